@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	glog "github.com/labstack/gommon/log"
+	"github.com/nats-io/nkeys"
+	"gopkg.in/yaml.v3"
+)
+
+// globalAccount is the account users are placed in if the policy has no account rules.
+const globalAccount = "$G"
+
+// AccountsPolicy places users in NATS accounts based on their token, e.g. one account
+// per OEM brand, so that tenants are isolated by the NATS server.
+type AccountsPolicy struct {
+	// Default is the account of tokens that match no rule, "$G" if empty.
+	Default string `yaml:"default"`
+	// Rules are evaluated in order, the first matching rule places the user.
+	Rules []AccountRule `yaml:"rules"`
+}
+
+// AccountRule matches tokens by the Keycloak realm, a client ID prefix or the value
+// of a custom claim. All conditions that are set must match.
+type AccountRule struct {
+	Account string `yaml:"account"`
+	// Realm is the realm name in the iss claim, ".../realms/<realm>".
+	Realm        string `yaml:"realm"`
+	ClientPrefix string `yaml:"clientPrefix"`
+	// Claim is a dot separated claim path. The claim must be Value, or a list containing it.
+	Claim string `yaml:"claim"`
+	Value string `yaml:"value"`
+
+	claimPath []string
+}
+
+// compile validates the rules and parses their claim paths.
+func (a *AccountsPolicy) compile() error {
+	if a.Default != "" && !isValidAccountName(a.Default) {
+		return fmt.Errorf("accounts.default: invalid account name %q", a.Default)
+	}
+
+	var errs []error
+	for i := range a.Rules {
+		rule := &a.Rules[i]
+		if !isValidAccountName(rule.Account) {
+			errs = append(errs, fmt.Errorf("accounts.rules[%d]: invalid account name %q", i, rule.Account))
+		}
+		if rule.Realm == "" && rule.ClientPrefix == "" && rule.Claim == "" {
+			errs = append(errs, fmt.Errorf("accounts.rules[%d]: no realm, clientPrefix or claim to match", i))
+		}
+		if rule.Claim != "" {
+			if rule.Value == "" {
+				errs = append(errs, fmt.Errorf("accounts.rules[%d]: claim %q has no value", i, rule.Claim))
+			}
+			path, err := parseClaimPath(rule.Claim)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("accounts.rules[%d]: %w", i, err))
+			}
+			rule.claimPath = path
+		} else if rule.Value != "" {
+			errs = append(errs, fmt.Errorf("accounts.rules[%d]: value without claim", i))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func isValidAccountName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\r\n.*>")
+}
+
+// account returns the NATS account the user of the token is placed in.
+func (p *Policy) account(claims jwt.MapClaims, clientID string) string {
+	if p.Accounts == nil {
+		return globalAccount
+	}
+	for _, rule := range p.Accounts.Rules {
+		if rule.matches(claims, clientID) {
+			return rule.Account
+		}
+	}
+	if p.Accounts.Default != "" {
+		return p.Accounts.Default
+	}
+	return globalAccount
+}
+
+func (r *AccountRule) matches(claims jwt.MapClaims, clientID string) bool {
+	if r.Realm != "" {
+		issuer, _ := claims["iss"].(string)
+		if realmOf(issuer) != r.Realm {
+			return false
+		}
+	}
+	if r.ClientPrefix != "" && !strings.HasPrefix(clientID, r.ClientPrefix) {
+		return false
+	}
+	if r.Claim != "" {
+		switch value := lookupClaim(claims, r.claimPath).(type) {
+		case string:
+			return value == r.Value
+		case []any:
+			for _, item := range value {
+				if item == r.Value {
+					return true
+				}
+			}
+			return false
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// realmOf returns the realm of a Keycloak issuer, e.g. "brand-a" for
+// "https://keycloak.example.com/realms/brand-a".
+func realmOf(issuer string) string {
+	i := strings.LastIndex(issuer, "/realms/")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(issuer[i+len("/realms/"):], "/")
+}
+
+// accountKey signs the user JWTs of an account.
+type accountKey struct {
+	keyPair nkeys.KeyPair
+	// account is the public key of the account if keyPair is one of its signing keys.
+	account string
+}
+
+// accountKeys holds the signing keys of the accounts users are placed in. Accounts
+// without an own key are signed with the issuer key of the callout, which is how the
+// NATS server expects it without operator mode: the issuer signs for all accounts and
+// the audience of the user JWT names the account.
+type accountKeys struct {
+	issuer nkeys.KeyPair
+	keys   map[string]accountKey
+}
+
+// accountKeyFile is the format of ACCOUNT_SIGNING_KEYS_FILE:
+//
+//	BRAND_A:
+//	  seed: SA...
+//	  account: AB...
+type accountKeyFile map[string]struct {
+	Seed    string `yaml:"seed"`
+	Account string `yaml:"account"`
+}
+
+// loadAccountKeys reads the signing keys per account from path. Without a file, all
+// user JWTs are signed with the issuer key.
+func loadAccountKeys(path string, issuer nkeys.KeyPair) (*accountKeys, error) {
+	k := &accountKeys{issuer: issuer, keys: map[string]accountKey{}}
+	if path == "" {
+		return k, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account signing keys: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var file accountKeyFile
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to decode account signing keys: %w", err)
+	}
+
+	for name, entry := range file {
+		keyPair, err := nkeys.FromSeed([]byte(entry.Seed))
+		if err != nil {
+			return nil, fmt.Errorf("account %q: invalid seed: %w", name, err)
+		}
+		public, err := keyPair.PublicKey()
+		if err != nil || !nkeys.IsValidPublicAccountKey(public) {
+			return nil, fmt.Errorf("account %q: seed is not an account key", name)
+		}
+		if entry.Account != "" && !nkeys.IsValidPublicAccountKey(entry.Account) {
+			return nil, fmt.Errorf("account %q: invalid account public key %q", name, entry.Account)
+		}
+		key := accountKey{keyPair: keyPair}
+		if entry.Account != public {
+			key.account = entry.Account
+		}
+		k.keys[name] = key
+	}
+	glog.Infof("Loaded signing keys for %d accounts", len(k.keys))
+	return k, nil
+}
+
+// signer returns the key that signs user JWTs for the account, and the public key of
+// the account if the key is one of its signing keys.
+func (k *accountKeys) signer(account string) (nkeys.KeyPair, string) {
+	if key, ok := k.keys[account]; ok {
+		return key.keyPair, key.account
+	}
+	return k.issuer, ""
+}
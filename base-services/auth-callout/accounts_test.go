@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nkeys"
+)
+
+const accountsTestPolicy = `
+roles:
+  edge-device:
+    sub:
+      allow: ["commands.{{.VIN}}.>"]
+accounts:
+  default: VEHICLES
+  rules:
+    - account: BRAND_A
+      realm: brand-a
+    - account: BRAND_B
+      clientPrefix: WBB
+    - account: FLEET
+      claim: tenant.groups
+      value: fleet
+    - account: BRAND_A_FLEET
+      realm: sdv-telemetry
+      clientPrefix: WAA
+`
+
+func TestPolicyAccount(t *testing.T) {
+	policy, err := parsePolicy([]byte(accountsTestPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		claims   string
+		clientID string
+		want     string
+	}{
+		{name: "realm", claims: `{"iss": "https://kc.example.com/realms/brand-a"}`, clientID: "WBB1", want: "BRAND_A"},
+		{name: "client prefix", claims: `{"iss": "https://kc.example.com/realms/other"}`, clientID: "WBB1", want: "BRAND_B"},
+		{name: "claim list", claims: `{"tenant": {"groups": ["x", "fleet"]}}`, clientID: "VIN1", want: "FLEET"},
+		{name: "claim value", claims: `{"tenant": {"groups": "fleet"}}`, clientID: "VIN1", want: "FLEET"},
+		{name: "claim mismatch", claims: `{"tenant": {"groups": ["x"]}}`, clientID: "VIN1", want: "VEHICLES"},
+		{name: "all conditions", claims: `{"iss": "https://kc.example.com/realms/sdv-telemetry"}`, clientID: "WAA1", want: "BRAND_A_FLEET"},
+		{name: "partial match", claims: `{"iss": "https://kc.example.com/realms/sdv-telemetry"}`, clientID: "VIN1", want: "VEHICLES"},
+		{name: "default", claims: `{}`, clientID: "VIN1", want: "VEHICLES"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.account(claimsFromJSON(t, tt.claims), tt.clientID); got != tt.want {
+				t.Errorf("expected account %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	withoutAccounts, err := parsePolicy([]byte(expiryTestPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := withoutAccounts.account(claimsFromJSON(t, `{}`), "VIN1"); got != globalAccount {
+		t.Errorf("expected %q without account rules, got %q", globalAccount, got)
+	}
+}
+
+func TestParsePolicyAccountValidation(t *testing.T) {
+	for name, accounts := range map[string]string{
+		"no condition":     "rules: [{account: A}]",
+		"no account":       "rules: [{realm: a}]",
+		"invalid account":  "rules: [{account: 'A.B', realm: a}]",
+		"claim no value":   "rules: [{account: A, claim: tenant}]",
+		"value no claim":   "rules: [{account: A, value: x}]",
+		"invalid claim":    "rules: [{account: A, claim: 'a..b', value: x}]",
+		"invalid default":  "default: 'A B'",
+		"unknown property": "rules: [{account: A, realm: a, issuer: x}]",
+	} {
+		t.Run(name, func(t *testing.T) {
+			policy := "roles:\n  edge-device:\n    sub:\n      allow: [\"commands.{{.VIN}}.>\"]\naccounts:\n  " + accounts + "\n"
+			if _, err := parsePolicy([]byte(policy)); err == nil {
+				t.Error("expected policy to be rejected")
+			}
+		})
+	}
+}
+
+func TestUserJWTAccountPlacement(t *testing.T) {
+	callout := newTestCallout(t, accountsTestPolicy)
+
+	// BRAND_A has its own signing key (operator mode), the others are signed by the issuer
+	brandA, _ := nkeys.CreateAccount()
+	brandAPublic, _ := brandA.PublicKey()
+	brandASigningKey, _ := nkeys.CreateAccount()
+	brandASigningSeed, _ := brandASigningKey.Seed()
+	brandASigningPublic, _ := brandASigningKey.PublicKey()
+
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	keysFile := "BRAND_A:\n  seed: " + string(brandASigningSeed) + "\n  account: " + brandAPublic + "\n"
+	if err := os.WriteFile(path, []byte(keysFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadAccountKeys(path, callout.accountKeyPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callout.accountKeys = keys
+	issuerPublic, _ := callout.accountKeyPair.PublicKey()
+
+	claims := validClaims(time.Now())
+	claims["iss"] = "https://kc.example.com/realms/brand-a"
+	userClaims, err := callout.authorize(t, callout.signer.sign(t, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userClaims.Audience != "BRAND_A" || userClaims.Issuer != brandASigningPublic || userClaims.IssuerAccount != brandAPublic {
+		t.Errorf("expected user JWT signed by the BRAND_A signing key, got audience %q issuer %q issuer account %q",
+			userClaims.Audience, userClaims.Issuer, userClaims.IssuerAccount)
+	}
+
+	claims = validClaims(time.Now())
+	userClaims, err = callout.authorize(t, callout.signer.sign(t, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userClaims.Audience != "VEHICLES" || userClaims.Issuer != issuerPublic || userClaims.IssuerAccount != "" {
+		t.Errorf("expected user JWT for VEHICLES signed by the issuer, got audience %q issuer %q issuer account %q",
+			userClaims.Audience, userClaims.Issuer, userClaims.IssuerAccount)
+	}
+}
+
+func TestLoadAccountKeysValidation(t *testing.T) {
+	user, _ := nkeys.CreateUser()
+	userSeed, _ := user.Seed()
+	account, _ := nkeys.CreateAccount()
+	accountSeed, _ := account.Seed()
+
+	for name, content := range map[string]string{
+		"invalid seed":        "A:\n  seed: nope\n",
+		"user seed":           "A:\n  seed: " + string(userSeed) + "\n",
+		"invalid account key": "A:\n  seed: " + string(accountSeed) + "\n  account: nope\n",
+		"unknown property":    "A:\n  seed: " + string(accountSeed) + "\n  key: x\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.yaml")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadAccountKeys(path, account); err == nil {
+				t.Error("expected keys to be rejected")
+			} else if strings.Contains(err.Error(), string(accountSeed)) {
+				t.Errorf("error contains the seed: %v", err)
+			}
+		})
+	}
+
+	// The issuer key signs for all accounts without a key file
+	keys, err := loadAccountKeys("", account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, issuerAccount := keys.signer("ANY"); key != account || issuerAccount != "" {
+		t.Error("expected the issuer key for accounts without own key")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	glog "github.com/labstack/gommon/log"
+	natsjwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// defaultAuditSubject is the NATS subject audit events are published to with AUDIT_SINK=nats.
+const defaultAuditSubject = "audit.auth"
+
+// auditEvent records a single authorization decision. It must never contain the
+// token or other credentials of the client.
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason,omitempty"`
+	Message  string    `json:"message,omitempty"`
+
+	ClientID string   `json:"clientId,omitempty"`
+	VIN      string   `json:"vin,omitempty"`
+	TokenID  string   `json:"tokenId,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+
+	Account      string    `json:"account,omitempty"`
+	GrantedRoles []string  `json:"grantedRoles,omitempty"`
+	Pub          []string  `json:"pub,omitempty"`
+	PubDeny      []string  `json:"pubDeny,omitempty"`
+	Sub          []string  `json:"sub,omitempty"`
+	SubDeny      []string  `json:"subDeny,omitempty"`
+	Expires      time.Time `json:"expires,omitzero"`
+
+	ServerID   string `json:"serverId,omitempty"`
+	ServerName string `json:"serverName,omitempty"`
+	ClientIP   string `json:"clientIp,omitempty"`
+	ClientName string `json:"clientName,omitempty"`
+	ClientKind string `json:"clientKind,omitempty"`
+	ClientType string `json:"clientType,omitempty"`
+}
+
+// newAuditEvent describes the decision on an auth request. req and result may be nil
+// if the request was rejected before they were known.
+func newAuditEvent(req *natsjwt.AuthorizationRequestClaims, result *authorization, decision, reason, message string) *auditEvent {
+	event := &auditEvent{
+		Time:     time.Now().UTC(),
+		Event:    "auth_decision",
+		Decision: decision,
+		Reason:   reason,
+		Message:  message,
+	}
+
+	if req != nil {
+		event.ServerID = req.Server.ID
+		event.ServerName = req.Server.Name
+		event.ClientIP = req.ClientInformation.Host
+		event.ClientName = req.ClientInformation.Name
+		event.ClientKind = req.ClientInformation.Kind
+		event.ClientType = req.ClientInformation.Type
+	}
+
+	if result == nil {
+		return event
+	}
+	if c := result.claims; c != nil {
+		event.ClientID = c.ClientID
+		event.VIN = c.VIN
+		event.TokenID = c.TokenID
+		event.Roles = c.Roles
+	}
+	// The permissions are only part of the event if they were issued
+	if g := result.grant; g != nil && decision == outcomeGranted {
+		event.Account = result.account
+		event.GrantedRoles = g.Roles
+		event.Pub = g.Permissions.Pub.Allow
+		event.PubDeny = g.Permissions.Pub.Deny
+		event.Sub = g.Permissions.Sub.Allow
+		event.SubDeny = g.Permissions.Sub.Deny
+		event.Expires = result.expires.UTC()
+	}
+	return event
+}
+
+// auditSink receives the audit events.
+type auditSink interface {
+	write(event *auditEvent) error
+}
+
+// writerAuditSink writes the events as JSON lines, e.g. to stdout or a file.
+type writerAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerAuditSink) write(event *auditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+// natsAuditSink publishes the events as JSON to a NATS subject.
+type natsAuditSink struct {
+	nc      *nats.Conn
+	subject string
+}
+
+func (s *natsAuditSink) write(event *auditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.nc.Publish(s.subject, data)
+}
+
+// discardAuditSink drops all events, for AUDIT_SINK=none.
+type discardAuditSink struct{}
+
+func (discardAuditSink) write(*auditEvent) error { return nil }
+
+// newAuditSink creates the sink for AUDIT_SINK: "stdout" (default), "file" with the
+// events appended to path, "nats" with the events published to subject, or "none".
+func newAuditSink(kind, path, subject string, nc *nats.Conn) (auditSink, error) {
+	if err := checkAuditSink(kind, path, subject); err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "file":
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit file: %w", err)
+		}
+		return &writerAuditSink{w: f}, nil
+	case "nats":
+		if subject == "" {
+			subject = defaultAuditSubject
+		}
+		return &natsAuditSink{nc: nc, subject: subject}, nil
+	case "none":
+		return discardAuditSink{}, nil
+	default:
+		return &writerAuditSink{w: os.Stdout}, nil
+	}
+}
+
+// checkAuditSink validates the audit settings without opening the sink.
+func checkAuditSink(kind, path, subject string) error {
+	switch kind {
+	case "", "stdout", "none":
+		return nil
+	case "file":
+		if path == "" {
+			return fmt.Errorf("AUDIT_FILE must be set for AUDIT_SINK=file")
+		}
+		return nil
+	case "nats":
+		if subject != "" && (!isValidSubject(subject) || strings.ContainsAny(subject, "*>")) {
+			return fmt.Errorf("invalid AUDIT_SUBJECT %q", subject)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown AUDIT_SINK %q, expected stdout, file, nats or none", kind)
+	}
+}
+
+// audit writes the event to the sink of the callout. A failing sink is logged, but
+// doesn't change the decision.
+func (a *authCallout) audit(event *auditEvent) {
+	if a.auditSink == nil {
+		return
+	}
+	if err := a.auditSink.write(event); err != nil {
+		glog.Errorf("Failed to write audit event: %v", err)
+	}
+}
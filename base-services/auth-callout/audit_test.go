@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	natsjwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+// auditRequest creates an auth request as the NATS server sends it.
+func auditRequest(t *testing.T, token string) *natsjwt.AuthorizationRequestClaims {
+	t.Helper()
+	userKeyPair, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userNkey, _ := userKeyPair.PublicKey()
+
+	req := natsjwt.NewAuthorizationRequestClaims(userNkey)
+	req.UserNkey = userNkey
+	req.Server = natsjwt.ServerID{ID: "NSERVER", Name: "nats-0"}
+	req.ClientInformation = natsjwt.ClientInformation{Host: "10.1.2.3", Kind: "Client", Type: "websocket", Name: "vehicle"}
+	req.ConnectOptions.Token = token
+	return req
+}
+
+func writeAuditEvent(t *testing.T, event *auditEvent) (string, map[string]any) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := (&writerAuditSink{w: &buf}).write(event); err != nil {
+		t.Fatal(err)
+	}
+	line := buf.String()
+	if !strings.HasSuffix(line, "\n") || strings.Count(line, "\n") != 1 {
+		t.Fatalf("expected a single JSON line, got %q", line)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		t.Fatal(err)
+	}
+	return line, fields
+}
+
+func TestAuditEventGranted(t *testing.T) {
+	callout := newTestCallout(t, expiryTestPolicy)
+	claims := validClaims(time.Now())
+	claims["jti"] = "token-1"
+	claims["realm_access"] = map[string]any{"roles": []string{"edge-device", "offline_access"}}
+	token := callout.signer.sign(t, claims)
+
+	req := auditRequest(t, token)
+	result, err := callout.authCallout.authorize(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line, fields := writeAuditEvent(t, newAuditEvent(req, result, outcomeGranted, "", ""))
+	if strings.Contains(line, token) || strings.Contains(line, strings.Split(token, ".")[2]) {
+		t.Fatalf("audit event contains the token: %s", line)
+	}
+
+	want := map[string]any{
+		"event":      "auth_decision",
+		"decision":   "granted",
+		"clientId":   "VIN1",
+		"vin":        "VIN1",
+		"tokenId":    "token-1",
+		"serverId":   "NSERVER",
+		"serverName": "nats-0",
+		"clientIp":   "10.1.2.3",
+		"clientType": "websocket",
+	}
+	for key, value := range want {
+		if fields[key] != value {
+			t.Errorf("expected %s=%v, got %v", key, value, fields[key])
+		}
+	}
+
+	event := newAuditEvent(req, result, outcomeGranted, "", "")
+	if !slices.Equal(event.Roles, []string{"edge-device", "offline_access"}) {
+		t.Errorf("expected token roles, got %v", event.Roles)
+	}
+	if !slices.Equal(event.GrantedRoles, []string{"edge-device"}) {
+		t.Errorf("expected granted role edge-device, got %v", event.GrantedRoles)
+	}
+	if !slices.Equal(event.Sub, []string{"commands.VIN1.>"}) {
+		t.Errorf("expected granted subscription, got %v", event.Sub)
+	}
+	if event.Expires.IsZero() {
+		t.Error("expected expiry of the user JWT")
+	}
+}
+
+func TestAuditEventRejected(t *testing.T) {
+	callout := newTestCallout(t, expiryTestPolicy)
+	claims := validClaims(time.Now())
+	claims["realm_access"] = map[string]any{"roles": []string{"unknown"}}
+
+	req := auditRequest(t, callout.signer.sign(t, claims))
+	result, err := callout.authCallout.authorize(context.Background(), req)
+	reason, message := rejection(err)
+	if reason != reasonNotAuthorized {
+		t.Fatalf("expected %s, got %v", reasonNotAuthorized, err)
+	}
+
+	event := newAuditEvent(req, result, outcomeRejected, reason, message)
+	if event.Decision != outcomeRejected || event.Reason != reasonNotAuthorized || event.Message == "" {
+		t.Errorf("unexpected decision %+v", event)
+	}
+	if event.ClientID != "VIN1" || !slices.Equal(event.Roles, []string{"unknown"}) {
+		t.Errorf("expected the claims of the rejected token, got %+v", event)
+	}
+	if event.Sub != nil || event.Pub != nil || !event.Expires.IsZero() {
+		t.Errorf("expected no permissions for a rejected request, got %+v", event)
+	}
+
+	// A request that can't be decoded has neither request nor claims
+	event = newAuditEvent(nil, nil, outcomeRejected, reasonMalformedRequest, "error when decoding nats temp token")
+	if event.ServerID != "" || event.ClientID != "" {
+		t.Errorf("unexpected fields %+v", event)
+	}
+}
+
+func TestNewAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := newAuditSink("file", path, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := sink.write(&auditEvent{Decision: outcomeGranted}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("expected 2 lines in audit file, got %d", lines)
+	}
+
+	if sink, err := newAuditSink("nats", "", "", nil); err != nil || sink.(*natsAuditSink).subject != defaultAuditSubject {
+		t.Errorf("expected NATS sink on %s, got %v (%v)", defaultAuditSubject, sink, err)
+	}
+	for _, tt := range []struct{ kind, path, subject string }{
+		{kind: "file"},
+		{kind: "nats", subject: "audit.>"},
+		{kind: "syslog"},
+	} {
+		if _, err := newAuditSink(tt.kind, tt.path, tt.subject, nil); err == nil {
+			t.Errorf("expected %+v to be rejected", tt)
+		}
+	}
+}
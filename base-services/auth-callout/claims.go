@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// defaultRolesClaimPath is where Keycloak puts the realm roles of a token.
+const defaultRolesClaimPath = "realm_access.roles"
+
+// Reason codes of rejected auth requests. They are part of the error response and the logs.
+const (
+	reasonMissingClaim   = "missing_claim"
+	reasonMalformedClaim = "malformed_claim"
+)
+
+// authError rejects an auth request for a reason that can be reported to the client.
+type authError struct {
+	Reason string
+	Err    error
+}
+
+func (e *authError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *authError) Unwrap() error {
+	return e.Err
+}
+
+func newAuthError(reason string, format string, args ...any) *authError {
+	return &authError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// tokenClaims are the claims of a validated token that are used for authorization.
+type tokenClaims struct {
+	// ClientID is the azp claim, the Keycloak client the token was issued to.
+	ClientID string
+	// VIN identifies the vehicle. Vehicles are Keycloak clients, so it is the client ID.
+	VIN string
+	// TokenID is the jti claim, empty if the token has none.
+	TokenID string
+	Roles   []string
+	// Fleets are the fleets the token grants access to, from the optional fleets claim.
+	Fleets []string
+	// Expires is the exp claim. The issued NATS user JWT must not outlive the token.
+	Expires time.Time
+}
+
+// parseClaimPath splits a dot separated claim path like "resource_access.car.roles".
+func parseClaimPath(path string) ([]string, error) {
+	if path == "" {
+		path = defaultRolesClaimPath
+	}
+	parts := strings.Split(path, ".")
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("invalid claim path %q", path)
+		}
+	}
+	return parts, nil
+}
+
+// extractClaims reads the client ID, roles and expiry from the token claims. Missing or
+// malformed claims are reported as authError instead of panicking.
+func extractClaims(claims jwt.MapClaims, rolesPath []string) (*tokenClaims, error) {
+	clientID, err := stringClaim(claims, "azp")
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := stringListClaim(claims, rolesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	expires, err := claims.GetExpirationTime()
+	if err != nil {
+		return nil, &authError{Reason: reasonMalformedClaim, Err: err}
+	}
+	if expires == nil {
+		return nil, newAuthError(reasonMissingClaim, "token has no exp claim")
+	}
+
+	// The jti is optional, it identifies the token in the audit log and revocations
+	tokenID, _ := claims["jti"].(string)
+
+	return &tokenClaims{ClientID: clientID, VIN: clientID, TokenID: tokenID, Roles: roles, Expires: expires.Time}, nil
+}
+
+func stringClaim(claims jwt.MapClaims, name string) (string, error) {
+	value, ok := claims[name]
+	if !ok || value == nil {
+		return "", newAuthError(reasonMissingClaim, "token has no %s claim", name)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", newAuthError(reasonMalformedClaim, "claim %s is %T, expected string", name, value)
+	}
+	if s == "" {
+		return "", newAuthError(reasonMalformedClaim, "claim %s is empty", name)
+	}
+	return s, nil
+}
+
+// stringListClaim follows the path through nested objects and returns the string
+// list at its end.
+func stringListClaim(claims jwt.MapClaims, path []string) ([]string, error) {
+	name := strings.Join(path, ".")
+
+	var value any = map[string]any(claims)
+	for i, part := range path {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, newAuthError(reasonMalformedClaim, "claim %s is %T, expected object", strings.Join(path[:i], "."), value)
+		}
+		value, ok = object[part]
+		if !ok || value == nil {
+			return nil, newAuthError(reasonMissingClaim, "token has no %s claim", name)
+		}
+	}
+
+	list, ok := value.([]any)
+	if !ok {
+		return nil, newAuthError(reasonMalformedClaim, "claim %s is %T, expected list", name, value)
+	}
+
+	values := make([]string, 0, len(list))
+	for i, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, newAuthError(reasonMalformedClaim, "claim %s[%d] is %T, expected string", name, i, item)
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// lookupClaim follows the path through nested objects and returns the value at its
+// end, nil if there is none.
+func lookupClaim(claims jwt.MapClaims, path []string) any {
+	var value any = map[string]any(claims)
+	for _, part := range path {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	return value
+}
+
+// rejection returns the reason code and description of an authError. Other errors
+// are internal errors whose details are not reported to the client.
+func rejection(err error) (reason string, message string) {
+	var authErr *authError
+	if errors.As(err, &authErr) {
+		return authErr.Reason, authErr.Err.Error()
+	}
+	return reasonInternalError, "internal server error"
+}
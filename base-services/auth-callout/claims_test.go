@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// claimsFromJSON decodes claims the same way jwt.Parse does.
+func claimsFromJSON(t *testing.T, data string) jwt.MapClaims {
+	t.Helper()
+	var claims jwt.MapClaims
+	if err := json.Unmarshal([]byte(data), &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestExtractClaims(t *testing.T) {
+	tests := []struct {
+		name       string
+		claims     string
+		rolesPath  string
+		wantClient string
+		wantRoles  []string
+		wantReason string
+	}{
+		{
+			name:       "realm roles",
+			claims:     `{"azp": "VIN1", "exp": 1700000000, "realm_access": {"roles": ["edge-device", "telemetry-client"]}}`,
+			wantClient: "VIN1",
+			wantRoles:  []string{"edge-device", "telemetry-client"},
+		},
+		{
+			name:       "empty roles",
+			claims:     `{"azp": "VIN1", "exp": 1700000000, "realm_access": {"roles": []}}`,
+			wantClient: "VIN1",
+			wantRoles:  []string{},
+		},
+		{
+			name:       "client roles",
+			claims:     `{"azp": "collector", "exp": 1700000000, "resource_access": {"car": {"roles": ["telemetry-collector"]}}}`,
+			rolesPath:  "resource_access.car.roles",
+			wantClient: "collector",
+			wantRoles:  []string{"telemetry-collector"},
+		},
+		{
+			name:       "missing realm_access",
+			claims:     `{"azp": "VIN1"}`,
+			wantReason: reasonMissingClaim,
+		},
+		{
+			name:       "missing roles",
+			claims:     `{"azp": "VIN1", "realm_access": {}}`,
+			wantReason: reasonMissingClaim,
+		},
+		{
+			name:       "null roles",
+			claims:     `{"azp": "VIN1", "realm_access": {"roles": null}}`,
+			wantReason: reasonMissingClaim,
+		},
+		{
+			name:       "realm_access not an object",
+			claims:     `{"azp": "VIN1", "realm_access": ["edge-device"]}`,
+			wantReason: reasonMalformedClaim,
+		},
+		{
+			name:       "roles not a list",
+			claims:     `{"azp": "VIN1", "realm_access": {"roles": "edge-device"}}`,
+			wantReason: reasonMalformedClaim,
+		},
+		{
+			name:       "non-string role",
+			claims:     `{"azp": "VIN1", "realm_access": {"roles": ["edge-device", 42]}}`,
+			wantReason: reasonMalformedClaim,
+		},
+		{
+			name:       "missing client roles",
+			claims:     `{"azp": "collector", "resource_access": {"other": {"roles": ["telemetry-collector"]}}}`,
+			rolesPath:  "resource_access.car.roles",
+			wantReason: reasonMissingClaim,
+		},
+		{
+			name:       "missing azp",
+			claims:     `{"realm_access": {"roles": ["edge-device"]}}`,
+			wantReason: reasonMissingClaim,
+		},
+		{
+			name:       "non-string azp",
+			claims:     `{"azp": 123, "realm_access": {"roles": ["edge-device"]}}`,
+			wantReason: reasonMalformedClaim,
+		},
+		{
+			name:       "missing exp",
+			claims:     `{"azp": "VIN1", "realm_access": {"roles": ["edge-device"]}}`,
+			wantReason: reasonMissingClaim,
+		},
+		{
+			name:       "non-numeric exp",
+			claims:     `{"azp": "VIN1", "exp": "tomorrow", "realm_access": {"roles": ["edge-device"]}}`,
+			wantReason: reasonMalformedClaim,
+		},
+		{
+			name:       "empty azp",
+			claims:     `{"azp": "", "realm_access": {"roles": ["edge-device"]}}`,
+			wantReason: reasonMalformedClaim,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := parseClaimPath(tt.rolesPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := extractClaims(claimsFromJSON(t, tt.claims), path)
+			if tt.wantReason != "" {
+				var authErr *authError
+				if !errors.As(err, &authErr) {
+					t.Fatalf("expected authError, got %v", err)
+				}
+				if authErr.Reason != tt.wantReason {
+					t.Errorf("expected reason %q, got %q (%v)", tt.wantReason, authErr.Reason, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.ClientID != tt.wantClient {
+				t.Errorf("expected client %q, got %q", tt.wantClient, got.ClientID)
+			}
+			if !slices.Equal(got.Roles, tt.wantRoles) {
+				t.Errorf("expected roles %v, got %v", tt.wantRoles, got.Roles)
+			}
+			if got.Expires.Unix() != 1700000000 {
+				t.Errorf("expected expiry 1700000000, got %d", got.Expires.Unix())
+			}
+		})
+	}
+}
+
+func TestParseClaimPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []string
+		wantErr bool
+	}{
+		{path: "", want: []string{"realm_access", "roles"}},
+		{path: "resource_access.car.roles", want: []string{"resource_access", "car", "roles"}},
+		{path: "roles", want: []string{"roles"}},
+		{path: "resource_access..roles", wantErr: true},
+		{path: ".roles", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseClaimPath(tt.path)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.path)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("%q: expected %v, got %v (%v)", tt.path, tt.want, got, err)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	glog "github.com/labstack/gommon/log"
+	"github.com/lestrrat-go/jwx/jwk"
+	natsjwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// defaultShutdownTimeout is how long the pending auth requests are drained on shutdown.
+const defaultShutdownTimeout = 10 * time.Second
+
+// logLevels are the accepted values of LOG_LEVEL.
+var logLevels = map[string]glog.Lvl{
+	"DEBUG": glog.DEBUG,
+	"INFO":  glog.INFO,
+	"WARN":  glog.WARN,
+	"ERROR": glog.ERROR,
+}
+
+// redacted replaces secret values in logs.
+const redacted = "[REDACTED]"
+
+// natsAuth holds the credentials of a NATS connection, at most one kind is set.
+type natsAuth struct {
+	user     string
+	password string
+	// credsFile is a .creds file with the user JWT and its nkey seed, e.g. from nsc.
+	credsFile string
+	// nkey is a user nkey, whose public key is configured at the NATS server.
+	nkey nkeys.KeyPair
+}
+
+// configured reports whether any credentials are set.
+func (a natsAuth) configured() bool {
+	return a.user != "" || a.credsFile != "" || a.nkey != nil
+}
+
+// String describes the credentials for logs, without secrets.
+func (a natsAuth) String() string {
+	switch {
+	case a.user != "":
+		return fmt.Sprintf("user %s with password %s", a.user, redacted)
+	case a.credsFile != "":
+		return fmt.Sprintf("credentials from %s", a.credsFile)
+	case a.nkey != nil:
+		public, _ := a.nkey.PublicKey()
+		return fmt.Sprintf("nkey %s", public)
+	default:
+		return "no credentials"
+	}
+}
+
+// natsConfig holds the server, credentials and TLS settings of a NATS connection of the callout.
+type natsConfig struct {
+	url string
+	natsAuth
+	// tlsCertFile and tlsKeyFile are the client certificate, tlsCAFile verifies the server.
+	tlsCertFile string
+	tlsKeyFile  string
+	tlsCAFile   string
+}
+
+// options returns the connect options of the credentials and TLS settings.
+func (c natsConfig) options() []nats.Option {
+	var opts []nats.Option
+	switch {
+	case c.user != "":
+		opts = append(opts, nats.UserInfo(c.user, c.password))
+	case c.credsFile != "":
+		opts = append(opts, nats.UserCredentials(c.credsFile))
+	case c.nkey != nil:
+		public, _ := c.nkey.PublicKey()
+		opts = append(opts, nats.Nkey(public, c.nkey.Sign))
+	}
+	if c.tlsCertFile != "" {
+		opts = append(opts, nats.ClientCert(c.tlsCertFile, c.tlsKeyFile))
+	}
+	if c.tlsCAFile != "" {
+		opts = append(opts, nats.RootCAs(c.tlsCAFile))
+	}
+	return opts
+}
+
+// String describes the connection for logs, without secrets.
+func (c natsConfig) String() string {
+	s := fmt.Sprintf("%s with %s", redactURL(c.url), c.natsAuth)
+	if c.tlsCertFile != "" {
+		s += fmt.Sprintf(" and TLS client certificate %s", c.tlsCertFile)
+	}
+	return s
+}
+
+// redactURL replaces the password of a URL, or of each URL of a comma separated list
+// like NATS_URL, with xxxxx for logs. A value that can't be parsed is redacted completely.
+func redactURL(value string) string {
+	urls := strings.Split(value, ",")
+	for i, raw := range urls {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil {
+			return redacted
+		}
+		urls[i] = u.Redacted()
+	}
+	return strings.Join(urls, ",")
+}
+
+// config is the configuration of the service from the environment. It is loaded and
+// validated at startup, before anything is connected.
+type config struct {
+	logLevel   string
+	httpAddr   string
+	nats       natsConfig
+	systemNats natsConfig
+
+	accountKeyPair         nkeys.KeyPair
+	accountSigningKeysFile string
+	xkey                   nkeys.KeyPair
+
+	initialKeys         jwk.Set
+	jwksURL             string
+	jwksRefreshInterval time.Duration
+	jwksCAFile          string
+
+	policyFile      string
+	rolesClaimPath  []string
+	fleetsClaimPath []string
+
+	tokenIssuers   []string
+	tokenAudiences []string
+	tokenTypes     []string
+	tokenMaxAge    time.Duration
+	tokenLeeway    time.Duration
+	maxExpiry      time.Duration
+
+	consentFile     string
+	consentURL      string
+	consentCacheTTL time.Duration
+	fleetFile       string
+	fleetURL        string
+	fleetCacheTTL   time.Duration
+
+	auditSink    string
+	auditFile    string
+	auditSubject string
+
+	revocationFile     string
+	revocationKVBucket string
+
+	queueGroup      string
+	workers         int
+	queueSize       int
+	requestTimeout  time.Duration
+	shutdownTimeout time.Duration
+}
+
+// loadConfig reads the configuration with getenv, e.g. os.Getenv. All invalid values
+// are reported at once, each with the name of its variable.
+func loadConfig(getenv func(string) string) (*config, error) {
+	env := &envReader{getenv: getenv}
+	c := &config{
+		logLevel: env.string("LOG_LEVEL", "INFO"),
+		httpAddr: env.string("HTTP_ADDR", defaultHTTPAddr),
+		nats:     loadNatsConfig(env),
+
+		accountSigningKeysFile: getenv("ACCOUNT_SIGNING_KEYS_FILE"),
+		jwksURL:                getenv("KEYCLOAK_JWKS_URL"),
+		jwksRefreshInterval:    env.duration("KEYCLOAK_JWKS_REFRESH_INTERVAL", defaultJwksRefreshInterval, false),
+		jwksCAFile:             getenv("KEYCLOAK_JWKS_CA_FILE"),
+		policyFile:             getenv("AUTH_POLICY_FILE"),
+
+		tokenIssuers:   splitList(getenv("TOKEN_ISSUER")),
+		tokenAudiences: splitList(getenv("TOKEN_AUDIENCE")),
+		tokenTypes:     splitList(env.string("TOKEN_TYPES", "Bearer")),
+		tokenMaxAge:    env.duration("TOKEN_MAX_AGE", 0, true),
+		tokenLeeway:    env.duration("TOKEN_LEEWAY", defaultTokenLeeway, true),
+		maxExpiry:      env.duration("NATS_JWT_MAX_EXPIRY", defaultNatsJwtMaxExpiry, false),
+
+		consentFile:     getenv("CONSENT_FILE"),
+		consentURL:      getenv("CONSENT_URL"),
+		consentCacheTTL: env.duration("CONSENT_CACHE_TTL", defaultConsentCacheTTL, true),
+		fleetFile:       getenv("FLEET_FILE"),
+		fleetURL:        getenv("FLEET_URL"),
+		fleetCacheTTL:   env.duration("FLEET_CACHE_TTL", defaultFleetCacheTTL, true),
+
+		auditSink:    env.string("AUDIT_SINK", "stdout"),
+		auditFile:    getenv("AUDIT_FILE"),
+		auditSubject: env.string("AUDIT_SUBJECT", defaultAuditSubject),
+
+		revocationFile:     getenv("REVOCATION_FILE"),
+		revocationKVBucket: getenv("REVOCATION_KV_BUCKET"),
+
+		queueGroup:      env.string("AUTH_QUEUE_GROUP", defaultQueueGroup),
+		workers:         env.int("AUTH_WORKERS", defaultWorkers, 1),
+		queueSize:       env.int("AUTH_QUEUE_SIZE", defaultQueueSize, 0),
+		requestTimeout:  env.duration("AUTH_REQUEST_TIMEOUT", defaultRequestTimeout, false),
+		shutdownTimeout: env.duration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout, false),
+	}
+	// The system user connects to the same servers, only with other credentials
+	c.systemNats = c.nats
+	c.systemNats.natsAuth = env.natsAuth("SYSTEM_NATS_")
+
+	if _, ok := logLevels[c.logLevel]; !ok {
+		env.fail("LOG_LEVEL", "unknown level %q, expected DEBUG, INFO, WARN or ERROR", c.logLevel)
+	}
+
+	c.accountKeyPair = env.accountSeed("JWT_ACC_SIGNING_KEY")
+	if seed := getenv("XKEY_SEED"); seed != "" {
+		var err error
+		if c.xkey, err = nkeys.FromCurveSeed([]byte(seed)); err != nil {
+			env.fail("XKEY_SEED", "not a curve seed (SX...): %v", err)
+		}
+	}
+
+	// The Keycloak keys come from the JWKS endpoint, the static key set, or both
+	if b64 := getenv("KEYCLOAK_JWK_B64"); b64 != "" {
+		c.initialKeys = env.jwkSet("KEYCLOAK_JWK_B64", b64)
+	} else if c.jwksURL == "" {
+		env.fail("KEYCLOAK_JWKS_URL", "either KEYCLOAK_JWKS_URL or KEYCLOAK_JWK_B64 must be set")
+	}
+	if c.jwksURL != "" {
+		env.httpURL("KEYCLOAK_JWKS_URL", c.jwksURL)
+	}
+
+	var err error
+	if c.rolesClaimPath, err = parseClaimPath(getenv("ROLES_CLAIM")); err != nil {
+		env.fail("ROLES_CLAIM", "%v", err)
+	}
+	if c.fleetsClaimPath, err = parseClaimPath(env.string("FLEETS_CLAIM", defaultFleetsClaimPath)); err != nil {
+		env.fail("FLEETS_CLAIM", "%v", err)
+	}
+
+	if c.consentFile != "" && c.consentURL != "" {
+		env.fail("CONSENT_URL", "can't be set together with CONSENT_FILE")
+	} else if c.consentURL != "" {
+		env.httpURL("CONSENT_URL", c.consentURL)
+	}
+	if c.fleetFile != "" && c.fleetURL != "" {
+		env.fail("FLEET_URL", "can't be set together with FLEET_FILE")
+	} else if c.fleetURL != "" {
+		env.httpURL("FLEET_URL", c.fleetURL)
+	}
+	if c.revocationFile != "" && c.revocationKVBucket != "" {
+		env.fail("REVOCATION_KV_BUCKET", "can't be set together with REVOCATION_FILE")
+	}
+	if err := checkAuditSink(c.auditSink, c.auditFile, c.auditSubject); err != nil {
+		env.fail("AUDIT_SINK", "%v", err)
+	}
+	if c.queueGroup != "" && !isValidToken(c.queueGroup) {
+		env.fail("AUTH_QUEUE_GROUP", "invalid queue group %q", c.queueGroup)
+	}
+
+	if err := errors.Join(env.errs...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadNatsConfig reads the settings of the callout's own NATS connection, which the
+// revoke command uses as well.
+func loadNatsConfig(env *envReader) natsConfig {
+	c := natsConfig{
+		url:         env.string("NATS_URL", nats.DefaultURL),
+		natsAuth:    env.natsAuth("NATS_"),
+		tlsCertFile: env.getenv("NATS_TLS_CERT_FILE"),
+		tlsKeyFile:  env.getenv("NATS_TLS_KEY_FILE"),
+		tlsCAFile:   env.getenv("NATS_TLS_CA_FILE"),
+	}
+	if (c.tlsCertFile == "") != (c.tlsKeyFile == "") {
+		env.fail("NATS_TLS_CERT_FILE", "must be set together with NATS_TLS_KEY_FILE")
+	} else if c.tlsCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.tlsCertFile, c.tlsKeyFile); err != nil {
+			env.fail("NATS_TLS_CERT_FILE", "invalid client certificate: %v", err)
+		}
+	}
+	if c.tlsCAFile != "" {
+		if _, err := loadCertPool(c.tlsCAFile); err != nil {
+			env.fail("NATS_TLS_CA_FILE", "%v", err)
+		}
+	}
+	return c
+}
+
+// envReader reads and parses environment variables and collects the errors.
+type envReader struct {
+	getenv func(string) string
+	errs   []error
+}
+
+func (r *envReader) fail(name, format string, args ...any) {
+	r.errs = append(r.errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+}
+
+// string returns the value of the variable, or def if it is empty.
+func (r *envReader) string(name, def string) string {
+	if value := r.getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// duration parses a Go duration. Negative durations are invalid, zero only if allowZero.
+func (r *envReader) duration(name string, def time.Duration, allowZero bool) time.Duration {
+	value := r.getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 || (d == 0 && !allowZero) {
+		r.fail(name, "invalid duration %q", value)
+		return def
+	}
+	return d
+}
+
+// int parses an integer of at least minimum.
+func (r *envReader) int(name string, def, minimum int) int {
+	value := r.getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < minimum {
+		r.fail(name, "invalid value %q, expected a number of at least %d", value, minimum)
+		return def
+	}
+	return n
+}
+
+// accountSeed parses a required account seed (SA...).
+func (r *envReader) accountSeed(name string) nkeys.KeyPair {
+	seed := r.getenv(name)
+	if seed == "" {
+		r.fail(name, "must be set")
+		return nil
+	}
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		r.fail(name, "not an nkey seed: %v", err)
+		return nil
+	}
+	if public, _ := kp.PublicKey(); !nkeys.IsValidPublicAccountKey(public) {
+		r.fail(name, "not an account seed (SA...)")
+		return nil
+	}
+	return kp
+}
+
+// natsAuth reads the credentials of a NATS connection from the variables with the
+// prefix: USER and PASSWORD, CREDS_FILE or NKEY_SEED. Without any, the connection is
+// not authenticated.
+func (r *envReader) natsAuth(prefix string) natsAuth {
+	a := natsAuth{
+		user:      r.getenv(prefix + "USER"),
+		password:  r.getenv(prefix + "PASSWORD"),
+		credsFile: r.getenv(prefix + "CREDS_FILE"),
+	}
+	if (a.user == "") != (a.password == "") {
+		r.fail(prefix+"USER", "must be set together with %sPASSWORD", prefix)
+	}
+	if a.credsFile != "" {
+		if err := checkCredsFile(a.credsFile); err != nil {
+			r.fail(prefix+"CREDS_FILE", "%v", err)
+		}
+	}
+	if seed := r.getenv(prefix + "NKEY_SEED"); seed != "" {
+		kp, err := nkeys.FromSeed([]byte(seed))
+		if err != nil {
+			r.fail(prefix+"NKEY_SEED", "not an nkey seed: %v", err)
+		} else if public, _ := kp.PublicKey(); !nkeys.IsValidPublicUserKey(public) {
+			r.fail(prefix+"NKEY_SEED", "not a user seed (SU...)")
+		} else {
+			a.nkey = kp
+		}
+	}
+
+	var kinds int
+	for _, name := range []string{"PASSWORD", "CREDS_FILE", "NKEY_SEED"} {
+		if r.getenv(prefix+name) != "" {
+			kinds++
+		}
+	}
+	if kinds > 1 {
+		r.fail(prefix+"CREDS_FILE", "only one of %[1]sUSER/%[1]sPASSWORD, %[1]sCREDS_FILE and %[1]sNKEY_SEED can be set", prefix)
+	}
+	return a
+}
+
+// checkCredsFile checks that a .creds file contains a user JWT and its nkey seed.
+func checkCredsFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	token, err := natsjwt.ParseDecoratedJWT(data)
+	if err == nil {
+		_, err = natsjwt.DecodeUserClaims(token)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid credentials file %s: %w", path, err)
+	}
+	kp, err := natsjwt.ParseDecoratedUserNKey(data)
+	if err != nil {
+		return fmt.Errorf("invalid credentials file %s: %w", path, err)
+	}
+	kp.Wipe()
+	return nil
+}
+
+// jwkSet parses a base64 encoded JWK set.
+func (r *envReader) jwkSet(name, value string) jwk.Set {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		r.fail(name, "invalid base64: %v", err)
+		return nil
+	}
+	set, err := jwk.Parse(data)
+	if err != nil {
+		r.fail(name, "invalid JWK set: %v", err)
+		return nil
+	}
+	return set
+}
+
+// httpURL checks that the value is an absolute http or https URL.
+func (r *envReader) httpURL(name, value string) {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		r.fail(name, "invalid URL %q, expected http(s)://<host>/...", redactURL(value))
+	}
+}
+
+// splitList splits a comma separated list and drops empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	glog "github.com/labstack/gommon/log"
+	"github.com/nats-io/nats.go"
+)
+
+// kickTimeout is how long the NATS server may take to disconnect a client.
+const kickTimeout = 2 * time.Second
+
+// minPruneSize is the number of tracked connections or cache entries from which the
+// expired ones are dropped.
+const minPruneSize = 1024
+
+// trackedConnection is a client connection the callout issued a user JWT for.
+type trackedConnection struct {
+	serverID string
+	// cid is the client ID of the connection on the server.
+	cid     uint64
+	claims  *tokenClaims
+	expires time.Time
+}
+
+// connectionTracker remembers the connections the callout authorized until their
+// user JWT expires, so they can be disconnected when their token, vehicle or client
+// is revoked. The NATS server disconnects them anyway once the user JWT expires.
+// Closed connections are kept until then as well, so the tracker holds at most the
+// connections authorized within the maximum user JWT lifetime.
+type connectionTracker struct {
+	// kick disconnects a client from a server.
+	kick func(serverID string, cid uint64) error
+	now  func() time.Time
+
+	mu          sync.Mutex
+	connections []trackedConnection
+	// pruneAt is the number of tracked connections at which add drops the expired ones next.
+	pruneAt int
+}
+
+func newConnectionTracker(kick func(serverID string, cid uint64) error) *connectionTracker {
+	return &connectionTracker{kick: kick, now: time.Now}
+}
+
+// add tracks an authorized connection. Expired connections are dropped whenever the
+// number of tracked connections doubled since the last time, so adding stays cheap.
+func (t *connectionTracker) add(serverID string, cid uint64, claims *tokenClaims, expires time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.connections) >= t.pruneAt {
+		now := t.now()
+		t.connections = slices.DeleteFunc(t.connections, func(c trackedConnection) bool { return !c.expires.After(now) })
+		t.pruneAt = max(2*len(t.connections), minPruneSize)
+	}
+	t.connections = append(t.connections, trackedConnection{serverID: serverID, cid: cid, claims: claims, expires: expires})
+}
+
+// disconnect kicks all tracked connections the revocation applies to and returns
+// how many were kicked. Expired connections are dropped on the way.
+func (t *connectionTracker) disconnect(r Revocation) int {
+	t.mu.Lock()
+	now := t.now()
+	var matched []trackedConnection
+	kept := t.connections[:0]
+	for _, c := range t.connections {
+		switch {
+		case !c.expires.After(now):
+		case r.matches(c.claims):
+			matched = append(matched, c)
+		default:
+			kept = append(kept, c)
+		}
+	}
+	t.connections = kept
+	t.mu.Unlock()
+
+	kicked := 0
+	for _, c := range matched {
+		if err := t.kick(c.serverID, c.cid); err != nil {
+			glog.Errorf("Failed to disconnect client %d on server %s after revoking %s: %v", c.cid, c.serverID, r, err)
+			continue
+		}
+		glog.Infof("Disconnected client %d (%s) on server %s after revoking %s", c.cid, c.claims.ClientID, c.serverID, r)
+		kicked++
+	}
+	return kicked
+}
+
+// natsKicker disconnects clients with the KICK request of the NATS system account.
+// The connection must be a user of the system account.
+func natsKicker(sys *nats.Conn) func(serverID string, cid uint64) error {
+	return func(serverID string, cid uint64) error {
+		req, err := json.Marshal(map[string]uint64{"cid": cid})
+		if err != nil {
+			return err
+		}
+		msg, err := sys.Request(fmt.Sprintf("$SYS.REQ.SERVER.%s.KICK", serverID), req, kickTimeout)
+		if err != nil {
+			return err
+		}
+
+		var resp struct {
+			Error *struct {
+				Description string `json:"description"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(msg.Data, &resp); err != nil {
+			return fmt.Errorf("invalid kick response: %w", err)
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("kick failed: %s", resp.Error.Description)
+		}
+		return nil
+	}
+}
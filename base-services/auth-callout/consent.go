@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	glog "github.com/labstack/gommon/log"
+	"gopkg.in/yaml.v3"
+)
+
+// allFamilies is the data family of a consent that covers all telemetry of a vehicle.
+const allFamilies = "*"
+
+// Consent allows a service to access the given data families of a vehicle until it expires.
+type Consent struct {
+	ClientID string    `json:"clientId" yaml:"clientId"`
+	VIN      string    `json:"vin" yaml:"vin"`
+	Families []string  `json:"families" yaml:"families"`
+	Expires  time.Time `json:"expires,omitzero" yaml:"expires,omitempty"`
+}
+
+// active reports whether the consent is valid at the given time. A consent without
+// expiry never expires.
+func (c Consent) active(now time.Time) bool {
+	return c.Expires.IsZero() || now.Before(c.Expires)
+}
+
+func (c Consent) validate() error {
+	if !isValidToken(c.ClientID) {
+		return fmt.Errorf("invalid clientId %q", c.ClientID)
+	}
+	if !isValidToken(c.VIN) {
+		return fmt.Errorf("invalid vin %q", c.VIN)
+	}
+	if len(c.Families) == 0 {
+		return fmt.Errorf("consent of %q for %q has no families", c.ClientID, c.VIN)
+	}
+	for _, family := range c.Families {
+		if family != allFamilies && !isValidToken(family) {
+			return fmt.Errorf("invalid family %q", family)
+		}
+	}
+	return nil
+}
+
+// ConsentStore looks up which vehicles and data families a service may access.
+type ConsentStore interface {
+	// ActiveConsents returns the consents of the client that are active at the given time.
+	ActiveConsents(ctx context.Context, clientID string, now time.Time) ([]Consent, error)
+}
+
+// activeConsents filters the consents of a client by their expiry.
+func activeConsents(consents []Consent, clientID string, now time.Time) []Consent {
+	var active []Consent
+	for _, consent := range consents {
+		if consent.ClientID == clientID && consent.active(now) {
+			active = append(active, consent)
+		}
+	}
+	return active
+}
+
+// consentDocument is the format of the file read by fileConsentStore.
+type consentDocument struct {
+	Consents []Consent `json:"consents" yaml:"consents"`
+}
+
+func parseConsents(data []byte) ([]Consent, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	var doc consentDocument
+	if err := decoder.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to decode consents: %w", err)
+	}
+	for i, consent := range doc.Consents {
+		if err := consent.validate(); err != nil {
+			return nil, fmt.Errorf("consent %d: %w", i, err)
+		}
+	}
+	return doc.Consents, nil
+}
+
+// fileConsentStore reads consents from a YAML or JSON file that is reloaded when it changes.
+type fileConsentStore struct {
+	file     *watchedFile
+	consents atomic.Pointer[[]Consent]
+}
+
+func newFileConsentStore(path string) (*fileConsentStore, error) {
+	s := &fileConsentStore{file: &watchedFile{path: path}}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileConsentStore) ActiveConsents(_ context.Context, clientID string, now time.Time) ([]Consent, error) {
+	return activeConsents(*s.consents.Load(), clientID, now), nil
+}
+
+// reload re-reads the consent file. An invalid file is rejected and the previous
+// consents stay active.
+func (s *fileConsentStore) reload() (bool, error) {
+	data, changed, err := s.file.readIfChanged()
+	if err != nil || !changed {
+		return false, err
+	}
+	consents, err := parseConsents(data)
+	if err != nil {
+		return false, err
+	}
+	s.consents.Store(&consents)
+	s.file.commit(data)
+	glog.Infof("Loaded %d consents from %s", len(consents), s.file.path)
+	return true, nil
+}
+
+func (s *fileConsentStore) watch(ctx context.Context, interval time.Duration) {
+	watchFile(ctx, "consents", interval, s.reload)
+}
+
+// httpConsentStore queries a consent service with GET <url>?clientId=<id>. The service
+// responds with a JSON document in the consentDocument format. Responses are cached per
+// client for cacheTTL, errors are not cached. Expired responses are dropped whenever the
+// cache doubled in size, so it doesn't grow with every client ID ever seen.
+type httpConsentStore struct {
+	url      string
+	client   *http.Client
+	cacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedConsents
+	// pruneAt is the number of cached clients at which the expired ones are dropped next.
+	pruneAt int
+}
+
+type cachedConsents struct {
+	consents []Consent
+	fetched  time.Time
+}
+
+func newHTTPConsentStore(url string, client *http.Client, cacheTTL time.Duration) *httpConsentStore {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	return &httpConsentStore{url: url, client: client, cacheTTL: cacheTTL, cache: make(map[string]cachedConsents)}
+}
+
+func (s *httpConsentStore) ActiveConsents(ctx context.Context, clientID string, now time.Time) ([]Consent, error) {
+	s.mu.Lock()
+	cached, ok := s.cache[clientID]
+	s.mu.Unlock()
+	if ok && time.Since(cached.fetched) < s.cacheTTL {
+		return activeConsents(cached.consents, clientID, now), nil
+	}
+
+	consents, err := s.fetch(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if len(s.cache) >= s.pruneAt {
+		maps.DeleteFunc(s.cache, func(_ string, c cachedConsents) bool { return time.Since(c.fetched) >= s.cacheTTL })
+		s.pruneAt = max(2*len(s.cache), minPruneSize)
+	}
+	s.cache[clientID] = cachedConsents{consents: consents, fetched: time.Now()}
+	s.mu.Unlock()
+
+	return activeConsents(consents, clientID, now), nil
+}
+
+func (s *httpConsentStore) fetch(ctx context.Context, clientID string) ([]Consent, error) {
+	reqURL, err := url.Parse(s.url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid consent URL: %w", err)
+	}
+	query := reqURL.Query()
+	query.Set("clientId", clientID)
+	reqURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query consent service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consent service responded with %s", resp.Status)
+	}
+
+	var doc consentDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode consent response: %w", err)
+	}
+
+	// Only consents of the requested client are accepted, whatever the service returns.
+	var consents []Consent
+	for _, consent := range doc.Consents {
+		if consent.ClientID != clientID {
+			continue
+		}
+		if err := consent.validate(); err != nil {
+			glog.Warnf("Ignoring invalid consent from consent service: %v", err)
+			continue
+		}
+		consents = append(consents, consent)
+	}
+	return consents, nil
+}
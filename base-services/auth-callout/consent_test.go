@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const consentTestPolicy = `
+roles:
+  telemetry-collector:
+    consent:
+      sub:
+        - "telemetry.{{.VIN}}.{{.Family}}"
+        - "telemetry.{{.VIN}}.{{.Family}}.>"
+  telemetry-client:
+    pub:
+      allow: ["telemetry.{{.VIN}}.>"]
+`
+
+// staticConsents is a ConsentStore for tests.
+type staticConsents []Consent
+
+func (s staticConsents) ActiveConsents(_ context.Context, clientID string, now time.Time) ([]Consent, error) {
+	return activeConsents(s, clientID, now), nil
+}
+
+func TestPolicyResolveWithConsent(t *testing.T) {
+	policy, err := parsePolicy([]byte(consentTestPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	soon := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+	consents := staticConsents{
+		{ClientID: "collector", VIN: "VIN1", Families: []string{"battery", "location"}, Expires: soon},
+		{ClientID: "collector", VIN: "VIN2", Families: []string{"*"}},
+		{ClientID: "collector", VIN: "VIN3", Families: []string{"*"}, Expires: time.Now().Add(-time.Minute)},
+		{ClientID: "other", VIN: "VIN4", Families: []string{"*"}},
+	}
+
+	g, err := policy.resolve(context.Background(), []string{"telemetry-collector"}, subjectVars{VIN: "collector", ClientID: "collector"}, consents, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"telemetry.VIN1.battery", "telemetry.VIN1.battery.>",
+		"telemetry.VIN1.location", "telemetry.VIN1.location.>",
+		"telemetry.VIN2.*", "telemetry.VIN2.*.>",
+	}
+	if !slices.Equal([]string(g.Permissions.Sub.Allow), want) {
+		t.Errorf("expected subscriptions %v, got %v", want, g.Permissions.Sub.Allow)
+	}
+	if !g.Expires.Equal(soon) {
+		t.Errorf("expected grant to expire with the consent at %v, got %v", soon, g.Expires)
+	}
+}
+
+func TestPolicyResolveWithoutConsent(t *testing.T) {
+	policy, err := parsePolicy([]byte(consentTestPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := subjectVars{VIN: "VIN1", ClientID: "VIN1"}
+
+	// A collector without consent gets nothing, so the request is rejected.
+	if _, err := policy.resolve(context.Background(), []string{"telemetry-collector"}, vars, staticConsents{}, nil); err == nil {
+		t.Fatal("expected collector without consent to be rejected")
+	}
+	if _, err := policy.resolve(context.Background(), []string{"telemetry-collector"}, vars, nil, nil); err == nil {
+		t.Fatal("expected collector without consent store to be rejected")
+	}
+
+	// Combined with another role, subscriptions must be denied instead of left open.
+	g, err := policy.resolve(context.Background(), []string{"telemetry-collector", "telemetry-client"}, vars, staticConsents{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Permissions.Sub.Allow) != 0 || !g.Permissions.Sub.Deny.Contains(">") {
+		t.Errorf("expected all subscriptions to be denied, got %+v", g.Permissions.Sub)
+	}
+}
+
+func TestFileConsentStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "consents.yaml")
+	data := `
+consents:
+  - clientId: collector
+    vin: VIN1
+    families: [battery]
+    expires: 2099-01-01T00:00:00Z
+  - clientId: collector
+    vin: VIN2
+    families: ["*"]
+    expires: 2000-01-01T00:00:00Z
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newFileConsentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consents, err := store.ActiveConsents(context.Background(), "collector", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(consents) != 1 || consents[0].VIN != "VIN1" {
+		t.Fatalf("expected only the consent for VIN1 to be active, got %+v", consents)
+	}
+
+	// Invalid consents are rejected on reload and the previous ones stay active.
+	if err := os.WriteFile(path, []byte("consents:\n  - clientId: collector\n    vin: \"VIN.*\"\n    families: [\"*\"]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.reload(); err == nil {
+		t.Fatal("expected invalid consent file to be rejected")
+	}
+	if consents, _ := store.ActiveConsents(context.Background(), "collector", time.Now()); len(consents) != 1 {
+		t.Fatalf("expected previous consents to stay active, got %+v", consents)
+	}
+}
+
+func TestHTTPConsentStore(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		clientID := r.URL.Query().Get("clientId")
+		_ = json.NewEncoder(w).Encode(consentDocument{Consents: []Consent{
+			{ClientID: clientID, VIN: "VIN1", Families: []string{"battery"}},
+			// Consents of other clients must be ignored even if the service returns them.
+			{ClientID: "other", VIN: "VIN2", Families: []string{"*"}},
+		}})
+	}))
+	defer srv.Close()
+
+	store := newHTTPConsentStore(srv.URL, srv.Client(), time.Minute)
+	for range 3 {
+		consents, err := store.ActiveConsents(context.Background(), "collector", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(consents) != 1 || consents[0].VIN != "VIN1" {
+			t.Fatalf("unexpected consents %+v", consents)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expected consents to be cached, got %d requests", got)
+	}
+}
+
+func TestHTTPConsentStoreDropsExpired(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(consentDocument{})
+	}))
+	defer srv.Close()
+
+	store := newHTTPConsentStore(srv.URL, srv.Client(), time.Minute)
+	for i := range minPruneSize {
+		store.cache[fmt.Sprintf("client-%d", i)] = cachedConsents{fetched: time.Now().Add(-time.Hour)}
+	}
+	store.cache["fresh"] = cachedConsents{fetched: time.Now()}
+	if _, err := store.ActiveConsents(context.Background(), "collector", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.cache) != 2 {
+		t.Errorf("expected only the fresh entries to be kept, got %d", len(store.cache))
+	}
+}
+
+func TestHTTPConsentStoreFailsClosed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	store := newHTTPConsentStore(srv.URL, srv.Client(), time.Minute)
+	if _, err := store.ActiveConsents(context.Background(), "collector", time.Now()); err == nil {
+		t.Fatal("expected an error when the consent service is unavailable")
+	}
+}
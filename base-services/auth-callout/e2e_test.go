@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// The end-to-end tests run the callout with the default policy behind an embedded NATS
+// server, get the tokens from a fake Keycloak and check what the server enforces for the
+// connected clients, rather than the permissions written into the user JWT.
+
+// fakeKeycloak is a Keycloak realm that publishes its keys on a JWKS endpoint and
+// issues access tokens.
+type fakeKeycloak struct {
+	jwks    *fakeJwks
+	url     string
+	signers []*testSigner
+}
+
+func newFakeKeycloak(t *testing.T) *fakeKeycloak {
+	t.Helper()
+	k := &fakeKeycloak{jwks: &fakeJwks{}}
+	k.rotate(t)
+	srv := httptest.NewServer(k.jwks)
+	t.Cleanup(srv.Close)
+	k.url = srv.URL
+	return k
+}
+
+// rotate adds a new realm key, which signs the tokens from now on. The previous keys
+// stay published, like during a key rotation in Keycloak.
+func (k *fakeKeycloak) rotate(t *testing.T) {
+	t.Helper()
+	k.signers = append(k.signers, newTestSigner(t, fmt.Sprintf("key-%d", len(k.signers)+1)))
+	set := newTestJwkSet()
+	for _, signer := range k.signers {
+		set.Add(signer.jwk(t))
+	}
+	k.jwks.setKeys(set)
+}
+
+// token issues an access token for the client with the roles. The claims are added to
+// or, if nil, removed from the token.
+func (k *fakeKeycloak) token(t *testing.T, clientID string, roles []string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := validClaims(time.Now())
+	token["azp"] = clientID
+	token["realm_access"] = map[string]any{"roles": roles}
+	for name, value := range claims {
+		if value == nil {
+			delete(token, name)
+		} else {
+			token[name] = value
+		}
+	}
+	return k.signers[len(k.signers)-1].sign(t, token)
+}
+
+// e2e is a callout with the default policy that gets its keys from a fake Keycloak.
+type e2e struct {
+	*calloutServer
+	callout  *testCallout
+	keycloak *fakeKeycloak
+	admin    *nats.Conn
+}
+
+func runE2E(t *testing.T) *e2e {
+	t.Helper()
+	keycloak := newFakeKeycloak(t)
+	keys := newKeySet(keycloak.url, nil, nil)
+	keys.minRefetch = 0
+	if err := keys.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	callout := newTestCallout(t, string(defaultPolicy))
+	callout.validator = &tokenValidator{
+		keys:      keys,
+		issuers:   []string{testIssuer},
+		audiences: []string{"nats"},
+		types:     []string{"Bearer"},
+		leeway:    defaultTokenLeeway,
+	}
+	srv := runCalloutServer(t, callout)
+	return &e2e{calloutServer: srv, callout: callout, keycloak: keycloak, admin: srv.admin(t)}
+}
+
+// e2eClient is a client connected through the callout. The permission violations the
+// server reports are received on violations.
+type e2eClient struct {
+	*nats.Conn
+	env        *e2e
+	violations chan error
+}
+
+// connectAs connects a client with a token for the roles.
+func (e *e2e) connectAs(t *testing.T, clientID string, roles []string, claims jwt.MapClaims) *e2eClient {
+	t.Helper()
+	c := &e2eClient{env: e, violations: make(chan error, 10)}
+	nc, err := e.connectWithToken(t, e.keycloak.token(t, clientID, roles, claims), nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		if errors.Is(err, nats.ErrPermissionViolation) {
+			c.violations <- err
+		}
+	}))
+	if err != nil {
+		t.Fatalf("failed to connect %s with roles %v: %v", clientID, roles, err)
+	}
+	c.Conn = nc
+	return c
+}
+
+// canPublish reports whether a message the client publishes to the subject is delivered.
+func (c *e2eClient) canPublish(t *testing.T, subject string) bool {
+	t.Helper()
+	msgs := make(chan *nats.Msg, 1)
+	sub, err := c.env.admin.ChanSubscribe(subject, msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	if err := c.env.admin.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish(subject, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	return c.delivered(t, subject, msgs)
+}
+
+// canSubscribe reports whether the client receives a message published to the subject.
+func (c *e2eClient) canSubscribe(t *testing.T, subject string) bool {
+	t.Helper()
+	msgs := make(chan *nats.Msg, 1)
+	sub, err := c.ChanSubscribe(subject, msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.env.admin.Publish(subject, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	return c.delivered(t, subject, msgs)
+}
+
+// delivered waits for the message on msgs or the permission violation of the subject.
+func (c *e2eClient) delivered(t *testing.T, subject string, msgs chan *nats.Msg) bool {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case <-msgs:
+			return true
+		case err := <-c.violations:
+			if strings.Contains(err.Error(), fmt.Sprintf("%q", subject)) {
+				return false
+			}
+		case <-timeout:
+			t.Fatalf("neither a message nor a permission violation for %s", subject)
+		}
+	}
+}
+
+// permissionCase is a subject a client publishes or subscribes to and whether the
+// server must allow it.
+type permissionCase struct {
+	subject string
+	allowed bool
+}
+
+func checkPublish(t *testing.T, c *e2eClient, cases []permissionCase) {
+	t.Helper()
+	for _, tc := range cases {
+		if got := c.canPublish(t, tc.subject); got != tc.allowed {
+			t.Errorf("publish to %s: expected allowed=%t, got %t", tc.subject, tc.allowed, got)
+		}
+	}
+}
+
+func checkSubscribe(t *testing.T, c *e2eClient, cases []permissionCase) {
+	t.Helper()
+	for _, tc := range cases {
+		if got := c.canSubscribe(t, tc.subject); got != tc.allowed {
+			t.Errorf("subscribe to %s: expected allowed=%t, got %t", tc.subject, tc.allowed, got)
+		}
+	}
+}
+
+func TestE2EVehicle(t *testing.T) {
+	e := runE2E(t)
+	vehicle := e.connectAs(t, "VIN1", []string{"edge-device", "telemetry-client", "offline_access"}, nil)
+
+	checkPublish(t, vehicle, []permissionCase{
+		{"telemetry.VIN1.battery", true},
+		{"telemetry.VIN1.battery.soc", true},
+		{"telemetry.VIN2.battery", false},
+		{"commands.VIN1.unlock", false},
+		{"commands.VIN2.unlock", false},
+	})
+	checkSubscribe(t, vehicle, []permissionCase{
+		{"commands.VIN1.unlock", true},
+		{"commands.VIN2.unlock", false},
+		{"telemetry.VIN1.battery", false},
+		{"telemetry.VIN2.battery", false},
+	})
+}
+
+func TestE2EEdgeDevice(t *testing.T) {
+	e := runE2E(t)
+	device := e.connectAs(t, "VIN1", []string{"edge-device"}, nil)
+
+	// Publishing telemetry needs the telemetry-client role
+	checkPublish(t, device, []permissionCase{
+		{"telemetry.VIN1.battery", false},
+		{"telemetry.VIN2.battery", false},
+		{"commands.VIN2.unlock", false},
+		{"fleet.f1.telemetry.battery", false},
+	})
+	checkSubscribe(t, device, []permissionCase{
+		{"commands.VIN1.unlock", true},
+		{"commands.VIN2.unlock", false},
+	})
+}
+
+func TestE2ETelemetryCollector(t *testing.T) {
+	e := runE2E(t)
+	e.callout.consents = staticConsents{
+		{ClientID: "collector", VIN: "VIN1", Families: []string{"battery"}},
+		{ClientID: "collector", VIN: "VIN2", Families: []string{"*"}},
+		{ClientID: "other", VIN: "VIN3", Families: []string{"*"}},
+	}
+	collector := e.connectAs(t, "collector", []string{"telemetry-collector"}, nil)
+
+	checkSubscribe(t, collector, []permissionCase{
+		{"telemetry.VIN1.battery", true},
+		{"telemetry.VIN1.battery.soc", true},
+		{"telemetry.VIN1.location", false},
+		{"telemetry.VIN2.location", true},
+		{"telemetry.VIN3.battery", false},
+		{"commands.VIN1.unlock", false},
+	})
+	// Collectors only read, they can't fake telemetry or send commands
+	checkPublish(t, collector, []permissionCase{
+		{"telemetry.VIN1.battery", false},
+		{"commands.VIN1.unlock", false},
+	})
+}
+
+func TestE2EFleetCollector(t *testing.T) {
+	e := runE2E(t)
+	e.callout.fleets = staticFleets{"f1": {"VIN1", "VIN2"}, "f2": {"VIN3"}}
+	collector := e.connectAs(t, "ops", []string{"fleet-collector"}, jwt.MapClaims{"fleets": []string{"f1"}})
+
+	checkSubscribe(t, collector, []permissionCase{
+		{"fleet.f1.telemetry.battery", true},
+		{"fleet.f2.telemetry.battery", false},
+		{"telemetry.VIN1.battery", true},
+		{"telemetry.VIN2.location", true},
+		{"telemetry.VIN3.battery", false},
+	})
+	checkPublish(t, collector, []permissionCase{
+		{"commands.VIN1.unlock", false},
+	})
+}
+
+func TestE2ERejectedTokens(t *testing.T) {
+	e := runE2E(t)
+	impostor := newTestSigner(t, "key-1")
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "expired", token: e.keycloak.token(t, "VIN1", []string{"edge-device"}, jwt.MapClaims{
+			"iat": now.Add(-10 * time.Minute).Unix(),
+			"exp": now.Add(-5 * time.Minute).Unix(),
+		})},
+		{name: "other issuer", token: e.keycloak.token(t, "VIN1", []string{"edge-device"}, jwt.MapClaims{"iss": "https://evil.example.com/realms/sdv-telemetry"})},
+		{name: "other audience", token: e.keycloak.token(t, "VIN1", []string{"edge-device"}, jwt.MapClaims{"aud": "account"})},
+		{name: "unknown roles only", token: e.keycloak.token(t, "VIN1", []string{"admin", "offline_access"}, nil)},
+		{name: "wildcard client ID", token: e.keycloak.token(t, "VIN1.>", []string{"edge-device"}, nil)},
+		{name: "signed by another key", token: impostor.sign(t, validClaims(now))},
+		{name: "not a JWT", token: "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := e.connectWithToken(t, tt.token)
+			if !errors.Is(err, nats.ErrAuthorization) {
+				t.Errorf("expected an authorization violation, got %v", err)
+			}
+		})
+	}
+}
+
+func TestE2EKeyRotation(t *testing.T) {
+	e := runE2E(t)
+	e.connectAs(t, "VIN1", []string{"edge-device"}, nil)
+
+	// Tokens signed with the new key are accepted once the JWKS is refetched
+	e.keycloak.rotate(t)
+	device := e.connectAs(t, "VIN2", []string{"edge-device", "telemetry-client"}, nil)
+	if !device.canPublish(t, "telemetry.VIN2.battery") {
+		t.Error("expected the client with the rotated key to publish its telemetry")
+	}
+}
+
+func TestE2EUserJWTExpiry(t *testing.T) {
+	e := runE2E(t)
+	disconnected := make(chan struct{})
+	expires := time.Now().Add(2 * time.Second).Truncate(time.Second)
+	token := e.keycloak.token(t, "VIN1", []string{"edge-device"}, jwt.MapClaims{"exp": expires.Unix()})
+	if _, err := e.connectWithToken(t, token, nats.ClosedHandler(func(*nats.Conn) { close(disconnected) })); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user JWT expires with the token and the server disconnects the client
+	select {
+	case <-disconnected:
+		if time.Now().Before(expires) {
+			t.Errorf("expected the client to stay connected until %s", expires)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the client to be disconnected when its token expired")
+	}
+}
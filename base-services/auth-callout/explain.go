@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	glog "github.com/labstack/gommon/log"
+	natsjwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+const explainUsage = `Usage: auth-callout explain -token <token> [flags]
+
+Shows what the callout would do with a Keycloak token, without connecting to NATS:
+the decoded claims, the validation result, the matched roles and the permissions and
+expiry of the NATS user JWT it would issue. The token is validated and the user JWT
+created like for an auth request, with the configuration from the environment of the
+service. Revocations in REVOCATION_KV_BUCKET are not checked.
+
+Flags:
+`
+
+// explainClients maps the -connection-type flag to the client information of the auth
+// request the NATS server would send.
+var explainClients = map[string]natsjwt.ClientInformation{
+	natsjwt.ConnectionTypeStandard:  {Kind: "Client", Type: "nats"},
+	natsjwt.ConnectionTypeWebsocket: {Kind: "Client", Type: "websocket"},
+	natsjwt.ConnectionTypeMqtt:      {Kind: "Client", Type: "mqtt"},
+	natsjwt.ConnectionTypeLeafnode:  {Kind: "Leafnode"},
+}
+
+// runExplainCommand runs "auth-callout explain" with the configuration from getenv and
+// returns the exit code: 0 if the token would be granted, 1 if it would be rejected.
+func runExplainCommand(args []string, getenv func(string) string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, explainUsage)
+		flags.PrintDefaults()
+	}
+	token := flags.String("token", "", `Keycloak access token, "-" reads it from stdin`)
+	policyFile := flags.String("policy", getenv("AUTH_POLICY_FILE"), "policy file (default AUTH_POLICY_FILE or the built-in policy)")
+	connectionType := flags.String("connection-type", natsjwt.ConnectionTypeStandard, "connection type of the client: STANDARD, WEBSOCKET, MQTT or LEAFNODE")
+	host := flags.String("host", "", "address of the client, required if a role restricts sourceCidrs")
+	printJWT := flags.Bool("jwt", false, "print the signed NATS user JWT")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	client, ok := explainClients[strings.ToUpper(*connectionType)]
+	if *token == "" || !ok {
+		flags.Usage()
+		return 2
+	}
+	if *token == "-" {
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(stderr, "explain: failed to read the token: %v\n", err)
+			return 1
+		}
+		*token = strings.TrimSpace(line)
+	}
+	client.Host = *host
+
+	// The logs of the loaders would mix with the explanation
+	glog.SetOutput(stderr)
+	glog.SetLevel(glog.WARN)
+
+	callout, notes, err := newExplainCallout(getenv, *policyFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "explain: %v\n", err)
+		return 1
+	}
+	return explain(context.Background(), callout, *token, client, *printJWT, notes, stdout)
+}
+
+// newExplainCallout creates the callout like main does, except for what requires NATS.
+// The notes tell where the result may differ from the running service.
+func newExplainCallout(getenv func(string) string, policyFile string) (*authCallout, []string, error) {
+	var notes []string
+
+	// Without the signing key of the service, the user JWT is signed with a throwaway
+	// key, which doesn't change the permissions
+	if getenv("JWT_ACC_SIGNING_KEY") == "" {
+		account, err := nkeys.CreateAccount()
+		if err != nil {
+			return nil, nil, err
+		}
+		seed, _ := account.Seed()
+		serviceEnv := getenv
+		getenv = func(name string) string {
+			if name == "JWT_ACC_SIGNING_KEY" {
+				return string(seed)
+			}
+			return serviceEnv(name)
+		}
+		notes = append(notes, "JWT_ACC_SIGNING_KEY is not set, the user JWT is signed with a throwaway key")
+	}
+
+	cfg, err := loadConfig(getenv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	accountKeys, err := loadAccountKeys(cfg.accountSigningKeysFile, cfg.accountKeyPair)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load account signing keys: %w", err)
+	}
+	keys, err := loadKeySet(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load Keycloak keys: %w", err)
+	}
+	policies, err := newPolicyStore(policyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load policy: %w", err)
+	}
+	fleets, err := loadFleetStore(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load fleets: %w", err)
+	}
+	consents, err := loadConsentStore(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load consents: %w", err)
+	}
+
+	var revocations RevocationStore
+	switch {
+	case cfg.revocationFile != "":
+		if revocations, err = newFileRevocationStore(cfg.revocationFile, nil); err != nil {
+			return nil, nil, fmt.Errorf("failed to load revocations: %w", err)
+		}
+	case cfg.revocationKVBucket != "":
+		notes = append(notes, fmt.Sprintf("revocations in the KV bucket %s are not checked", cfg.revocationKVBucket))
+	}
+
+	return &authCallout{
+		validator:       loadTokenValidator(cfg, keys),
+		policies:        policies,
+		consents:        consents,
+		revocations:     revocations,
+		rolesClaimPath:  cfg.rolesClaimPath,
+		fleets:          fleets,
+		fleetsClaimPath: cfg.fleetsClaimPath,
+		accountKeyPair:  cfg.accountKeyPair,
+		accountKeys:     accountKeys,
+		maxExpiry:       cfg.maxExpiry,
+	}, notes, nil
+}
+
+// explain authorizes the token like an auth request of the client and prints the result.
+func explain(ctx context.Context, a *authCallout, token string, client natsjwt.ClientInformation, printJWT bool, notes []string, out io.Writer) int {
+	printTokenClaims(out, token)
+
+	// The same request the NATS server sends for a client connecting with the token
+	userKeyPair, err := nkeys.CreateUser()
+	if err != nil {
+		fmt.Fprintf(out, "\nResult:\terror: %v\n", err)
+		return 1
+	}
+	userNkey, _ := userKeyPair.PublicKey()
+	req := natsjwt.NewAuthorizationRequestClaims(userNkey)
+	req.UserNkey = userNkey
+	req.ConnectOptions.Token = token
+	req.ClientInformation = client
+
+	result, err := a.authorize(ctx, req)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w)
+	if err != nil {
+		reason, message := rejection(err)
+		fmt.Fprintf(w, "Result:\trejected (%s): %s\n", reason, message)
+	} else {
+		fmt.Fprintf(w, "Result:\tgranted\n")
+	}
+	for _, note := range notes {
+		fmt.Fprintf(w, "Note:\t%s\n", note)
+	}
+
+	if result != nil && result.claims != nil {
+		fmt.Fprintf(w, "Client:\t%s\n", result.claims.ClientID)
+		if len(result.claims.Fleets) > 0 {
+			fmt.Fprintf(w, "Fleets:\t%s\n", strings.Join(result.claims.Fleets, ", "))
+		}
+		fmt.Fprintf(w, "Roles:\t%s\n", explainRoles(a.policies.current(), result))
+		fmt.Fprintf(w, "Account:\t%s\n", result.account)
+	}
+
+	// The permissions are shown as issued, or as resolved if the connection was rejected
+	// after the roles were resolved
+	switch {
+	case err == nil:
+		user, err := natsjwt.DecodeUserClaims(result.userJWT)
+		if err != nil {
+			fmt.Fprintf(w, "User JWT:\tinvalid: %v\n", err)
+			w.Flush()
+			return 1
+		}
+		printPermissions(w, user.Permissions, user.Limits.NatsLimits, user.AllowedConnectionTypes, user.Limits.Src)
+		expires := time.Unix(user.Expires, 0)
+		fmt.Fprintf(w, "Expires:\t%s (in %s)\n", expires.UTC().Format(time.RFC3339), time.Until(expires).Round(time.Second))
+		if printJWT {
+			fmt.Fprintf(w, "User JWT:\t%s\n", result.userJWT)
+		}
+	case result != nil && result.grant != nil:
+		g := result.grant
+		printPermissions(w, g.Permissions, g.Limits, g.ConnectionTypes, g.SourceCIDRs)
+	}
+	w.Flush()
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// printTokenClaims prints the header and claims of the token without verifying it, so
+// they are shown for rejected tokens as well.
+func printTokenClaims(out io.Writer, token string) {
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		fmt.Fprintf(out, "Token can't be decoded: %v\n", err)
+		return
+	}
+	header, _ := json.MarshalIndent(parsed.Header, "", "  ")
+	claims, _ := json.MarshalIndent(parsed.Claims, "", "  ")
+	fmt.Fprintf(out, "Header:\n%s\nClaims:\n%s\n", header, claims)
+	if exp, err := parsed.Claims.GetExpirationTime(); err == nil && exp != nil {
+		fmt.Fprintf(out, "Token expires %s (in %s)\n", exp.UTC().Format(time.RFC3339), time.Until(exp.Time).Round(time.Second))
+	}
+}
+
+// explainRoles lists the roles of the token and whether the policy granted, ignored or
+// doesn't know them.
+func explainRoles(policy *Policy, result *authorization) string {
+	var roles []string
+	for _, role := range result.claims.Roles {
+		switch _, known := policy.Roles[role]; {
+		case result.grant != nil && known:
+			roles = append(roles, role+" (granted)")
+		case known:
+			roles = append(roles, role)
+		case policy.isIgnored(role):
+			roles = append(roles, role+" (ignored)")
+		default:
+			roles = append(roles, role+" (not in policy)")
+		}
+	}
+	if len(roles) == 0 {
+		return "none"
+	}
+	return strings.Join(roles, ", ")
+}
+
+func printPermissions(w io.Writer, perms natsjwt.Permissions, limits natsjwt.NatsLimits, connectionTypes, sourceCIDRs []string) {
+	printSubjects(w, "Publish allow", perms.Pub.Allow)
+	printSubjects(w, "Publish deny", perms.Pub.Deny)
+	printSubjects(w, "Subscribe allow", perms.Sub.Allow)
+	printSubjects(w, "Subscribe deny", perms.Sub.Deny)
+	if perms.Resp != nil {
+		fmt.Fprintf(w, "Responses:\t%d within %s\n", perms.Resp.MaxMsgs, perms.Resp.Expires)
+	}
+	fmt.Fprintf(w, "Limits:\tsubs %s, data %s, payload %s\n", explainLimit(limits.Subs), explainLimit(limits.Data), explainLimit(limits.Payload))
+	if len(connectionTypes) > 0 {
+		fmt.Fprintf(w, "Connection types:\t%s\n", strings.Join(connectionTypes, ", "))
+	}
+	if len(sourceCIDRs) > 0 {
+		fmt.Fprintf(w, "Source CIDRs:\t%s\n", strings.Join(sourceCIDRs, ", "))
+	}
+}
+
+// printSubjects prints one subject per line, "-" if there are none.
+func printSubjects(w io.Writer, label string, subjects []string) {
+	if len(subjects) == 0 {
+		fmt.Fprintf(w, "%s:\t-\n", label)
+		return
+	}
+	for i, subject := range subjects {
+		if i > 0 {
+			label = ""
+		} else {
+			label += ":"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", label, subject)
+	}
+}
+
+func explainLimit(limit int64) string {
+	if limit == natsjwt.NoLimit {
+		return "unlimited"
+	}
+	return fmt.Sprint(limit)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	glog "github.com/labstack/gommon/log"
+)
+
+func TestExplainCommand(t *testing.T) {
+	signer := newTestSigner(t, "key-1")
+	jwks, err := json.Marshal(newTestJwkSet(signer.jwk(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := testEnv(t, map[string]string{
+		"JWT_ACC_SIGNING_KEY": "",
+		"KEYCLOAK_JWKS_URL":   "",
+		"KEYCLOAK_JWK_B64":    base64.StdEncoding.EncodeToString(jwks),
+		"TOKEN_ISSUER":        testIssuer,
+	})
+	t.Cleanup(func() {
+		glog.SetOutput(os.Stdout)
+		glog.SetLevel(glog.INFO)
+	})
+
+	token := func(roles []string, changes jwt.MapClaims) string {
+		claims := validClaims(time.Now())
+		claims["realm_access"] = map[string]any{"roles": roles}
+		for name, value := range changes {
+			claims[name] = value
+		}
+		return signer.sign(t, claims)
+	}
+	vehicle := token([]string{"edge-device", "telemetry-client", "offline_access"}, nil)
+
+	tests := []struct {
+		name     string
+		args     []string
+		stdin    string
+		wantCode int
+		want     []string
+	}{
+		{
+			name:     "granted",
+			args:     []string{"-token", vehicle, "-jwt"},
+			wantCode: 0,
+			want: []string{
+				`"azp": "VIN1"`,
+				"Result:            granted",
+				"Note:              JWT_ACC_SIGNING_KEY is not set",
+				"Roles:             edge-device (granted), telemetry-client (granted), offline_access (ignored)",
+				"Account:           $G",
+				"Publish allow:     telemetry.VIN1.>",
+				"Subscribe allow:   commands.VIN1.>",
+				"Limits:            subs 10, data unlimited, payload 1048576",
+				"Connection types:  STANDARD, WEBSOCKET",
+				"Expires:",
+				"User JWT:          eyJ",
+			},
+		},
+		{
+			name:     "token from stdin",
+			args:     []string{"--token", "-"},
+			stdin:    vehicle + "\n",
+			wantCode: 0,
+			want:     []string{"Result:            granted"},
+		},
+		{
+			name:     "expired token",
+			args:     []string{"-token", token([]string{"edge-device"}, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})},
+			wantCode: 1,
+			want:     []string{`"azp": "VIN1"`, "Result:  rejected (token_expired)"},
+		},
+		{
+			name:     "unknown roles",
+			args:     []string{"-token", token([]string{"admin", "offline_access"}, nil)},
+			wantCode: 1,
+			want:     []string{"rejected (not_authorized)", "admin (not in policy), offline_access (ignored)"},
+		},
+		{
+			name:     "connection type not allowed",
+			args:     []string{"-token", vehicle, "-connection-type", "leafnode"},
+			wantCode: 1,
+			want:     []string{"rejected (connection_not_allowed)", "Publish allow:     telemetry.VIN1.>"},
+		},
+		{
+			name:     "not a token",
+			args:     []string{"-token", "secret"},
+			wantCode: 1,
+			want:     []string{"Token can't be decoded", "rejected (malformed_token)"},
+		},
+		{name: "no token", args: nil, wantCode: 2},
+		{name: "unknown connection type", args: []string{"-token", vehicle, "-connection-type", "udp"}, wantCode: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := runExplainCommand(tt.args, env, strings.NewReader(tt.stdin), &stdout, &stderr)
+			if code != tt.wantCode {
+				t.Errorf("expected exit code %d, got %d\n%s%s", tt.wantCode, code, stdout.String(), stderr.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("expected output containing %q, got\n%s", want, stdout.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"time"
+
+	glog "github.com/labstack/gommon/log"
+)
+
+// watchedFile tracks the content of a configuration file that is reloaded at runtime.
+type watchedFile struct {
+	path string
+	hash [sha256.Size]byte
+}
+
+// readIfChanged returns the file content and whether it differs from the last
+// committed content.
+func (f *watchedFile) readIfChanged() ([]byte, bool, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read %s: %w", f.path, err)
+	}
+	return data, sha256.Sum256(data) != f.hash, nil
+}
+
+// commit marks the content as successfully loaded.
+func (f *watchedFile) commit(data []byte) {
+	f.hash = sha256.Sum256(data)
+}
+
+// watchFile calls reload every interval until the context is cancelled. Polling is
+// used instead of file events because Kubernetes updates mounted ConfigMaps by
+// swapping symlinks. Failed reloads are logged and the previous content stays active.
+func watchFile(ctx context.Context, name string, interval time.Duration, reload func() (bool, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := reload()
+			if err != nil {
+				glog.Errorf("Failed to reload %s, keeping the previous one: %v", name, err)
+			} else if changed {
+				glog.Infof("Reloaded %s", name)
+			}
+		}
+	}
+}
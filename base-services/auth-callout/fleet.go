@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	glog "github.com/labstack/gommon/log"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultFleetsClaimPath is the claim with the fleets of a token, e.g. "fleets": ["f1", "f2"].
+const defaultFleetsClaimPath = "fleets"
+
+// defaultFleetMaxVehicles is the largest fleet whose vehicles are granted one by one.
+const defaultFleetMaxVehicles = 100
+
+// FleetPolicy grants access to the fleets in the fleets claim of the token, e.g. for
+// fleet operators and backend services.
+type FleetPolicy struct {
+	// Pub and Sub are rendered once per fleet with {{.Fleet}}, e.g. the per fleet prefix
+	// "fleet.{{.Fleet}}.>". Their number doesn't grow with the size of the fleet.
+	Pub []string `yaml:"pub"`
+	Sub []string `yaml:"sub"`
+	// VehiclePub and VehicleSub are rendered once per vehicle of the fleet with {{.VIN}}
+	// and {{.Fleet}}, e.g. "telemetry.{{.VIN}}.>". The vehicles are looked up in the
+	// fleet store.
+	VehiclePub []string `yaml:"vehiclePub"`
+	VehicleSub []string `yaml:"vehicleSub"`
+	// MaxVehicles is the largest fleet whose vehicles are granted one by one, so the
+	// user JWT doesn't grow unbounded. Larger fleets only get Pub and Sub. Default 100.
+	MaxVehicles int `yaml:"maxVehicles"`
+}
+
+// compiledFleetPolicy holds the parsed templates of a FleetPolicy.
+type compiledFleetPolicy struct {
+	pub, sub, vehiclePub, vehicleSub []*template.Template
+	maxVehicles                      int
+}
+
+func (f *FleetPolicy) compile() (*compiledFleetPolicy, error) {
+	if len(f.Pub)+len(f.Sub)+len(f.VehiclePub)+len(f.VehicleSub) == 0 {
+		return nil, errors.New("no subjects")
+	}
+	if f.MaxVehicles < 0 {
+		return nil, errors.New("maxVehicles must not be negative")
+	}
+
+	sample := subjectVars{VIN: "VIN", ClientID: "client", Fleet: "fleet"}
+	c := &compiledFleetPolicy{maxVehicles: f.MaxVehicles}
+	if c.maxVehicles == 0 {
+		c.maxVehicles = defaultFleetMaxVehicles
+	}
+	var errs []error
+	var err error
+	if c.pub, err = compileSubjects(f.Pub, sample); err != nil {
+		errs = append(errs, fmt.Errorf("pub: %w", err))
+	}
+	if c.sub, err = compileSubjects(f.Sub, sample); err != nil {
+		errs = append(errs, fmt.Errorf("sub: %w", err))
+	}
+	if c.vehiclePub, err = compileSubjects(f.VehiclePub, sample); err != nil {
+		errs = append(errs, fmt.Errorf("vehiclePub: %w", err))
+	}
+	if c.vehicleSub, err = compileSubjects(f.VehicleSub, sample); err != nil {
+		errs = append(errs, fmt.Errorf("vehicleSub: %w", err))
+	}
+	return c, errors.Join(errs...)
+}
+
+// fleetAccess holds the fleets of a token and the store their vehicles are looked up in.
+type fleetAccess struct {
+	fleets []string
+	store  FleetStore
+}
+
+// addFleetSubjects adds the subjects of all fleets of the token. A fleet that is larger
+// than maxVehicles only gets the per fleet subjects.
+func (g *grant) addFleetSubjects(ctx context.Context, fleet *compiledFleetPolicy, vars subjectVars, access *fleetAccess) error {
+	if access == nil || len(access.fleets) == 0 {
+		glog.Infof("Client %q has no fleets", vars.ClientID)
+		return nil
+	}
+
+	perVehicle := len(fleet.vehiclePub)+len(fleet.vehicleSub) > 0
+	if perVehicle && access.store == nil {
+		glog.Warnf("No fleet store configured, %q gets no vehicle subjects of its fleets", vars.ClientID)
+		perVehicle = false
+	}
+
+	for _, id := range access.fleets {
+		fleetVars := subjectVars{VIN: vars.VIN, ClientID: vars.ClientID, Fleet: id}
+		if err := addSubjects(&g.Permissions.Pub.Allow, fleet.pub, fleetVars); err != nil {
+			return err
+		}
+		if err := addSubjects(&g.Permissions.Sub.Allow, fleet.sub, fleetVars); err != nil {
+			return err
+		}
+		if !perVehicle {
+			continue
+		}
+
+		vins, err := access.store.FleetVehicles(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to look up vehicles of fleet %q: %w", id, err)
+		}
+		if len(vins) > fleet.maxVehicles {
+			glog.Warnf("Fleet %q of %q has %d vehicles, more than %d, only granting the fleet subjects", id, vars.ClientID, len(vins), fleet.maxVehicles)
+			continue
+		}
+		for _, vin := range vins {
+			vehicleVars := subjectVars{VIN: vin, ClientID: vars.ClientID, Fleet: id}
+			if err := addSubjects(&g.Permissions.Pub.Allow, fleet.vehiclePub, vehicleVars); err != nil {
+				return err
+			}
+			if err := addSubjects(&g.Permissions.Sub.Allow, fleet.vehicleSub, vehicleVars); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// extractFleets reads the optional fleets claim. A token without it has no fleets.
+func extractFleets(claims jwt.MapClaims, path []string) ([]string, error) {
+	if lookupClaim(claims, path) == nil {
+		return nil, nil
+	}
+	fleets, err := stringListClaim(claims, path)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range fleets {
+		if !isValidToken(id) {
+			return nil, newAuthError(reasonMalformedClaim, "fleet %q can't be used as a subject token", id)
+		}
+	}
+	return fleets, nil
+}
+
+// FleetStore looks up the vehicles of a fleet.
+type FleetStore interface {
+	// FleetVehicles returns the VINs of the fleet, none for an unknown fleet.
+	FleetVehicles(ctx context.Context, fleet string) ([]string, error)
+}
+
+// fleetDocument is the format of the file read by fileFleetStore:
+//
+//	fleets:
+//	  f1: [WDD1234567890, WDD1234567891]
+type fleetDocument struct {
+	Fleets map[string][]string `json:"fleets" yaml:"fleets"`
+}
+
+func (doc *fleetDocument) validate() error {
+	for id, vins := range doc.Fleets {
+		if !isValidToken(id) {
+			return fmt.Errorf("invalid fleet %q", id)
+		}
+		for _, vin := range vins {
+			if !isValidToken(vin) {
+				return fmt.Errorf("fleet %q: invalid vin %q", id, vin)
+			}
+		}
+	}
+	return nil
+}
+
+func parseFleets(data []byte) (map[string][]string, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	var doc fleetDocument
+	if err := decoder.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to decode fleets: %w", err)
+	}
+	if err := doc.validate(); err != nil {
+		return nil, err
+	}
+	return doc.Fleets, nil
+}
+
+// fileFleetStore reads the fleets from a YAML or JSON file that is reloaded when it changes.
+type fileFleetStore struct {
+	file   *watchedFile
+	fleets atomic.Pointer[map[string][]string]
+}
+
+func newFileFleetStore(path string) (*fileFleetStore, error) {
+	s := &fileFleetStore{file: &watchedFile{path: path}}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileFleetStore) FleetVehicles(_ context.Context, fleet string) ([]string, error) {
+	return (*s.fleets.Load())[fleet], nil
+}
+
+// reload re-reads the fleet file. An invalid file is rejected and the previous fleets
+// stay active.
+func (s *fileFleetStore) reload() (bool, error) {
+	data, changed, err := s.file.readIfChanged()
+	if err != nil || !changed {
+		return false, err
+	}
+	fleets, err := parseFleets(data)
+	if err != nil {
+		return false, err
+	}
+	s.fleets.Store(&fleets)
+	s.file.commit(data)
+	glog.Infof("Loaded %d fleets from %s", len(fleets), s.file.path)
+	return true, nil
+}
+
+func (s *fileFleetStore) watch(ctx context.Context, interval time.Duration) {
+	watchFile(ctx, "fleets", interval, s.reload)
+}
+
+// fleetResponse is the response of the fleet service.
+type fleetResponse struct {
+	VINs []string `json:"vins"`
+}
+
+// httpFleetStore queries a fleet service with GET <url>?fleet=<id>, which responds
+// with {"vins": [...]}. Responses are cached per fleet for cacheTTL, errors are not cached.
+// Expired responses are dropped whenever the cache doubled in size.
+type httpFleetStore struct {
+	url      string
+	client   *http.Client
+	cacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedFleet
+	// pruneAt is the number of cached fleets at which the expired ones are dropped next.
+	pruneAt int
+}
+
+type cachedFleet struct {
+	vins    []string
+	fetched time.Time
+}
+
+func newHTTPFleetStore(url string, client *http.Client, cacheTTL time.Duration) *httpFleetStore {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	return &httpFleetStore{url: url, client: client, cacheTTL: cacheTTL, cache: make(map[string]cachedFleet)}
+}
+
+func (s *httpFleetStore) FleetVehicles(ctx context.Context, fleet string) ([]string, error) {
+	s.mu.Lock()
+	cached, ok := s.cache[fleet]
+	s.mu.Unlock()
+	if ok && time.Since(cached.fetched) < s.cacheTTL {
+		return cached.vins, nil
+	}
+
+	vins, err := s.fetch(ctx, fleet)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if len(s.cache) >= s.pruneAt {
+		maps.DeleteFunc(s.cache, func(_ string, c cachedFleet) bool { return time.Since(c.fetched) >= s.cacheTTL })
+		s.pruneAt = max(2*len(s.cache), minPruneSize)
+	}
+	s.cache[fleet] = cachedFleet{vins: vins, fetched: time.Now()}
+	s.mu.Unlock()
+	return vins, nil
+}
+
+func (s *httpFleetStore) fetch(ctx context.Context, fleet string) ([]string, error) {
+	reqURL, err := url.Parse(s.url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fleet URL: %w", err)
+	}
+	query := reqURL.Query()
+	query.Set("fleet", fleet)
+	reqURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query fleet service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fleet service responded with %s", resp.Status)
+	}
+
+	var doc fleetResponse
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode fleet response: %w", err)
+	}
+
+	var vins []string
+	for _, vin := range doc.VINs {
+		if !isValidToken(vin) {
+			glog.Warnf("Ignoring invalid vin %q of fleet %q from fleet service", vin, fleet)
+			continue
+		}
+		vins = append(vins, vin)
+	}
+	return vins, nil
+}
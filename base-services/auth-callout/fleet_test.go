@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const fleetTestPolicy = `
+roles:
+  fleet-collector:
+    fleet:
+      sub: ["fleet.{{.Fleet}}.status"]
+      vehicleSub: ["telemetry.{{.VIN}}.>"]
+      maxVehicles: 2
+  fleet-dispatcher:
+    fleet:
+      vehiclePub: ["commands.{{.VIN}}.{{.Fleet}}"]
+`
+
+// staticFleets is a FleetStore for tests.
+type staticFleets map[string][]string
+
+func (s staticFleets) FleetVehicles(_ context.Context, fleet string) ([]string, error) {
+	return s[fleet], nil
+}
+
+func TestParsePolicyFleetValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr string
+	}{
+		{name: "no subjects", policy: "roles:\n  r:\n    fleet:\n      maxVehicles: 10", wantErr: "fleet: no subjects"},
+		{name: "negative max", policy: "roles:\n  r:\n    fleet:\n      sub: [\"a\"]\n      maxVehicles: -1", wantErr: "must not be negative"},
+		{name: "invalid subject", policy: "roles:\n  r:\n    fleet:\n      vehicleSub: [\"a..{{.VIN}}\"]", wantErr: "vehicleSub"},
+		{name: "unknown field", policy: "roles:\n  r:\n    fleet:\n      vehicles: [\"a\"]", wantErr: "field vehicles not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePolicy([]byte(tt.policy))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPolicyResolveWithFleets(t *testing.T) {
+	policy, err := parsePolicy([]byte(fleetTestPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := staticFleets{"f1": {"VIN1", "VIN2"}, "f2": {"VIN3", "VIN4", "VIN5"}}
+	vars := subjectVars{VIN: "ops", ClientID: "ops"}
+
+	g, err := policy.resolve(context.Background(), []string{"fleet-collector"}, vars, nil, &fleetAccess{fleets: []string{"f1", "f2"}, store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// f2 is larger than maxVehicles, so it only gets the per fleet subject
+	want := []string{"fleet.f1.status", "telemetry.VIN1.>", "telemetry.VIN2.>", "fleet.f2.status"}
+	if !slices.Equal([]string(g.Permissions.Sub.Allow), want) {
+		t.Errorf("expected subscriptions %v, got %v", want, g.Permissions.Sub.Allow)
+	}
+	if len(g.Permissions.Pub.Allow) != 0 || !slices.Equal([]string(g.Permissions.Pub.Deny), []string{">"}) {
+		t.Errorf("expected publishing to be denied, got %+v", g.Permissions.Pub)
+	}
+
+	g, err = policy.resolve(context.Background(), []string{"fleet-dispatcher"}, vars, nil, &fleetAccess{fleets: []string{"f1"}, store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"commands.VIN1.f1", "commands.VIN2.f1"}; !slices.Equal([]string(g.Permissions.Pub.Allow), want) {
+		t.Errorf("expected publish permissions %v, got %v", want, g.Permissions.Pub.Allow)
+	}
+	// The fleet role only allows publishing, so subscriptions are denied
+	if len(g.Permissions.Sub.Allow) != 0 || !slices.Equal([]string(g.Permissions.Sub.Deny), []string{">"}) {
+		t.Errorf("expected subscriptions to be denied, got %+v", g.Permissions.Sub)
+	}
+}
+
+func TestPolicyResolveWithoutFleets(t *testing.T) {
+	policy, err := parsePolicy([]byte(fleetTestPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := subjectVars{VIN: "ops", ClientID: "ops"}
+
+	// Without fleets in the token, a fleet role grants nothing
+	if _, err := policy.resolve(context.Background(), []string{"fleet-collector"}, vars, nil, &fleetAccess{store: staticFleets{}}); err == nil {
+		t.Error("expected a token without fleets to be rejected")
+	}
+
+	// Without a fleet store, only the per fleet subjects are granted
+	g, err := policy.resolve(context.Background(), []string{"fleet-collector"}, vars, nil, &fleetAccess{fleets: []string{"f1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"fleet.f1.status"}; !slices.Equal([]string(g.Permissions.Sub.Allow), want) {
+		t.Errorf("expected subscriptions %v, got %v", want, g.Permissions.Sub.Allow)
+	}
+}
+
+func TestExtractFleets(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  string
+		want    []string
+		wantErr bool
+	}{
+		{name: "fleets", claims: `{"fleets": ["f1", "f2"]}`, want: []string{"f1", "f2"}},
+		{name: "no fleets", claims: `{}`},
+		{name: "not a list", claims: `{"fleets": "f1"}`, wantErr: true},
+		{name: "wildcard", claims: `{"fleets": ["f1", "*"]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fleets, err := extractFleets(claimsFromJSON(t, tt.claims), []string{defaultFleetsClaimPath})
+			var authErr *authError
+			if tt.wantErr {
+				if !errors.As(err, &authErr) || authErr.Reason != reasonMalformedClaim {
+					t.Fatalf("expected a %s error, got %v", reasonMalformedClaim, err)
+				}
+				return
+			}
+			if err != nil || !slices.Equal(fleets, tt.want) {
+				t.Errorf("expected fleets %v, got %v (%v)", tt.want, fleets, err)
+			}
+		})
+	}
+}
+
+func TestFileFleetStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fleets.yaml")
+	if err := os.WriteFile(path, []byte("fleets:\n  f1: [VIN1, VIN2]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFileFleetStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vins, _ := store.FleetVehicles(context.Background(), "f1"); !slices.Equal(vins, []string{"VIN1", "VIN2"}) {
+		t.Errorf("unexpected vehicles of f1: %v", vins)
+	}
+	if vins, _ := store.FleetVehicles(context.Background(), "unknown"); len(vins) != 0 {
+		t.Errorf("expected no vehicles for an unknown fleet, got %v", vins)
+	}
+
+	// Invalid fleets are rejected on reload and the previous ones stay active.
+	if err := os.WriteFile(path, []byte("fleets:\n  f1: [\"VIN.>\"]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.reload(); err == nil {
+		t.Fatal("expected invalid fleet file to be rejected")
+	}
+	if vins, _ := store.FleetVehicles(context.Background(), "f1"); len(vins) != 2 {
+		t.Errorf("expected previous fleets to stay active, got %v", vins)
+	}
+}
+
+func TestHTTPFleetStore(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Query().Get("fleet") {
+		case "f1":
+			_ = json.NewEncoder(w).Encode(fleetResponse{VINs: []string{"VIN1", "VIN.*"}})
+		case "down":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	store := newHTTPFleetStore(srv.URL, srv.Client(), time.Minute)
+	for range 3 {
+		vins, err := store.FleetVehicles(context.Background(), "f1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Invalid VINs from the service are dropped
+		if !slices.Equal(vins, []string{"VIN1"}) {
+			t.Fatalf("unexpected vehicles %v", vins)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expected fleets to be cached, got %d requests", got)
+	}
+
+	if vins, err := store.FleetVehicles(context.Background(), "unknown"); err != nil || len(vins) != 0 {
+		t.Errorf("expected no vehicles for an unknown fleet, got %v (%v)", vins, err)
+	}
+	if _, err := store.FleetVehicles(context.Background(), "down"); err == nil {
+		t.Error("expected an error when the fleet service is unavailable")
+	}
+}
+
+func TestHTTPFleetStoreDropsExpired(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(fleetResponse{})
+	}))
+	defer srv.Close()
+
+	store := newHTTPFleetStore(srv.URL, srv.Client(), time.Minute)
+	for i := range minPruneSize {
+		store.cache[fmt.Sprintf("fleet-%d", i)] = cachedFleet{fetched: time.Now().Add(-time.Hour)}
+	}
+	store.cache["fresh"] = cachedFleet{fetched: time.Now()}
+	if _, err := store.FleetVehicles(context.Background(), "f1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.cache) != 2 {
+		t.Errorf("expected only the fresh entries to be kept, got %d", len(store.cache))
+	}
+}
+
+func TestUserJWTFleetPermissions(t *testing.T) {
+	callout := newTestCallout(t, fleetTestPolicy)
+	callout.fleets = staticFleets{"f1": {"VIN1", "VIN2"}}
+
+	claims := validClaims(time.Now())
+	claims["azp"] = "fleet-ops"
+	claims["fleets"] = []string{"f1"}
+	claims["realm_access"] = map[string]any{"roles": []string{"fleet-collector"}}
+
+	userClaims, err := callout.authorize(t, callout.signer.sign(t, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"fleet.f1.status", "telemetry.VIN1.>", "telemetry.VIN2.>"}
+	if !slices.Equal([]string(userClaims.Sub.Allow), want) {
+		t.Errorf("expected subscriptions %v, got %v", want, userClaims.Sub.Allow)
+	}
+}
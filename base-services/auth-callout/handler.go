@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	glog "github.com/labstack/gommon/log"
+	natsjwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// serverXkeyHeader carries the public xkey of the NATS server in encrypted auth requests.
+const serverXkeyHeader = "Nats-Server-Xkey"
+
+// Reason codes of rejected auth requests that are not caused by the token itself.
+const (
+	reasonMalformedRequest = "malformed_request"
+	reasonNotEncrypted     = "encryption_required"
+	reasonNotAuthorized    = "not_authorized"
+	// reasonConnectionNotAllowed rejects a connection type or source address the roles don't allow.
+	reasonConnectionNotAllowed = "connection_not_allowed"
+	// reasonOverloaded sheds a request that doesn't fit into the queue of the workers.
+	reasonOverloaded = "overloaded"
+	// reasonTimeout rejects a request that wasn't handled before its deadline.
+	reasonTimeout       = "timeout"
+	reasonInternalError = "internal_error"
+)
+
+// authCallout handles the auth callout requests of the NATS server.
+type authCallout struct {
+	validator *tokenValidator
+	policies  *policyStore
+	consents  ConsentStore
+	// revocations blocks tokens, vehicles and clients. If nil, nothing is revoked.
+	revocations RevocationStore
+	// connections tracks granted connections, so they can be disconnected on
+	// revocation. If nil, revoked clients stay connected until their user JWT expires.
+	connections    *connectionTracker
+	rolesClaimPath []string
+	// fleets looks up the vehicles of the fleets in the fleetsClaimPath claim.
+	fleets          FleetStore
+	fleetsClaimPath []string
+	// accountKeyPair signs the responses to the NATS server.
+	accountKeyPair nkeys.KeyPair
+	// accountKeys sign the user JWTs for the account the user is placed in.
+	accountKeys *accountKeys
+	auditSink   auditSink
+	// xkey decrypts requests and encrypts responses. If nil, requests must be plaintext.
+	xkey nkeys.KeyPair
+	// maxExpiry is the longest lifetime of an issued NATS user JWT.
+	maxExpiry time.Duration
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// handleRequest authorizes an auth request and responds to it. Requests that aren't
+// handled before the deadline of ctx, or the expiry of the request, are rejected.
+func (a *authCallout) handleRequest(ctx context.Context, msg *nats.Msg) {
+	start := time.Now()
+	var authRequestClaims *natsjwt.AuthorizationRequestClaims
+	var result *authorization
+	serverXkey := msg.Header.Get(serverXkeyHeader)
+
+	// record reports the decision to the metrics and the audit log
+	record := func(outcome, reason, message string) {
+		observeAuthRequest(outcome, reason, start)
+		a.audit(newAuditEvent(authRequestClaims, result, outcome, reason, message))
+	}
+
+	// A bug in the handler must not take down the subscription
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Errorf("Recovered from panic while handling auth request: %v", r)
+			a.respondWithError(msg, authRequestClaims, serverXkey, reasonInternalError, "internal server error")
+			record(outcomeError, reasonInternalError, "internal server error")
+		}
+	}()
+
+	data, err := a.openRequest(msg.Data, serverXkey)
+	if err != nil {
+		reason, message := rejection(err)
+		glog.Errorf("Rejecting auth request (%s): %s", reason, message)
+		a.respondWithError(msg, nil, "", reason, message)
+		record(outcomeRejected, reason, message)
+		return
+	}
+
+	authRequestClaims, err = natsjwt.DecodeAuthorizationRequestClaims(string(data))
+	if err != nil {
+		glog.Errorf("Error when decoding nats temp token: %v", err)
+		authRequestClaims = nil
+		a.respondWithError(msg, nil, "", reasonMalformedRequest, "error when decoding nats temp token")
+		record(outcomeRejected, reasonMalformedRequest, "error when decoding nats temp token")
+		return
+	}
+
+	// The NATS server stops waiting for the response once the request expires. The
+	// expiry is truncated to seconds, so the server may wait up to a second longer.
+	if authRequestClaims.Expires > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.Unix(authRequestClaims.Expires, 0).Add(time.Second))
+		defer cancel()
+	}
+	if ctx.Err() != nil {
+		glog.Warnf("Rejecting auth request (%s): expired after %s in the queue", reasonTimeout, time.Since(start))
+		a.respondWithError(msg, authRequestClaims, serverXkey, reasonTimeout, "request expired before it was handled")
+		record(outcomeError, reasonTimeout, "request expired before it was handled")
+		return
+	}
+
+	result, err = a.authorize(ctx, authRequestClaims)
+	if err != nil && ctx.Err() != nil {
+		// Lookups that were cut off by the deadline fail with all kinds of errors
+		err = newAuthError(reasonTimeout, "request not handled in time: %v", err)
+	}
+	if err != nil {
+		reason, message := rejection(err)
+		outcome := outcomeRejected
+		if reason == reasonInternalError || reason == reasonTimeout {
+			outcome = outcomeError
+			glog.Errorf("Failed to authorize request: %v", err)
+		} else {
+			glog.Warnf("Rejecting auth request (%s): %s", reason, message)
+		}
+		a.respondWithError(msg, authRequestClaims, serverXkey, reason, message)
+		record(outcome, reason, message)
+		return
+	}
+
+	if err := a.respond(msg, authRequestClaims, serverXkey, natsjwt.AuthorizationResponse{Jwt: result.userJWT}); err != nil {
+		glog.Errorf("Failed to send NATS response: %v", err)
+		record(outcomeError, reasonInternalError, "failed to send response")
+		return
+	}
+	record(outcomeGranted, "", "")
+	if a.connections != nil {
+		a.connections.add(authRequestClaims.Server.ID, authRequestClaims.ClientInformation.ID, result.claims, result.expires)
+	}
+
+	glog.Infof("Successfully issued NATS JWT for user '%s' in account '%s' with roles '%v'", result.claims.ClientID, result.account, result.grant.Roles)
+}
+
+// shed rejects a request that the workers have no room for, so the client fails fast
+// and retries instead of waiting for the auth timeout of the NATS server.
+func (a *authCallout) shed(msg *nats.Msg) {
+	start := time.Now()
+	const message = "too many pending auth requests"
+
+	serverXkey := msg.Header.Get(serverXkeyHeader)
+	var authRequestClaims *natsjwt.AuthorizationRequestClaims
+	if data, err := a.openRequest(msg.Data, serverXkey); err == nil {
+		if authRequestClaims, err = natsjwt.DecodeAuthorizationRequestClaims(string(data)); err != nil {
+			authRequestClaims = nil
+		}
+	}
+	glog.Debugf("Rejecting auth request (%s): %s", reasonOverloaded, message)
+	a.respondWithError(msg, authRequestClaims, serverXkey, reasonOverloaded, message)
+	observeAuthRequest(outcomeError, reasonOverloaded, start)
+	a.audit(newAuditEvent(authRequestClaims, nil, outcomeError, reasonOverloaded, message))
+}
+
+// openRequest returns the plaintext of a request. Requests with the public xkey of the
+// server in the header are encrypted to the xkey of the callout. If the callout has an
+// xkey, plaintext requests are rejected, because the server is expected to encrypt.
+func (a *authCallout) openRequest(data []byte, serverXkey string) ([]byte, error) {
+	switch {
+	case a.xkey == nil && serverXkey == "":
+		return data, nil
+	case a.xkey == nil:
+		return nil, newAuthError(reasonMalformedRequest, "request is encrypted, but XKEY_SEED is not set")
+	case serverXkey == "":
+		return nil, newAuthError(reasonNotEncrypted, "request is not encrypted")
+	}
+
+	plaintext, err := a.xkey.Open(data, serverXkey)
+	if err != nil {
+		return nil, newAuthError(reasonMalformedRequest, "failed to decrypt request: %v", err)
+	}
+	return plaintext, nil
+}
+
+// sealResponse encrypts the response to the xkey of the server if the request was encrypted.
+func (a *authCallout) sealResponse(data []byte, serverXkey string) ([]byte, error) {
+	if a.xkey == nil || serverXkey == "" {
+		return data, nil
+	}
+	return a.xkey.Seal(data, serverXkey)
+}
+
+// authorization is the outcome of an auth request. A rejected request keeps what was
+// known up to the rejection, e.g. the claims of a token whose roles grant nothing.
+type authorization struct {
+	claims  *tokenClaims
+	account string
+	grant   *grant
+	expires time.Time
+	userJWT string
+}
+
+// authorize validates the token of the request and creates the signed NATS user JWT.
+// Rejections are returned as authError with a reason code.
+func (a *authCallout) authorize(ctx context.Context, authRequestClaims *natsjwt.AuthorizationRequestClaims) (*authorization, error) {
+	result := &authorization{}
+
+	// 1. Validate the incoming external JWT
+	claims, err := a.validator.validate(ctx, authRequestClaims.ConnectOptions.Token)
+	if err != nil {
+		return result, err
+	}
+
+	// 2. Extract claims from the valid token
+	result.claims, err = extractClaims(claims, a.rolesClaimPath)
+	if err != nil {
+		return result, err
+	}
+	if a.fleetsClaimPath != nil {
+		if result.claims.Fleets, err = extractFleets(claims, a.fleetsClaimPath); err != nil {
+			return result, err
+		}
+	}
+	if a.revocations != nil {
+		if r, ok := a.revocations.Revoked(result.claims); ok {
+			return result, newAuthError(reasonRevoked, "%s is revoked", r)
+		}
+	}
+
+	// 3. Define permissions based on the roles from the external JWT, and the account
+	// the user is placed in
+	policy := a.policies.current()
+	result.account = policy.account(claims, result.claims.ClientID)
+	vars := subjectVars{VIN: result.claims.VIN, ClientID: result.claims.ClientID}
+	fleets := &fleetAccess{fleets: result.claims.Fleets, store: a.fleets}
+	result.grant, err = policy.resolve(ctx, result.claims.Roles, vars, a.consents, fleets)
+	if err != nil {
+		return result, &authError{Reason: reasonNotAuthorized, Err: fmt.Errorf("%w: %v", errNoPermissions, err)}
+	}
+	if err := result.grant.allowsConnection(authRequestClaims.ClientInformation); err != nil {
+		return result, &authError{Reason: reasonConnectionNotAllowed, Err: err}
+	}
+	result.expires = a.userJWTExpiry(result.claims, result.grant)
+
+	// 4. Create a new NATS User JWT with the permissions
+	result.userJWT, err = a.createNATSUserJWT(result.account, result.grant, result.expires, authRequestClaims)
+	if err != nil {
+		return result, fmt.Errorf("failed to create NATS user JWT: %w", err)
+	}
+	return result, nil
+}
+
+// createNATSUserJWT generates and signs a NATS user JWT with the permissions of the
+// grant. The user is placed in the account by the audience (without operator mode)
+// or by the key that signs the JWT (operator mode).
+func (a *authCallout) createNATSUserJWT(account string, grant *grant, expires time.Time, authReqClaims *natsjwt.AuthorizationRequestClaims) (string, error) {
+	// Create the NATS user claims
+	userClaims := natsjwt.NewUserClaims(authReqClaims.UserNkey)
+	userClaims.Permissions = grant.Permissions
+	userClaims.Limits.NatsLimits = grant.Limits
+	userClaims.AllowedConnectionTypes.Add(grant.ConnectionTypes...)
+	userClaims.Limits.Src.Add(grant.SourceCIDRs...)
+	userClaims.Expires = expires.Unix()
+	userClaims.Name = authReqClaims.ConnectOptions.Name
+	userClaims.Audience = account
+
+	// Sign the claims with the signing key of the account to get the final JWT
+	signingKey, issuerAccount := a.accountKeys.signer(account)
+	userClaims.IssuerAccount = issuerAccount
+	userJWT, err := userClaims.Encode(signingKey)
+	if err != nil {
+		return "", err
+	}
+	observeGrant(grant)
+	return userJWT, nil
+}
+
+// userJWTExpiry returns when the NATS user JWT expires: the earliest of the token
+// expiry, the consents of the grant and the maximum lifetime of the roles. The NATS
+// server disconnects the client once the user JWT expires, so a connection doesn't
+// outlive the credential it was authorized with.
+func (a *authCallout) userJWTExpiry(claims *tokenClaims, grant *grant) time.Time {
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+
+	maxExpiry := a.maxExpiry
+	if grant.MaxExpiry > 0 && (maxExpiry == 0 || grant.MaxExpiry < maxExpiry) {
+		maxExpiry = grant.MaxExpiry
+	}
+
+	expires := claims.Expires
+	if maxExpiry > 0 {
+		if limit := now().Add(maxExpiry); expires.IsZero() || limit.Before(expires) {
+			expires = limit
+		}
+	}
+	if !grant.Expires.IsZero() && grant.Expires.Before(expires) {
+		// The user must not outlive the consent its permissions are based on
+		expires = grant.Expires
+	}
+	return expires
+}
+
+// respond sends the signed authorization response to the NATS server, encrypted to
+// serverXkey if set.
+func (a *authCallout) respond(msg *nats.Msg, authRequestClaims *natsjwt.AuthorizationRequestClaims, serverXkey string, resp natsjwt.AuthorizationResponse) error {
+	resp.IssuerAccount = authRequestClaims.Subject
+
+	respJwt := natsjwt.NewAuthorizationResponseClaims(authRequestClaims.UserNkey)
+	respJwt.AuthorizationResponse = resp
+	respJwt.Audience = authRequestClaims.Server.ID
+	respJwt.Issuer = authRequestClaims.Subject
+
+	respJwtResult, err := respJwt.Encode(a.accountKeyPair)
+	if err != nil {
+		return fmt.Errorf("failed to encode response: %w", err)
+	}
+	data, err := a.sealResponse([]byte(respJwtResult), serverXkey)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt response: %w", err)
+	}
+	return msg.Respond(data)
+}
+
+// respondWithError sends a denial response with the reason code. If the request
+// couldn't be decrypted or decoded, there is no user to address the response to, so
+// the NATS server will only see a malformed response and deny the connection.
+func (a *authCallout) respondWithError(msg *nats.Msg, authRequestClaims *natsjwt.AuthorizationRequestClaims, serverXkey string, reason string, errMsg string) {
+	resp := natsjwt.AuthorizationResponse{Error: fmt.Sprintf("%s: %s", reason, errMsg)}
+	if authRequestClaims == nil {
+		_ = msg.Respond([]byte(resp.Error))
+		return
+	}
+	if err := a.respond(msg, authRequestClaims, serverXkey, resp); err != nil {
+		glog.Errorf("Failed to send NATS error response: %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	natsjwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+// testCallout is an authCallout with a static key set and the given policy.
+type testCallout struct {
+	*authCallout
+	signer *testSigner
+}
+
+func newTestCallout(t testing.TB, policyYAML string) *testCallout {
+	t.Helper()
+	policy, err := parsePolicy([]byte(policyYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := &policyStore{}
+	policies.policy.Store(policy)
+
+	accountKeyPair, err := nkeys.CreateAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := newTestSigner(t, "key-1")
+	return &testCallout{
+		authCallout: &authCallout{
+			validator:       &tokenValidator{keys: newStaticKeySet(newTestJwkSet(signer.jwk(t))), leeway: defaultTokenLeeway},
+			policies:        policies,
+			rolesClaimPath:  []string{"realm_access", "roles"},
+			fleetsClaimPath: []string{defaultFleetsClaimPath},
+			accountKeyPair:  accountKeyPair,
+			accountKeys:     &accountKeys{issuer: accountKeyPair},
+			maxExpiry:       defaultNatsJwtMaxExpiry,
+		},
+		signer: signer,
+	}
+}
+
+// authorize sends a request with the token through the callout and decodes the issued user JWT.
+func (c *testCallout) authorize(t *testing.T, token string) (*natsjwt.UserClaims, error) {
+	t.Helper()
+	return c.authorizeClient(t, token, natsjwt.ClientInformation{Host: "127.0.0.1", Kind: "Client", Type: "nats"})
+}
+
+// authorizeClient is authorize for a request from the given client.
+func (c *testCallout) authorizeClient(t *testing.T, token string, client natsjwt.ClientInformation) (*natsjwt.UserClaims, error) {
+	t.Helper()
+	userKeyPair, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userNkey, _ := userKeyPair.PublicKey()
+
+	serverKeyPair, _ := nkeys.CreateServer()
+	serverID, _ := serverKeyPair.PublicKey()
+
+	req := natsjwt.NewAuthorizationRequestClaims(userNkey)
+	req.UserNkey = userNkey
+	req.Server = natsjwt.ServerID{ID: serverID}
+	req.ConnectOptions.Token = token
+	req.ClientInformation = client
+
+	result, err := c.authCallout.authorize(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	userClaims, err := natsjwt.DecodeUserClaims(result.userJWT)
+	if err != nil {
+		t.Fatalf("failed to decode user JWT: %v", err)
+	}
+	return userClaims, nil
+}
+
+const expiryTestPolicy = `
+roles:
+  edge-device:
+    sub:
+      allow: ["commands.{{.VIN}}.>"]
+  telemetry-client:
+    pub:
+      allow: ["telemetry.{{.VIN}}.>"]
+    maxExpiry: 5m
+`
+
+func TestUserJWTExpiry(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	callout := newTestCallout(t, expiryTestPolicy)
+	callout.maxExpiry = 30 * time.Minute
+	callout.now = func() time.Time { return now }
+	callout.validator.now = callout.now
+
+	tests := []struct {
+		name        string
+		tokenExpiry time.Duration
+		roles       []string
+		want        time.Duration
+	}{
+		{name: "token expires first", tokenExpiry: 15 * time.Minute, roles: []string{"edge-device"}, want: 15 * time.Minute},
+		{name: "max expiry", tokenExpiry: 2 * time.Hour, roles: []string{"edge-device"}, want: 30 * time.Minute},
+		{name: "role override", tokenExpiry: 15 * time.Minute, roles: []string{"telemetry-client"}, want: 5 * time.Minute},
+		{name: "shortest role wins", tokenExpiry: 15 * time.Minute, roles: []string{"edge-device", "telemetry-client"}, want: 5 * time.Minute},
+		{name: "token shorter than role override", tokenExpiry: 2 * time.Minute, roles: []string{"telemetry-client"}, want: 2 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims(now)
+			claims["exp"] = now.Add(tt.tokenExpiry).Unix()
+			claims["realm_access"] = map[string]any{"roles": tt.roles}
+
+			userClaims, err := callout.authorize(t, callout.signer.sign(t, claims))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := now.Add(tt.want).Unix(); userClaims.Expires != want {
+				t.Errorf("expected expiry in %s, got %s", tt.want, time.Unix(userClaims.Expires, 0).Sub(now))
+			}
+		})
+	}
+}
+
+func TestUserJWTExpiryWithConsent(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	callout := newTestCallout(t, consentTestPolicy)
+	callout.now = func() time.Time { return now }
+	callout.validator.now = callout.now
+	callout.consents = staticConsents{
+		{ClientID: "VIN1", VIN: "VIN2", Families: []string{"*"}, Expires: now.Add(3 * time.Minute)},
+	}
+
+	claims := validClaims(now)
+	claims["realm_access"] = map[string]any{"roles": []string{"telemetry-collector"}}
+
+	userClaims, err := callout.authorize(t, callout.signer.sign(t, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(3 * time.Minute).Unix(); userClaims.Expires != want {
+		t.Errorf("expected user JWT to expire with the consent, got %s", time.Unix(userClaims.Expires, 0).Sub(now))
+	}
+}
+
+func TestParsePolicyRejectsNegativeMaxExpiry(t *testing.T) {
+	_, err := parsePolicy([]byte(`
+roles:
+  edge-device:
+    sub:
+      allow: ["commands.{{.VIN}}.>"]
+    maxExpiry: -5m
+`))
+	if err == nil {
+		t.Fatal("expected negative maxExpiry to be rejected")
+	}
+}
+
+const limitsTestPolicy = `
+roles:
+  edge-device:
+    sub:
+      allow: ["commands.{{.VIN}}.>"]
+    limits:
+      subs: 10
+      payload: 65536
+      data: 1048576
+      connectionTypes: [STANDARD, WEBSOCKET]
+      sourceCidrs: [10.0.0.0/8]
+`
+
+func TestUserJWTLimits(t *testing.T) {
+	callout := newTestCallout(t, limitsTestPolicy)
+	token := callout.signer.sign(t, validClaims(time.Now()))
+
+	userClaims, err := callout.authorizeClient(t, token, natsjwt.ClientInformation{Host: "10.1.2.3", Kind: "Client", Type: "websocket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := natsjwt.NatsLimits{Subs: 10, Data: 1048576, Payload: 65536}
+	if userClaims.Limits.NatsLimits != want {
+		t.Errorf("expected limits %+v, got %+v", want, userClaims.Limits.NatsLimits)
+	}
+	if len(userClaims.AllowedConnectionTypes) != 2 || !userClaims.AllowedConnectionTypes.Contains(natsjwt.ConnectionTypeStandard) ||
+		!userClaims.AllowedConnectionTypes.Contains(natsjwt.ConnectionTypeWebsocket) {
+		t.Errorf("expected STANDARD and WEBSOCKET connections, got %v", userClaims.AllowedConnectionTypes)
+	}
+	if len(userClaims.Limits.Src) != 1 || !userClaims.Limits.Src.Contains("10.0.0.0/8") {
+		t.Errorf("expected source CIDR 10.0.0.0/8, got %v", userClaims.Limits.Src)
+	}
+
+	// The NATS server doesn't apply them to auth callout users, so the callout rejects
+	// connections they don't allow.
+	for _, client := range []natsjwt.ClientInformation{
+		{Host: "10.1.2.3", Kind: "Leafnode"},
+		{Host: "192.168.1.1", Kind: "Client", Type: "nats"},
+	} {
+		_, err := callout.authorizeClient(t, token, client)
+		var authErr *authError
+		if !errors.As(err, &authErr) || authErr.Reason != reasonConnectionNotAllowed {
+			t.Errorf("expected %+v to be rejected with %s, got %v", client, reasonConnectionNotAllowed, err)
+		}
+	}
+}
+
+func TestUserJWTWithoutLimits(t *testing.T) {
+	callout := newTestCallout(t, expiryTestPolicy)
+	userClaims, err := callout.authorizeClient(t, callout.signer.sign(t, validClaims(time.Now())), natsjwt.ClientInformation{Kind: "Leafnode"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := natsjwt.NatsLimits{Subs: natsjwt.NoLimit, Data: natsjwt.NoLimit, Payload: natsjwt.NoLimit}
+	if userClaims.Limits.NatsLimits != want || len(userClaims.AllowedConnectionTypes) != 0 || len(userClaims.Limits.Src) != 0 {
+		t.Errorf("expected no limits, got %+v and connection types %v", userClaims.Limits, userClaims.AllowedConnectionTypes)
+	}
+}
+
+func TestEncryptedRequests(t *testing.T) {
+	calloutXkey, _ := nkeys.CreateCurveKeys()
+	calloutXkeyPublic, _ := calloutXkey.PublicKey()
+	serverXkey, _ := nkeys.CreateCurveKeys()
+	serverXkeyPublic, _ := serverXkey.PublicKey()
+	otherXkey, _ := nkeys.CreateCurveKeys()
+
+	request := []byte("request")
+	encrypted, err := serverXkey.Seal(request, calloutXkeyPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedByOther, err := otherXkey.Seal(request, calloutXkeyPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		xkey       nkeys.KeyPair
+		data       []byte
+		serverXkey string
+		wantReason string
+	}{
+		{name: "plaintext without xkey", data: request},
+		{name: "encrypted", xkey: calloutXkey, data: encrypted, serverXkey: serverXkeyPublic},
+		{name: "plaintext when encryption is required", xkey: calloutXkey, data: request, wantReason: reasonNotEncrypted},
+		{name: "encrypted without xkey", data: encrypted, serverXkey: serverXkeyPublic, wantReason: reasonMalformedRequest},
+		{name: "encrypted by other key", xkey: calloutXkey, data: encryptedByOther, serverXkey: serverXkeyPublic, wantReason: reasonMalformedRequest},
+		{name: "plaintext with header", xkey: calloutXkey, data: request, serverXkey: serverXkeyPublic, wantReason: reasonMalformedRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callout := &authCallout{xkey: tt.xkey}
+			got, err := callout.openRequest(tt.data, tt.serverXkey)
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if string(got) != string(request) {
+					t.Errorf("expected %q, got %q", request, got)
+				}
+				return
+			}
+			if reason, _ := rejection(err); reason != tt.wantReason {
+				t.Errorf("expected reason %q, got %v", tt.wantReason, err)
+			}
+		})
+	}
+}
+
+func TestEncryptedResponse(t *testing.T) {
+	calloutXkey, _ := nkeys.CreateCurveKeys()
+	calloutXkeyPublic, _ := calloutXkey.PublicKey()
+	serverXkey, _ := nkeys.CreateCurveKeys()
+	serverXkeyPublic, _ := serverXkey.PublicKey()
+
+	callout := &authCallout{xkey: calloutXkey}
+	sealed, err := callout.sealResponse([]byte("response"), serverXkeyPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := serverXkey.Open(sealed, calloutXkeyPublic)
+	if err != nil {
+		t.Fatalf("server can't decrypt response: %v", err)
+	}
+	if string(opened) != "response" {
+		t.Errorf("expected response, got %q", opened)
+	}
+
+	// Responses to plaintext requests stay plaintext
+	plain, err := callout.sealResponse([]byte("response"), "")
+	if err != nil || string(plain) != "response" {
+		t.Errorf("expected plaintext response, got %q (%v)", plain, err)
+	}
+}
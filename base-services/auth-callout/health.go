@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	glog "github.com/labstack/gommon/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultHTTPAddr is where /metrics, /healthz and /readyz are served.
+const defaultHTTPAddr = ":8080"
+
+// readiness collects the checks that must pass before the service can answer auth
+// requests, e.g. an active NATS subscription and loaded keys.
+type readiness struct {
+	mu     sync.RWMutex
+	checks []readinessCheck
+}
+
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// add registers a check. Checks can be added while the server is running.
+func (r *readiness) add(name string, check func() error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = append(r.checks, readinessCheck{name: name, check: check})
+}
+
+// ready runs all checks and returns the joined errors of the failed ones.
+func (r *readiness) ready() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.checks) == 0 {
+		return errors.New("starting")
+	}
+
+	var errs []error
+	for _, c := range r.checks {
+		if err := c.check(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// newHTTPHandler serves the Prometheus metrics and the health endpoints. /healthz
+// only reports that the process is running, /readyz runs the readiness checks.
+func newHTTPHandler(r *readiness) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if err := r.ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// serveHTTP runs the metrics and health server. It is not fatal if it fails, the
+// service keeps answering auth requests.
+func serveHTTP(addr string, r *readiness) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           newHTTPHandler(r),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	glog.Infof("Serving metrics and health endpoints on %s", addr)
+	if err := server.ListenAndServe(); err != nil {
+		glog.Errorf("Metrics and health server stopped: %v", err)
+	}
+}
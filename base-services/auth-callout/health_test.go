@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func get(t *testing.T, handler http.Handler, path string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	ready := &readiness{}
+	handler := newHTTPHandler(ready)
+
+	if code, _ := get(t, handler, "/healthz"); code != http.StatusOK {
+		t.Errorf("expected /healthz to be OK, got %d", code)
+	}
+	if code, _ := get(t, handler, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to fail while starting, got %d", code)
+	}
+
+	subscribed := false
+	ready.add("nats", func() error {
+		if !subscribed {
+			return errors.New("auth request subscription is not active")
+		}
+		return nil
+	})
+	ready.add("keys", func() error { return nil })
+
+	code, body := get(t, handler, "/readyz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "nats: auth request subscription is not active") {
+		t.Errorf("expected /readyz to report the failed check, got %d %q", code, body)
+	}
+
+	subscribed = true
+	if code, body := get(t, handler, "/readyz"); code != http.StatusOK {
+		t.Errorf("expected /readyz to be OK, got %d %q", code, body)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	before := testutil.ToFloat64(authRequests.WithLabelValues(outcomeRejected, reasonExpired))
+	observeAuthRequest(outcomeRejected, reasonExpired, time.Now())
+	if got := testutil.ToFloat64(authRequests.WithLabelValues(outcomeRejected, reasonExpired)); got != before+1 {
+		t.Errorf("expected counter to increase to %v, got %v", before+1, got)
+	}
+
+	code, body := get(t, newHTTPHandler(&readiness{}), "/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("expected /metrics to be OK, got %d", code)
+	}
+	for _, name := range []string{
+		`auth_callout_requests_total{outcome="rejected",reason="token_expired"}`,
+		"auth_callout_request_duration_seconds_bucket",
+	} {
+		if !strings.Contains(body, name) {
+			t.Errorf("expected metrics to contain %s", name)
+		}
+	}
+}
+
+func TestGrantMetrics(t *testing.T) {
+	callout := newTestCallout(t, expiryTestPolicy)
+	before := testutil.ToFloat64(grantedRoles.WithLabelValues("telemetry-client"))
+
+	claims := validClaims(time.Now())
+	claims["realm_access"] = map[string]any{"roles": []string{"telemetry-client"}}
+	if _, err := callout.authorize(t, callout.signer.sign(t, claims)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(grantedRoles.WithLabelValues("telemetry-client")); got != before+1 {
+		t.Errorf("expected granted roles counter to increase to %v, got %v", before+1, got)
+	}
+}
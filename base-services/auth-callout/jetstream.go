@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"text/template"
+)
+
+// defaultInboxPrefix is the prefix of the reply subjects of NATS clients.
+const defaultInboxPrefix = "_INBOX"
+
+// JetStreamPolicy grants the JetStream API subjects to consume from named durable
+// consumers, instead of the whole $JS.API.> namespace.
+type JetStreamPolicy struct {
+	// InboxPrefix is the prefix of the reply subjects of the client, default "_INBOX".
+	// A per client prefix like "_INBOX_{{.ClientID}}" (nats.CustomInboxPrefix) keeps
+	// the client from reading the replies of others.
+	InboxPrefix string              `yaml:"inboxPrefix"`
+	Consumers   []JetStreamConsumer `yaml:"consumers"`
+}
+
+// JetStreamConsumer is a durable consumer of a stream. Stream, Consumer and
+// DeliverSubject are templates like subjects, e.g. "collector-{{.ClientID}}".
+type JetStreamConsumer struct {
+	Stream   string `yaml:"stream"`
+	Consumer string `yaml:"consumer"`
+	// Create allows the client to create and update the consumer itself.
+	Create bool `yaml:"create"`
+	// DeliverSubject is the deliver subject of a push consumer. If empty, the consumer
+	// is a pull consumer.
+	DeliverSubject string `yaml:"deliverSubject"`
+}
+
+// subjects returns the publish and subscribe subject templates of the policy. The
+// names of streams and consumers are checked to render to a single subject token.
+func (j *JetStreamPolicy) subjects() (pub, sub []string, err error) {
+	if len(j.Consumers) == 0 {
+		return nil, nil, errors.New("no consumers")
+	}
+	inbox := j.InboxPrefix
+	if inbox == "" {
+		inbox = defaultInboxPrefix
+	}
+	// Replies of the JetStream API and pulled messages are delivered to the inbox
+	sub = append(sub, inbox+".>")
+
+	sample := subjectVars{VIN: "VIN", ClientID: "client"}
+	var errs []error
+	for i, c := range j.Consumers {
+		if err := checkNameTemplate(c.Stream, sample); err != nil {
+			errs = append(errs, fmt.Errorf("consumers[%d].stream: %w", i, err))
+			continue
+		}
+		if err := checkNameTemplate(c.Consumer, sample); err != nil {
+			errs = append(errs, fmt.Errorf("consumers[%d].consumer: %w", i, err))
+			continue
+		}
+
+		stream, consumer := c.Stream, c.Stream+"."+c.Consumer
+		pub = append(pub,
+			"$JS.API.STREAM.INFO."+stream,
+			"$JS.API.CONSUMER.INFO."+consumer,
+			"$JS.ACK."+consumer+".>",
+		)
+		if c.Create {
+			pub = append(pub,
+				"$JS.API.CONSUMER.CREATE."+consumer,
+				"$JS.API.CONSUMER.CREATE."+consumer+".>",
+				"$JS.API.CONSUMER.DURABLE.CREATE."+consumer,
+			)
+		}
+		if c.DeliverSubject == "" {
+			pub = append(pub, "$JS.API.CONSUMER.MSG.NEXT."+consumer)
+		} else {
+			// Push consumers deliver to the deliver subject and expect flow control replies
+			sub = append(sub, c.DeliverSubject)
+			pub = append(pub, "$JS.FC."+stream+".>")
+		}
+	}
+	return pub, sub, errors.Join(errs...)
+}
+
+// checkNameTemplate checks that a stream or consumer name renders to a single token.
+func checkNameTemplate(name string, sample subjectVars) error {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(name)
+	if err != nil {
+		return fmt.Errorf("invalid template %q: %w", name, err)
+	}
+	rendered, err := renderSubject(tmpl, sample)
+	if err != nil {
+		return err
+	}
+	if !isValidToken(rendered) {
+		return fmt.Errorf("template %q renders to invalid name %q", name, rendered)
+	}
+	return nil
+}
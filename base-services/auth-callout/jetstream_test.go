@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const jetStreamTestPolicy = `
+roles:
+  js-collector:
+    jetstream:
+      inboxPrefix: "_INBOX_{{.ClientID}}"
+      consumers:
+        - stream: TELEMETRY
+          consumer: "collector-{{.ClientID}}"
+  js-push:
+    jetstream:
+      consumers:
+        - stream: TELEMETRY
+          consumer: "push-{{.ClientID}}"
+          create: true
+          deliverSubject: "deliver.{{.ClientID}}"
+  responder:
+    pub:
+      allow: ["status.{{.ClientID}}"]
+    sub:
+      allow: ["service.{{.ClientID}}"]
+    resp:
+      maxMsgs: 1
+      expires: 1m
+  listener:
+    pub:
+      allow: ["status.{{.ClientID}}"]
+    sub:
+      allow: ["service.{{.ClientID}}"]
+`
+
+func TestJetStreamPolicySubjects(t *testing.T) {
+	policy, err := parsePolicy([]byte(jetStreamTestPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := subjectVars{VIN: "svc1", ClientID: "svc1"}
+
+	g, err := policy.resolve(context.Background(), []string{"js-collector"}, vars, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPub := []string{
+		"$JS.API.STREAM.INFO.TELEMETRY",
+		"$JS.API.CONSUMER.INFO.TELEMETRY.collector-svc1",
+		"$JS.ACK.TELEMETRY.collector-svc1.>",
+		"$JS.API.CONSUMER.MSG.NEXT.TELEMETRY.collector-svc1",
+	}
+	if !slices.Equal([]string(g.Permissions.Pub.Allow), wantPub) {
+		t.Errorf("expected pub %v, got %v", wantPub, g.Permissions.Pub.Allow)
+	}
+	if want := []string{"_INBOX_svc1.>"}; !slices.Equal([]string(g.Permissions.Sub.Allow), want) {
+		t.Errorf("expected sub %v, got %v", want, g.Permissions.Sub.Allow)
+	}
+
+	g, err = policy.resolve(context.Background(), []string{"js-push"}, vars, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPub = []string{
+		"$JS.API.STREAM.INFO.TELEMETRY",
+		"$JS.API.CONSUMER.INFO.TELEMETRY.push-svc1",
+		"$JS.ACK.TELEMETRY.push-svc1.>",
+		"$JS.API.CONSUMER.CREATE.TELEMETRY.push-svc1",
+		"$JS.API.CONSUMER.CREATE.TELEMETRY.push-svc1.>",
+		"$JS.API.CONSUMER.DURABLE.CREATE.TELEMETRY.push-svc1",
+		"$JS.FC.TELEMETRY.>",
+	}
+	if !slices.Equal([]string(g.Permissions.Pub.Allow), wantPub) {
+		t.Errorf("expected pub %v, got %v", wantPub, g.Permissions.Pub.Allow)
+	}
+	if want := []string{"_INBOX.>", "deliver.svc1"}; !slices.Equal([]string(g.Permissions.Sub.Allow), want) {
+		t.Errorf("expected sub %v, got %v", want, g.Permissions.Sub.Allow)
+	}
+}
+
+func TestParsePolicyJetStreamValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr string
+	}{
+		{name: "no consumers", policy: "roles:\n  r:\n    jetstream:\n      inboxPrefix: _INBOX", wantErr: "no consumers"},
+		{name: "stream with dot", policy: "roles:\n  r:\n    jetstream:\n      consumers:\n        - stream: A.B\n          consumer: c", wantErr: "invalid name"},
+		{name: "wildcard consumer", policy: "roles:\n  r:\n    jetstream:\n      consumers:\n        - stream: A\n          consumer: \"*\"", wantErr: "invalid name"},
+		{name: "missing consumer", policy: "roles:\n  r:\n    jetstream:\n      consumers:\n        - stream: A", wantErr: "invalid name"},
+		{name: "invalid inbox", policy: "roles:\n  r:\n    jetstream:\n      inboxPrefix: \"a..b\"\n      consumers:\n        - stream: A\n          consumer: c", wantErr: "invalid subject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePolicy([]byte(tt.policy))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// tokenFor returns a token of the client with the roles.
+func (c *testCallout) tokenFor(t testing.TB, clientID string, roles ...string) string {
+	t.Helper()
+	claims := validClaims(time.Now())
+	claims["azp"] = clientID
+	claims["realm_access"] = map[string]any{"roles": roles}
+	return c.signer.sign(t, claims)
+}
+
+func TestJetStreamDurableConsumer(t *testing.T) {
+	callout := newTestCallout(t, jetStreamTestPolicy)
+	srv := runCalloutServer(t, callout)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The admin sets up the stream and the durable consumers
+	admin, err := jetstream.New(srv.admin(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := admin.CreateStream(ctx, jetstream.StreamConfig{Name: "TELEMETRY", Subjects: []string{"telemetry.>"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"collector-svc1", "collector-svc2"} {
+		if _, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{Durable: name, AckPolicy: jetstream.AckExplicitPolicy}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := admin.Publish(ctx, "telemetry.VIN1.battery", []byte("42")); err != nil {
+		t.Fatal(err)
+	}
+
+	nc, err := srv.connectWithToken(t, callout.tokenFor(t, "svc1", "js-collector"), nats.CustomInboxPrefix("_INBOX_svc1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The own durable consumer can be fetched from and acknowledged
+	consumer, err := js.Consumer(ctx, "TELEMETRY", "collector-svc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := consumer.Fetch(1, jetstream.FetchMaxWait(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []string
+	for msg := range batch.Messages() {
+		received = append(received, string(msg.Data()))
+		if err := msg.DoubleAck(ctx); err != nil {
+			t.Fatalf("failed to acknowledge: %v", err)
+		}
+	}
+	if err := batch.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(received, []string{"42"}) {
+		t.Fatalf("expected to receive the telemetry, got %v", received)
+	}
+	info, err := stream.Consumer(ctx, "collector-svc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending := info.CachedInfo().NumAckPending; pending != 0 {
+		t.Errorf("expected the message to be acknowledged, %d pending", pending)
+	}
+
+	// The consumer of another client is denied
+	otherCtx, otherCancel := context.WithTimeout(ctx, time.Second)
+	defer otherCancel()
+	if _, err := js.Consumer(otherCtx, "TELEMETRY", "collector-svc2"); err == nil {
+		t.Error("expected the consumer of another client to be denied")
+	}
+	if _, err := js.CreateStream(otherCtx, jetstream.StreamConfig{Name: "OTHER", Subjects: []string{"other.>"}}); err == nil {
+		t.Error("expected creating a stream to be denied")
+	}
+}
+
+func TestJetStreamInboxPrefix(t *testing.T) {
+	callout := newTestCallout(t, jetStreamTestPolicy)
+	srv := runCalloutServer(t, callout)
+
+	errs := make(chan error, 10)
+	nc, err := srv.connectWithToken(t, callout.tokenFor(t, "svc1", "js-collector"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errs <- err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The replies of other clients can't be read
+	if _, err := nc.SubscribeSync("_INBOX.>"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, nats.ErrPermissionViolation) {
+			t.Errorf("expected a permissions violation, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected the subscription on the shared inbox to be denied")
+	}
+}
+
+func TestAllowResponses(t *testing.T) {
+	callout := newTestCallout(t, jetStreamTestPolicy)
+	srv := runCalloutServer(t, callout)
+	admin := srv.admin(t)
+
+	for _, tt := range []struct {
+		role    string
+		allowed bool
+	}{
+		{role: "responder", allowed: true},
+		{role: "listener"},
+	} {
+		t.Run(tt.role, func(t *testing.T) {
+			nc, err := srv.connectWithToken(t, callout.tokenFor(t, tt.role, tt.role))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := nc.Subscribe("service."+tt.role, func(msg *nats.Msg) { _ = msg.Respond([]byte("pong")) }); err != nil {
+				t.Fatal(err)
+			}
+			if err := nc.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			reply, err := admin.Request("service."+tt.role, []byte("ping"), time.Second)
+			switch {
+			case tt.allowed && err != nil:
+				t.Errorf("expected a reply, got %v", err)
+			case tt.allowed && string(reply.Data) != "pong":
+				t.Errorf("unexpected reply %q", reply.Data)
+			case !tt.allowed && err == nil:
+				t.Error("expected the reply to be denied without a resp permission")
+			}
+		})
+	}
+}
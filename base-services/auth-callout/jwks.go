@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	glog "github.com/labstack/gommon/log"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// Default values for the JWKS cache, used when no environment override is given.
+const (
+	defaultJwksRefreshInterval = 5 * time.Minute
+	defaultJwksMinRefetch      = 10 * time.Second
+	defaultJwksFetchTimeout    = 10 * time.Second
+)
+
+// keySet caches the Keycloak JSON Web Key Set. It is refreshed on a schedule and
+// refetched once when a token references an unknown key ID. When Keycloak can't be
+// reached, the last successfully fetched key set keeps being served.
+type keySet struct {
+	url          string
+	client       *http.Client
+	fetchTimeout time.Duration
+	// minRefetch limits how often an unknown kid may trigger a refetch, so that
+	// tokens with random kids can't be used to hammer Keycloak.
+	minRefetch time.Duration
+
+	// fetchMu serializes fetches so concurrent cache misses cause only one request.
+	fetchMu sync.Mutex
+
+	mu          sync.RWMutex
+	set         jwk.Set
+	lastAttempt time.Time
+	lastSuccess time.Time
+	lastErr     error
+}
+
+// newKeySet creates a key set that loads its keys from the given JWKS URL.
+// The initial set is optional and is served until the first fetch succeeds.
+func newKeySet(url string, client *http.Client, initial jwk.Set) *keySet {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if initial != nil {
+		jwksKeys.Set(float64(initial.Len()))
+	}
+	return &keySet{
+		url:          url,
+		client:       client,
+		fetchTimeout: defaultJwksFetchTimeout,
+		minRefetch:   defaultJwksMinRefetch,
+		set:          initial,
+	}
+}
+
+// newStaticKeySet creates a key set that never fetches and always serves the given keys.
+func newStaticKeySet(set jwk.Set) *keySet {
+	if set != nil {
+		jwksKeys.Set(float64(set.Len()))
+	}
+	return &keySet{set: set}
+}
+
+// refresh fetches the JWKS and replaces the cached keys. On failure the previously
+// cached keys are kept and the error is returned.
+func (k *keySet) refresh(ctx context.Context) error {
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+	return k.fetchLocked(ctx)
+}
+
+func (k *keySet) fetchLocked(ctx context.Context) error {
+	if k.url == "" {
+		return errors.New("no JWKS URL configured")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, k.fetchTimeout)
+	defer cancel()
+
+	set, err := jwk.Fetch(ctx, k.url, jwk.WithHTTPClient(k.client))
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.lastAttempt = time.Now()
+	if err == nil && set.Len() == 0 {
+		err = errors.New("JWKS contains no keys")
+	}
+	if err != nil {
+		k.lastErr = fmt.Errorf("failed to fetch JWKS from %s: %w", redactURL(k.url), err)
+		jwksRefreshes.WithLabelValues("failure").Inc()
+		return k.lastErr
+	}
+	k.set = set
+	k.lastSuccess = k.lastAttempt
+	k.lastErr = nil
+	jwksRefreshes.WithLabelValues("success").Inc()
+	jwksLastSuccess.Set(float64(k.lastSuccess.Unix()))
+	jwksKeys.Set(float64(set.Len()))
+	return nil
+}
+
+// run refreshes the key set every interval until the context is cancelled.
+func (k *keySet) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.refresh(ctx); err != nil {
+				glog.Warnf("JWKS refresh failed, keeping last good key set: %v", err)
+			} else {
+				glog.Debugf("JWKS refreshed from %s", redactURL(k.url))
+			}
+		}
+	}
+}
+
+// lookup returns the key with the given ID. If the key is unknown, the JWKS is
+// refetched once (subject to minRefetch) before giving up.
+func (k *keySet) lookup(ctx context.Context, keyID string) (jwk.Key, error) {
+	if key, ok := k.cached(keyID); ok {
+		return key, nil
+	}
+	if k.url == "" {
+		return nil, fmt.Errorf("unable to find key with kid: %q", keyID)
+	}
+
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+
+	// Another request may have refreshed the keys while we were waiting.
+	if key, ok := k.cached(keyID); ok {
+		return key, nil
+	}
+
+	k.mu.RLock()
+	sinceLastAttempt := time.Since(k.lastAttempt)
+	k.mu.RUnlock()
+
+	if sinceLastAttempt >= k.minRefetch {
+		glog.Infof("Unknown kid %q, refetching JWKS", keyID)
+		if err := k.fetchLocked(ctx); err != nil {
+			glog.Warnf("JWKS refetch failed, keeping last good key set: %v", err)
+		}
+		if key, ok := k.cached(keyID); ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unable to find key with kid: %q", keyID)
+}
+
+func (k *keySet) cached(keyID string) (jwk.Key, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.set == nil {
+		return nil, false
+	}
+	return k.set.LookupKeyID(keyID)
+}
+
+// loaded reports whether any keys are available for validation.
+func (k *keySet) loaded() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.set != nil && k.set.Len() > 0
+}
+
+// newJwksHTTPClient creates the HTTP client used to fetch the JWKS. If caFile is
+// set, the server certificate is verified against that CA instead of the system pool.
+func newJwksHTTPClient(caFile string) (*http.Client, error) {
+	if caFile == "" {
+		return &http.Client{}, nil
+	}
+
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return &http.Client{Transport: transport}, nil
+}
+
+// loadCertPool reads a PEM file with CA certificates.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// fakeJwks is a JWKS endpoint whose keys and availability can be changed by the test.
+type fakeJwks struct {
+	mu       sync.Mutex
+	set      jwk.Set
+	down     bool
+	requests atomic.Int32
+}
+
+func (f *fakeJwks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests.Add(1)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(f.set)
+}
+
+func (f *fakeJwks) setKeys(set jwk.Set) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set = set
+}
+
+func (f *fakeJwks) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func newTestJwk(t *testing.T, kid string) jwk.Key {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.New(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = key.Set(jwk.KeyIDKey, kid)
+	return key
+}
+
+func newTestJwkSet(keys ...jwk.Key) jwk.Set {
+	set := jwk.NewSet()
+	for _, key := range keys {
+		set.Add(key)
+	}
+	return set
+}
+
+func TestKeySetRefetchesOnUnknownKid(t *testing.T) {
+	jwks := &fakeJwks{set: newTestJwkSet(newTestJwk(t, "key-1"))}
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	keys := newKeySet(srv.URL, srv.Client(), nil)
+	keys.minRefetch = 0
+	if err := keys.refresh(context.Background()); err != nil {
+		t.Fatalf("initial refresh failed: %v", err)
+	}
+
+	if _, err := keys.lookup(context.Background(), "key-1"); err != nil {
+		t.Fatalf("expected key-1 to be found: %v", err)
+	}
+
+	// Keycloak rotates its keys, the next token uses the new kid.
+	jwks.setKeys(newTestJwkSet(newTestJwk(t, "key-2")))
+	before := jwks.requests.Load()
+	if _, err := keys.lookup(context.Background(), "key-2"); err != nil {
+		t.Fatalf("expected key-2 to be found after refetch: %v", err)
+	}
+	if got := jwks.requests.Load() - before; got != 1 {
+		t.Errorf("expected exactly one refetch, got %d", got)
+	}
+}
+
+func TestKeySetLimitsUnknownKidRefetches(t *testing.T) {
+	jwks := &fakeJwks{set: newTestJwkSet(newTestJwk(t, "key-1"))}
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	keys := newKeySet(srv.URL, srv.Client(), nil)
+	keys.minRefetch = time.Hour
+	if err := keys.refresh(context.Background()); err != nil {
+		t.Fatalf("initial refresh failed: %v", err)
+	}
+
+	before := jwks.requests.Load()
+	for range 5 {
+		if _, err := keys.lookup(context.Background(), "unknown"); err == nil {
+			t.Fatal("expected unknown kid to fail")
+		}
+	}
+	if got := jwks.requests.Load() - before; got != 0 {
+		t.Errorf("expected no refetch within minRefetch, got %d", got)
+	}
+}
+
+func TestKeySetKeepsLastGoodKeysWhenUnreachable(t *testing.T) {
+	jwks := &fakeJwks{set: newTestJwkSet(newTestJwk(t, "key-1"))}
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	keys := newKeySet(srv.URL, srv.Client(), nil)
+	keys.minRefetch = 0
+	if err := keys.refresh(context.Background()); err != nil {
+		t.Fatalf("initial refresh failed: %v", err)
+	}
+
+	jwks.setDown(true)
+	if err := keys.refresh(context.Background()); err == nil {
+		t.Fatal("expected refresh to fail while the JWKS endpoint is down")
+	}
+	if _, err := keys.lookup(context.Background(), "key-1"); err != nil {
+		t.Fatalf("expected key-1 to still be served: %v", err)
+	}
+	if !keys.loaded() {
+		t.Error("expected key set to report loaded keys")
+	}
+}
+
+func TestKeySetScheduledRefresh(t *testing.T) {
+	jwks := &fakeJwks{set: newTestJwkSet(newTestJwk(t, "key-1"))}
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	// Unknown kid refetches are disabled so only the schedule can load key-2.
+	keys := newKeySet(srv.URL, srv.Client(), nil)
+	keys.minRefetch = time.Hour
+	if err := keys.refresh(context.Background()); err != nil {
+		t.Fatalf("initial refresh failed: %v", err)
+	}
+	jwks.setKeys(newTestJwkSet(newTestJwk(t, "key-2")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go keys.run(ctx, 10*time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := keys.cached("key-2"); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("scheduled refresh did not pick up key-2")
+}
+
+func TestStaticKeySetNeverFetches(t *testing.T) {
+	keys := newStaticKeySet(newTestJwkSet(newTestJwk(t, "key-1")))
+
+	if _, err := keys.lookup(context.Background(), "key-1"); err != nil {
+		t.Fatalf("expected key-1 to be found: %v", err)
+	}
+	if _, err := keys.lookup(context.Background(), "key-2"); err == nil {
+		t.Fatal("expected unknown kid to fail")
+	}
+}
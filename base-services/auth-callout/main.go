@@ -1,255 +1,371 @@
 package main
 
 import (
-	"crypto/rsa"
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"errors"
-	"fmt"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	glog "github.com/labstack/gommon/log"
-	"github.com/lestrrat-go/jwx/jwk"
-	natsjwt "github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
-	"github.com/nats-io/nkeys"
 )
 
-var natsAccountSigningKeySeed = os.Getenv("JWT_ACC_SIGNING_KEY")
-var keycloakJwkB64 = os.Getenv("KEYCLOAK_JWK_B64")
-var natsUrl = os.Getenv("NATS_URL")
-var natsUser = os.Getenv("NATS_USER")
-var natsPassword = os.Getenv("NATS_PASSWORD")
+// policyReloadInterval defines how often the policy file is checked for changes.
+const policyReloadInterval = 10 * time.Second
+
+// defaultConsentCacheTTL defines how long consents from the consent service are cached.
+const defaultConsentCacheTTL = 30 * time.Second
+
+// defaultFleetCacheTTL defines how long the vehicles from the fleet service are cached.
+const defaultFleetCacheTTL = 30 * time.Second
+
+// defaultNatsJwtMaxExpiry is the maximum lifetime of an issued NATS user JWT.
+const defaultNatsJwtMaxExpiry = time.Hour
+
+// errNoPermissions is returned when the policy grants no permissions for the roles of a token.
+var errNoPermissions = errors.New("no permissions granted")
 
 func main() {
-	// Configure log level from environment variable
-	logLevel := os.Getenv("LOG_LEVEL")
-	if logLevel == "" {
-		logLevel = "INFO" // Default to INFO if not set
-	}
-
-	switch logLevel {
-	case "DEBUG":
-		glog.SetLevel(glog.DEBUG)
-	case "INFO":
-		glog.SetLevel(glog.INFO)
-	case "WARN":
-		glog.SetLevel(glog.WARN)
-	case "ERROR":
-		glog.SetLevel(glog.ERROR)
-	default:
-		glog.SetLevel(glog.INFO)
-		glog.Warnf("Unknown LOG_LEVEL '%s', defaulting to INFO", logLevel)
+	// The revoke command edits the revocation store instead of running the service
+	if len(os.Args) > 1 && os.Args[1] == "revoke" {
+		os.Exit(runRevokeCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	// The explain command shows what the callout would do with a token
+	if len(os.Args) > 1 && os.Args[1] == "explain" {
+		os.Exit(runExplainCommand(os.Args[2:], os.Getenv, os.Stdin, os.Stdout, os.Stderr))
 	}
 
-	glog.Infof("Starting NATS auth callout service with log level: %s", logLevel)
-
-	// Log connection details at DEBUG level
-	if logLevel == "DEBUG" {
-		maskedPassword := "****"
-		if natsPassword != "" {
-			// Show first 3 characters of password if available
-			visibleChars := 3
-			if len(natsPassword) < visibleChars {
-				visibleChars = len(natsPassword)
-			}
-			if visibleChars > 0 {
-				maskedPassword = natsPassword[:visibleChars] + "****"
-			}
+	// Load and validate the whole configuration before anything is started
+	cfg, err := loadConfig(os.Getenv)
+	if err != nil {
+		glog.Fatalf("Invalid configuration: %v", err)
+	}
+	glog.SetLevel(logLevels[cfg.logLevel])
+	glog.Infof("Starting NATS auth callout service with log level: %s", cfg.logLevel)
+
+	// SIGTERM, e.g. from Kubernetes stopping the pod, drains the auth requests
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Serve metrics and health endpoints while starting up, readiness follows once
+	// keys are loaded and the auth requests are subscribed
+	ready := &readiness{}
+	go serveHTTP(cfg.httpAddr, ready)
+
+	// Connect to NATS cluster. The connection is only closed for good on shutdown,
+	// otherwise the service can't answer auth requests anymore and exits.
+	var shuttingDown atomic.Bool
+	closed := make(chan struct{})
+	glog.Infof("Connecting to NATS at %s", cfg.nats)
+	nc, err := connectNATS(cfg.nats, "auth-callout", func(nc *nats.Conn) {
+		if !shuttingDown.Load() {
+			glog.Fatalf("NATS connection closed: %v", nc.LastError())
 		}
-		glog.Debugf("NATS connection details:")
-		glog.Debugf("  URL: %s", natsUrl)
-		glog.Debugf("  User: %s", natsUser)
-		glog.Debugf("  Password: %s", maskedPassword)
+		close(closed)
+	})
+	if err != nil {
+		glog.Fatalf("Error connecting to NATS: %v", err)
 	}
+	glog.Info("Connected to NATS server")
 
-	// Connect to NATS cluster
-	var opts []nats.Option
-	if natsUser != "" && natsPassword != "" {
-		opts = append(opts, nats.UserInfo(natsUser, natsPassword))
-		glog.Debug("Using username/password authentication")
+	// Load the keys that sign the user JWTs of accounts, if they have their own
+	accountKeys, err := loadAccountKeys(cfg.accountSigningKeysFile, cfg.accountKeyPair)
+	if err != nil {
+		glog.Fatalf("Failed to load account signing keys: %v", err)
+	}
+
+	// The curve key decrypts auth requests, if the server encrypts them
+	if cfg.xkey != nil {
+		xkeyPublic, err := cfg.xkey.PublicKey()
+		if err != nil {
+			glog.Fatalf("Failed to load XKEY_SEED: %v", err)
+		}
+		glog.Infof("Auth requests must be encrypted to xkey %s", xkeyPublic)
 	} else {
-		glog.Debug("Connecting without authentication")
+		glog.Warn("XKEY_SEED is not set, auth requests are not encrypted")
 	}
 
-	nc, err := nats.Connect(natsUrl, opts...)
+	// Load the Keycloak keys used to validate incoming tokens
+	keys, err := loadKeySet(cfg)
 	if err != nil {
-		glog.Fatalf("Error connecting to NATS: %v", err)
+		glog.Fatalf("Failed to load Keycloak keys: %v", err)
 	}
-	defer nc.Close()
-	glog.Info("Connected to NATS server")
 
-	// Load the NATS account signing key from its seed
-	accountKeyPair, err := nkeys.FromSeed([]byte(natsAccountSigningKeySeed))
+	// Load the role to permission policy and reload it when the file changes
+	policies, err := newPolicyStore(cfg.policyFile)
 	if err != nil {
-		glog.Fatalf("Failed to load account signing key: %v", err)
+		glog.Fatalf("Failed to load policy: %v", err)
 	}
+	go policies.watch(context.Background(), policyReloadInterval)
 
-	// base64 decode the JWK
-	keycloakJwk, err := base64.StdEncoding.DecodeString(keycloakJwkB64)
+	// Load the fleet memberships that fleet roles expand to vehicle subjects
+	fleets, err := loadFleetStore(cfg)
 	if err != nil {
-		glog.Fatalf("error: %v", err)
+		glog.Fatalf("Failed to load fleets: %v", err)
 	}
 
-	// Create JWK keyset
-	keyset, err := jwk.Parse(keycloakJwk)
+	// Load the consents that limit which vehicles a telemetry collector may access
+	consents, err := loadConsentStore(cfg)
 	if err != nil {
-		errMessage := fmt.Sprintf("failed to parse JWK: %v", err)
-		glog.Fatal(errMessage)
+		glog.Fatalf("Failed to load consents: %v", err)
 	}
 
-	// Subscribe to auth requests
-	_, err = nc.Subscribe("$SYS.REQ.USER.AUTH", func(msg *nats.Msg) {
-		natsTempTokenString := string(msg.Data)
+	// Build the validator for the Keycloak tokens
+	validator := loadTokenValidator(cfg, keys)
+	glog.Infof("Validating tokens with %s", validator)
 
-		authRequestClaims, err := natsjwt.DecodeAuthorizationRequestClaims(natsTempTokenString)
+	// Every decision is written to the audit log
+	audit, err := newAuditSink(cfg.auditSink, cfg.auditFile, cfg.auditSubject, nc)
+	if err != nil {
+		glog.Fatalf("Invalid audit settings: %v", err)
+	}
+
+	// Revoked clients are disconnected if the callout can use the system account
+	var connections *connectionTracker
+	if cfg.systemNats.configured() {
+		sys, err := connectNATS(cfg.systemNats, "auth-callout-system", func(nc *nats.Conn) {
+			if !shuttingDown.Load() {
+				glog.Errorf("NATS system connection closed, revoked clients are no longer disconnected: %v", nc.LastError())
+			}
+		})
 		if err != nil {
-			glog.Errorf("Error when decoding nats temp token: %v", err)
-			respondWithError(msg, "Error when decoding nats temp token")
-			return
+			glog.Fatalf("Error connecting to NATS as system user: %v", err)
 		}
+		defer sys.Close()
+		connections = newConnectionTracker(natsKicker(sys))
+		glog.Info("Revoked clients are disconnected")
+	}
 
-		// 1. Validate the incoming external JWT
-		token, err := jwt.Parse(authRequestClaims.ConnectOptions.Token, func(token *jwt.Token) (any, error) {
-			glog.Info("Trying to parse token")
+	// Load the revoked tokens, vehicles and clients, checked on every request
+	revocations, err := loadRevocationStore(cfg, nc, connections)
+	if err != nil {
+		glog.Fatalf("Failed to load revocations: %v", err)
+	}
 
-			keyID, ok := token.Header["kid"].(string)
-			if !ok {
-				errMessage := "expecting JWT header to have string kid"
-				glog.Errorf(errMessage)
-				return nil, errors.New(errMessage)
-			}
+	callout := &authCallout{
+		validator:       validator,
+		policies:        policies,
+		consents:        consents,
+		revocations:     revocations,
+		connections:     connections,
+		rolesClaimPath:  cfg.rolesClaimPath,
+		fleets:          fleets,
+		fleetsClaimPath: cfg.fleetsClaimPath,
+		accountKeyPair:  cfg.accountKeyPair,
+		accountKeys:     accountKeys,
+		auditSink:       audit,
+		xkey:            cfg.xkey,
+		maxExpiry:       cfg.maxExpiry,
+	}
 
-			key, ok := keyset.LookupKeyID(keyID)
-			if ok {
-				var rawKey any
-				if err := key.Raw(&rawKey); err != nil {
-					errMessage := fmt.Sprintf("failed to create public key: %s", err)
-					glog.Errorf(errMessage)
-					return []byte(""), errors.New(errMessage)
-				}
-				rsaPublicKey, ok := rawKey.(*rsa.PublicKey)
-				if !ok {
-					errMessage := fmt.Sprintf("expected rsa key, got: %v", rawKey)
-					glog.Errorf(errMessage)
-					return nil, errors.New(errMessage)
-				}
-				glog.Info("Found public key")
-				return rsaPublicKey, nil
-			} else {
-				errMessage := fmt.Sprintf("unable to find key with kid: %q", keyID)
-				glog.Errorf(errMessage)
-				return nil, errors.New(errMessage)
-			}
-		})
+	// Handle the auth requests in a bounded worker pool, shared with the other replicas
+	// through a queue group
+	glog.Infof("Handling auth requests with %d workers, %d queued at most, within %s", cfg.workers, cfg.queueSize, cfg.requestTimeout)
+	pool := newWorkerPool(cfg.workers, cfg.queueSize, cfg.requestTimeout, callout.handleRequest, callout.shed)
+	sub, err := nc.QueueSubscribe("$SYS.REQ.USER.AUTH", cfg.queueGroup, pool.submit)
+	if err != nil {
+		glog.Fatalf("Error subscribing: %v", err)
+	}
+	// The pool sheds requests itself, the subscription must never drop them silently
+	if err := sub.SetPendingLimits(-1, -1); err != nil {
+		glog.Fatalf("Error subscribing: %v", err)
+	}
 
-		if err != nil || !token.Valid {
-			glog.Errorf("Error when validating token: %v", err)
-			respondWithError(msg, "invalid token")
-			return
+	ready.add("nats", func() error {
+		if !nc.IsConnected() {
+			return errors.New("not connected")
 		}
-
-		glog.Info("Validation successful!")
-
-		// 2. Extract claims from the valid token
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			glog.Error("Could not extract claims")
-			respondWithError(msg, "invalid token claims")
-			return
+		if !sub.IsValid() {
+			return errors.New("auth request subscription is not active")
+		}
+		return nil
+	})
+	ready.add("keys", func() error {
+		if !keys.loaded() {
+			return errors.New("no Keycloak keys loaded")
 		}
+		return nil
+	})
+	ready.add("shutdown", func() error {
+		if shuttingDown.Load() {
+			return errors.New("shutting down")
+		}
+		return nil
+	})
 
-		glog.Infof("Claims: %v", claims)
+	glog.Info("JWT auth callout service is running...")
+	<-ctx.Done()
 
-		userRoles := claims["realm_access"].(map[string]any)["roles"].([]any)
-		userName := claims["azp"].(string)
+	glog.Info("Shutting down, draining auth requests")
+	shuttingDown.Store(true)
+	drain(nc, sub, pool, closed, cfg.shutdownTimeout)
+	glog.Info("JWT auth callout service stopped")
+}
 
-		// 3. Create a new NATS User JWT based on the claims
-		userJWT, err := createNATSUserJWT(userName, userRoles, accountKeyPair, authRequestClaims)
-		if err != nil {
-			glog.Errorf("Failed to create NATS user JWT: %v", err)
-			respondWithError(msg, "internal server error")
-			return
+// connectNATS connects to NATS and logs when the connection is lost and restored. The
+// client reconnects without limit, meanwhile the readiness check fails. closed is
+// called once the connection is closed for good.
+func connectNATS(cfg natsConfig, name string, closed func(*nats.Conn)) (*nats.Conn, error) {
+	opts := append(cfg.options(),
+		nats.Name(name),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				glog.Warnf("NATS connection %s lost: %v", name, err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			glog.Infof("NATS connection %s restored to %s", name, nc.ConnectedUrlRedacted())
+		}),
+		nats.ClosedHandler(closed),
+	)
+	return nats.Connect(cfg.url, opts...)
+}
+
+// drain stops taking auth requests and answers the ones already received before the
+// connection is closed. Requests that arrive meanwhile go to the other replicas in the
+// queue group.
+func drain(nc *nats.Conn, sub *nats.Subscription, pool *workerPool, closed <-chan struct{}, timeout time.Duration) {
+	deadline := time.After(timeout)
+	drained := sub.StatusChanged(nats.SubscriptionClosed)
+	if err := sub.Drain(); err != nil {
+		glog.Errorf("Failed to drain the auth request subscription: %v", err)
+	} else {
+		select {
+		case <-drained:
+		case <-deadline:
+			glog.Warnf("Auth request subscription not drained within %s", timeout)
 		}
+	}
 
-		// 4. Send the successful response with the new NATS User JWT
-		innerRespJwt := natsjwt.AuthorizationResponse{Jwt: userJWT, IssuerAccount: authRequestClaims.Subject}
+	// The workers answer the queued requests, each within its request timeout
+	pool.stop()
 
-		respJwt := natsjwt.NewAuthorizationResponseClaims(authRequestClaims.UserNkey)
+	// Flush the responses and audit events before the connection is closed
+	if err := nc.Drain(); err != nil {
+		glog.Errorf("Failed to drain the NATS connection: %v", err)
+		nc.Close()
+		return
+	}
+	select {
+	case <-closed:
+	case <-deadline:
+		glog.Warnf("NATS connection not drained within %s", timeout)
+		nc.Close()
+	}
+}
+
+// loadKeySet creates the key set used for token validation. Keys are fetched from
+// KEYCLOAK_JWKS_URL if set; KEYCLOAK_JWK_B64 is used as the initial key set, or as the
+// only key set if no URL is configured.
+func loadKeySet(cfg *config) (*keySet, error) {
+	if cfg.jwksURL == "" {
+		glog.Warn("KEYCLOAK_JWKS_URL is not set, using static keys from KEYCLOAK_JWK_B64")
+		return newStaticKeySet(cfg.initialKeys), nil
+	}
 
-		// set inner JWT with permissions
-		respJwt.AuthorizationResponse = innerRespJwt
+	client, err := newJwksHTTPClient(cfg.jwksCAFile)
+	if err != nil {
+		return nil, err
+	}
 
-		respJwt.Audience = authRequestClaims.Server.ID
-		respJwt.Issuer = authRequestClaims.Subject
+	keys := newKeySet(cfg.jwksURL, client, cfg.initialKeys)
+	if err := keys.refresh(context.Background()); err != nil {
+		// Keycloak may not be reachable yet, keep retrying in the background.
+		glog.Errorf("Initial JWKS fetch failed: %v", err)
+	} else {
+		glog.Infof("Loaded JWKS from %s", redactURL(cfg.jwksURL))
+	}
+	go keys.run(context.Background(), cfg.jwksRefreshInterval)
 
-		respJwtResult, _ := respJwt.Encode(accountKeyPair)
+	return keys, nil
+}
 
-		err = msg.Respond([]byte(respJwtResult))
+// loadConsentStore creates the consent store from CONSENT_FILE or CONSENT_URL. Without
+// either, roles that require consent grant no subjects.
+func loadConsentStore(cfg *config) (ConsentStore, error) {
+	switch {
+	case cfg.consentFile != "":
+		store, err := newFileConsentStore(cfg.consentFile)
 		if err != nil {
-			glog.Errorf("Failed to send NATS response: %v", err)
-			respondWithError(msg, "internal server error")
-			return
+			return nil, err
 		}
-
-		glog.Infof("Successfully issued NATS JWT for user '%s' with roles '%v'", userName, userRoles)
-	})
-
-	if err != nil {
-		glog.Fatalf("Error subscribing: %v", err)
+		go store.watch(context.Background(), policyReloadInterval)
+		return store, nil
+	case cfg.consentURL != "":
+		glog.Infof("Using consent service at %s", redactURL(cfg.consentURL))
+		return newHTTPConsentStore(cfg.consentURL, nil, cfg.consentCacheTTL), nil
+	default:
+		glog.Warn("Neither CONSENT_FILE nor CONSENT_URL is set, consent based roles grant no subjects")
+		return nil, nil
 	}
-
-	glog.Info("JWT auth callout service is running...")
-	select {}
 }
 
-// createNATSUserJWT generates and signs a NATS user JWT.
-func createNATSUserJWT(name string, roles []any, accountKeyPair nkeys.KeyPair, authReqClaims *natsjwt.AuthorizationRequestClaims) (string, error) {
-	vin := name
-
-	// Define permissions based on the roles from the external JWT
-	var perms natsjwt.Permissions
-
-	// roles are extracted from the Keycloak JWT
-	for _, role := range roles {
-		role = role.(string)
-		// there can be special handling for specific role names
-		switch role {
-		case "edge-device":
-			// this allows the subscription of a commands subject for this specific VIN/deviceID
-			permission := fmt.Sprintf("commands.%s.>", vin)
-			perms.Sub.Allow.Add(permission)
-			glog.Debugf("Allowing the subscription of %s", permission)
-		case "telemetry-client":
-			permission := fmt.Sprintf("telemetry.%s.>", vin)
-			perms.Pub.Allow.Add(permission)
-			glog.Debugf("Allowing the publish of %s", permission)
-		case "telemetry-collector":
-			// TODO: check if the service has consent for the given VIN
-			permission := fmt.Sprintf("telemetry.%s.>", vin)
-			perms.Sub.Allow.Add(permission)
-			glog.Debugf("Allowing the subscription of %s", permission)
-		default:
-			continue
+// loadFleetStore creates the fleet store from FLEET_FILE or FLEET_URL. Without either,
+// fleet roles only get their per fleet subjects.
+func loadFleetStore(cfg *config) (FleetStore, error) {
+	switch {
+	case cfg.fleetFile != "":
+		store, err := newFileFleetStore(cfg.fleetFile)
+		if err != nil {
+			return nil, err
 		}
+		go store.watch(context.Background(), policyReloadInterval)
+		return store, nil
+	case cfg.fleetURL != "":
+		glog.Infof("Using fleet service at %s", redactURL(cfg.fleetURL))
+		return newHTTPFleetStore(cfg.fleetURL, nil, cfg.fleetCacheTTL), nil
+	default:
+		return nil, nil
 	}
+}
 
-	// Create the NATS user claims
-	userClaims := natsjwt.NewUserClaims(authReqClaims.UserNkey)
-	userClaims.Permissions = perms
-	userClaims.Expires = time.Now().Add(1 * time.Hour).Unix()
-	userClaims.Name = authReqClaims.ConnectOptions.Name
-	userClaims.Audience = "$G"
+// loadRevocationStore creates the revocation store from REVOCATION_FILE or
+// REVOCATION_KV_BUCKET. New revocations disconnect the matching connections if a
+// tracker is given.
+func loadRevocationStore(cfg *config, nc *nats.Conn, connections *connectionTracker) (RevocationStore, error) {
+	var onRevoke func(Revocation)
+	if connections != nil {
+		onRevoke = func(r Revocation) { connections.disconnect(r) }
+	}
 
-	// Sign the claims with the account signing key to get the final JWT
-	return userClaims.Encode(accountKeyPair)
+	switch {
+	case cfg.revocationFile != "":
+		store, err := newFileRevocationStore(cfg.revocationFile, onRevoke)
+		if err != nil {
+			return nil, err
+		}
+		go store.watch(context.Background(), policyReloadInterval)
+		return store, nil
+	case cfg.revocationKVBucket != "":
+		kv, err := openRevocationBucket(nc, cfg.revocationKVBucket)
+		if err != nil {
+			return nil, err
+		}
+		return newKVRevocationStore(kv, onRevoke)
+	default:
+		glog.Warn("Neither REVOCATION_FILE nor REVOCATION_KV_BUCKET is set, tokens can't be revoked")
+		return nil, nil
+	}
 }
 
-// respondWithError is a helper to send a denial response.
-func respondWithError(msg *nats.Msg, errMsg string) {
-	resp := natsjwt.AuthorizationResponse{Error: errMsg}
-	respJSON, _ := json.Marshal(resp)
-	msg.Respond(respJSON)
+// loadTokenValidator creates the token validator from the TOKEN_* settings.
+func loadTokenValidator(cfg *config, keys *keySet) *tokenValidator {
+	if len(cfg.tokenIssuers) == 0 {
+		glog.Warn("TOKEN_ISSUER is not set, the issuer of tokens is not checked")
+	}
+	if len(cfg.tokenAudiences) == 0 {
+		glog.Warn("TOKEN_AUDIENCE is not set, the audience of tokens is not checked")
+	}
+	return &tokenValidator{
+		keys:      keys,
+		issuers:   cfg.tokenIssuers,
+		audiences: cfg.tokenAudiences,
+		types:     cfg.tokenTypes,
+		maxAge:    cfg.tokenMaxAge,
+		leeway:    cfg.tokenLeeway,
+	}
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of an auth request, used as metric label.
+const (
+	outcomeGranted  = "granted"
+	outcomeRejected = "rejected"
+	outcomeError    = "error"
+)
+
+var (
+	authRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_callout_requests_total",
+		Help: "Auth callout requests by outcome and rejection reason.",
+	}, []string{"outcome", "reason"})
+
+	authRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "auth_callout_request_duration_seconds",
+		Help:    "Time to answer an auth callout request by outcome.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"outcome"})
+
+	pendingRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "auth_callout_pending_requests",
+		Help: "Auth requests waiting for a worker.",
+	})
+
+	jwksRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_callout_jwks_refreshes_total",
+		Help: "JWKS fetches by result (success or failure).",
+	}, []string{"result"})
+
+	jwksLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "auth_callout_jwks_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful JWKS fetch.",
+	})
+
+	jwksKeys = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "auth_callout_jwks_keys",
+		Help: "Number of keys in the cached JWKS.",
+	})
+
+	grantedRoles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_callout_granted_roles_total",
+		Help: "Issued NATS user JWTs by granted role.",
+	}, []string{"role"})
+
+	grantedSubjects = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "auth_callout_granted_subjects",
+		Help:    "Number of allowed subjects in the issued NATS user JWTs by direction (pub or sub).",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"direction"})
+)
+
+// observeAuthRequest records the outcome and duration of an auth request. The reason
+// is empty for granted requests.
+func observeAuthRequest(outcome, reason string, start time.Time) {
+	authRequests.WithLabelValues(outcome, reason).Inc()
+	authRequestDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
+
+// observeGrant records the roles and the number of subjects of an issued user JWT.
+func observeGrant(g *grant) {
+	for _, role := range g.Roles {
+		grantedRoles.WithLabelValues(role).Inc()
+	}
+	grantedSubjects.WithLabelValues("pub").Observe(float64(len(g.Permissions.Pub.Allow)))
+	grantedSubjects.WithLabelValues("sub").Observe(float64(len(g.Permissions.Sub.Allow)))
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	glog "github.com/labstack/gommon/log"
+	natsjwt "github.com/nats-io/jwt/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultPolicy is used when no AUTH_POLICY_FILE is configured.
+//
+//go:embed policy.yaml
+var defaultPolicy []byte
+
+// Policy maps Keycloak roles to the permissions and limits of the issued NATS user JWT.
+// Subjects are Go templates that are rendered with the subjectVars of the request.
+type Policy struct {
+	Roles map[string]*RolePolicy `yaml:"roles"`
+	// IgnoredRoles are Keycloak roles without NATS permissions, e.g. "offline_access".
+	// They are skipped silently instead of being logged as unknown.
+	IgnoredRoles []string `yaml:"ignoredRoles"`
+	// Accounts places users in NATS accounts. Without it, all users are placed in "$G".
+	Accounts *AccountsPolicy `yaml:"accounts"`
+}
+
+// RolePolicy holds the permissions and limits granted by a single role.
+type RolePolicy struct {
+	Pub    SubjectPolicy   `yaml:"pub"`
+	Sub    SubjectPolicy   `yaml:"sub"`
+	Resp   *ResponsePolicy `yaml:"resp"`
+	Limits *LimitsPolicy   `yaml:"limits"`
+	// Consent grants subscriptions for the vehicles and data families the client
+	// has active consent for, instead of the VIN of the token.
+	Consent *ConsentPolicy `yaml:"consent"`
+	// Fleet grants subjects for the fleets of the token and their vehicles.
+	Fleet *FleetPolicy `yaml:"fleet"`
+	// JetStream grants the API subjects to consume from named durable consumers.
+	JetStream *JetStreamPolicy `yaml:"jetstream"`
+	// MaxExpiry shortens the lifetime of the NATS user JWT for this role below the
+	// global maximum, e.g. "15m". Zero means the global maximum applies.
+	MaxExpiry time.Duration `yaml:"maxExpiry"`
+
+	pubAllow, pubDeny, subAllow, subDeny, consentSub []*template.Template
+	fleet                                            *compiledFleetPolicy
+}
+
+// ConsentPolicy lists the subject templates that are rendered once per consented
+// vehicle and data family, e.g. "telemetry.{{.VIN}}.{{.Family}}.>".
+type ConsentPolicy struct {
+	Sub []string `yaml:"sub"`
+}
+
+// SubjectPolicy lists the allowed and denied subject templates for publish or subscribe.
+type SubjectPolicy struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// ResponsePolicy allows publishing to the reply subjects of received requests.
+type ResponsePolicy struct {
+	MaxMsgs int           `yaml:"maxMsgs"`
+	Expires time.Duration `yaml:"expires"`
+}
+
+// LimitsPolicy restricts the connection of the user. Unset values mean no limit.
+type LimitsPolicy struct {
+	Subs    *int64 `yaml:"subs"`
+	Data    *int64 `yaml:"data"`
+	Payload *int64 `yaml:"payload"`
+	// ConnectionTypes are the allowed user JWT connection types, e.g. [STANDARD, WEBSOCKET].
+	ConnectionTypes []string `yaml:"connectionTypes"`
+	// SourceCIDRs are the networks the client may connect from, e.g. ["10.0.0.0/8"].
+	SourceCIDRs []string `yaml:"sourceCidrs"`
+}
+
+// connectionTypes are the connection types of user JWTs.
+var connectionTypes = []string{
+	natsjwt.ConnectionTypeStandard, natsjwt.ConnectionTypeWebsocket,
+	natsjwt.ConnectionTypeLeafnode, natsjwt.ConnectionTypeLeafnodeWS,
+	natsjwt.ConnectionTypeMqtt, natsjwt.ConnectionTypeMqttWS,
+	natsjwt.ConnectionTypeInProcess,
+}
+
+// subjectVars are the values available in subject templates, e.g. "commands.{{.VIN}}.>".
+type subjectVars struct {
+	VIN      string
+	ClientID string
+	// Family is only set for consent subjects. It is "*" for a consent to all families.
+	Family string
+	// Fleet is only set for fleet subjects.
+	Fleet string
+}
+
+// parsePolicy decodes and validates a YAML (or JSON) policy document.
+func parsePolicy(data []byte) (*Policy, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	var policy Policy
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("failed to decode policy: %w", err)
+	}
+	if err := policy.compile(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// compile parses all subject templates and checks that they render to valid subjects.
+func (p *Policy) compile() error {
+	if len(p.Roles) == 0 {
+		return errors.New("policy defines no roles")
+	}
+
+	sample := subjectVars{VIN: "VIN", ClientID: "client"}
+	consentSample := subjectVars{VIN: "VIN", ClientID: "client", Family: "family"}
+	var errs []error
+	for name, role := range p.Roles {
+		if role == nil {
+			errs = append(errs, fmt.Errorf("role %q: empty definition", name))
+			continue
+		}
+
+		var err error
+		if role.pubAllow, err = compileSubjects(role.Pub.Allow, sample); err != nil {
+			errs = append(errs, fmt.Errorf("role %q: pub.allow: %w", name, err))
+		}
+		if role.pubDeny, err = compileSubjects(role.Pub.Deny, sample); err != nil {
+			errs = append(errs, fmt.Errorf("role %q: pub.deny: %w", name, err))
+		}
+		if role.subAllow, err = compileSubjects(role.Sub.Allow, sample); err != nil {
+			errs = append(errs, fmt.Errorf("role %q: sub.allow: %w", name, err))
+		}
+		if role.subDeny, err = compileSubjects(role.Sub.Deny, sample); err != nil {
+			errs = append(errs, fmt.Errorf("role %q: sub.deny: %w", name, err))
+		}
+		if role.JetStream != nil {
+			if err := role.compileJetStream(sample); err != nil {
+				errs = append(errs, fmt.Errorf("role %q: jetstream: %w", name, err))
+			}
+		}
+		if role.Consent != nil {
+			if len(role.Consent.Sub) == 0 {
+				errs = append(errs, fmt.Errorf("role %q: consent.sub: no subjects", name))
+			} else if role.consentSub, err = compileSubjects(role.Consent.Sub, consentSample); err != nil {
+				errs = append(errs, fmt.Errorf("role %q: consent.sub: %w", name, err))
+			}
+		}
+		if role.Fleet != nil {
+			if role.fleet, err = role.Fleet.compile(); err != nil {
+				errs = append(errs, fmt.Errorf("role %q: fleet: %w", name, err))
+			}
+		}
+		if role.Resp != nil && (role.Resp.MaxMsgs < 0 || role.Resp.Expires < 0) {
+			errs = append(errs, fmt.Errorf("role %q: resp: maxMsgs and expires must not be negative", name))
+		}
+		if role.MaxExpiry < 0 {
+			errs = append(errs, fmt.Errorf("role %q: maxExpiry must not be negative", name))
+		}
+		if err := role.Limits.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("role %q: limits: %w", name, err))
+		}
+	}
+	if p.Accounts != nil {
+		if err := p.Accounts.compile(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compileJetStream adds the JetStream API subjects of the role to its allow lists.
+func (r *RolePolicy) compileJetStream(sample subjectVars) error {
+	pub, sub, err := r.JetStream.subjects()
+	if err != nil {
+		return err
+	}
+	pubAllow, err := compileSubjects(pub, sample)
+	if err != nil {
+		return err
+	}
+	subAllow, err := compileSubjects(sub, sample)
+	if err != nil {
+		return err
+	}
+	r.pubAllow = append(r.pubAllow, pubAllow...)
+	r.subAllow = append(r.subAllow, subAllow...)
+	return nil
+}
+
+func compileSubjects(subjects []string, sample subjectVars) ([]*template.Template, error) {
+	var templates []*template.Template
+	for _, subject := range subjects {
+		tmpl, err := template.New(subject).Option("missingkey=error").Parse(subject)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %q: %w", subject, err)
+		}
+		rendered, err := renderSubject(tmpl, sample)
+		if err != nil {
+			return nil, err
+		}
+		if !isValidSubject(rendered) {
+			return nil, fmt.Errorf("template %q renders to invalid subject %q", subject, rendered)
+		}
+		templates = append(templates, tmpl)
+	}
+	return templates, nil
+}
+
+func renderSubject(tmpl *template.Template, vars subjectVars) (string, error) {
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", fmt.Errorf("failed to render subject %q: %w", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+// isValidSubject checks a rendered subject for empty tokens, whitespace and a
+// full wildcard that isn't the last token.
+func isValidSubject(subject string) bool {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return false
+	}
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		if token == "" {
+			return false
+		}
+		if token == ">" && i != len(tokens)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidToken checks that a value is a single literal subject token.
+func isValidToken(value string) bool {
+	return value != "" && !strings.ContainsAny(value, ".*> \t\r\n")
+}
+
+// grant holds the permissions and limits resolved from the roles of a token.
+type grant struct {
+	Permissions natsjwt.Permissions
+	Limits      natsjwt.NatsLimits
+	// ConnectionTypes and SourceCIDRs restrict the connection, nil means unrestricted.
+	ConnectionTypes []string
+	SourceCIDRs     []string
+	Roles           []string
+	// Expires is the earliest expiry of the consents the grant is based on, zero if none.
+	Expires time.Time
+	// MaxExpiry is the shortest maxExpiry of the roles, zero if none defines one.
+	MaxExpiry time.Duration
+}
+
+// resolve renders the permissions for the given roles. Roles that are not part of
+// the policy are logged and grant nothing. An error is returned if none of the roles
+// is known or nothing is allowed, because a user JWT without permissions would allow
+// everything. Consents and fleet vehicles are only looked up if one of the roles
+// requires them.
+func (p *Policy) resolve(ctx context.Context, roles []string, vars subjectVars, consents ConsentStore, fleets *fleetAccess) (*grant, error) {
+	g := &grant{}
+
+	// The values end up in subjects, so they must not contain separators or wildcards.
+	for _, value := range []string{vars.VIN, vars.ClientID} {
+		if !isValidToken(value) {
+			return nil, fmt.Errorf("%q can't be used as a subject token", value)
+		}
+	}
+
+	for _, roleName := range roles {
+		role, ok := p.Roles[roleName]
+		if !ok {
+			if !p.isIgnored(roleName) {
+				glog.Warnf("Rejecting role %q for %q: not defined in policy", roleName, vars.ClientID)
+			}
+			continue
+		}
+
+		if err := addSubjects(&g.Permissions.Pub.Allow, role.pubAllow, vars); err != nil {
+			return nil, err
+		}
+		if err := addSubjects(&g.Permissions.Pub.Deny, role.pubDeny, vars); err != nil {
+			return nil, err
+		}
+		if err := addSubjects(&g.Permissions.Sub.Allow, role.subAllow, vars); err != nil {
+			return nil, err
+		}
+		if err := addSubjects(&g.Permissions.Sub.Deny, role.subDeny, vars); err != nil {
+			return nil, err
+		}
+		if role.Consent != nil {
+			if err := g.addConsentSubjects(ctx, role.consentSub, vars, consents); err != nil {
+				return nil, err
+			}
+		}
+		if role.fleet != nil {
+			if err := g.addFleetSubjects(ctx, role.fleet, vars, fleets); err != nil {
+				return nil, err
+			}
+		}
+
+		if role.Resp != nil {
+			if g.Permissions.Resp == nil {
+				g.Permissions.Resp = &natsjwt.ResponsePermission{}
+			}
+			g.Permissions.Resp.MaxMsgs = max(g.Permissions.Resp.MaxMsgs, role.Resp.MaxMsgs)
+			g.Permissions.Resp.Expires = max(g.Permissions.Resp.Expires, role.Resp.Expires)
+		}
+
+		// Roles are additive, so the most permissive limits of all roles apply.
+		if len(g.Roles) == 0 {
+			g.Limits = role.Limits.natsLimits()
+			g.ConnectionTypes = role.Limits.connectionTypes()
+			g.SourceCIDRs = role.Limits.sourceCIDRs()
+		} else {
+			g.Limits = mergeLimits(g.Limits, role.Limits.natsLimits())
+			g.ConnectionTypes = mergeRestriction(g.ConnectionTypes, role.Limits.connectionTypes())
+			g.SourceCIDRs = mergeRestriction(g.SourceCIDRs, role.Limits.sourceCIDRs())
+		}
+
+		// A role with a shorter lifetime protects its permissions, so the shortest wins.
+		if role.MaxExpiry > 0 && (g.MaxExpiry == 0 || role.MaxExpiry < g.MaxExpiry) {
+			g.MaxExpiry = role.MaxExpiry
+		}
+
+		g.Roles = append(g.Roles, roleName)
+	}
+
+	if len(g.Roles) == 0 {
+		return nil, fmt.Errorf("none of the roles %v is defined in the policy", roles)
+	}
+	if len(g.Permissions.Pub.Allow) == 0 && len(g.Permissions.Sub.Allow) == 0 {
+		return nil, fmt.Errorf("roles %v allow no subjects", g.Roles)
+	}
+
+	denyUngranted(&g.Permissions)
+	return g, nil
+}
+
+// denyUngranted denies a direction completely if none of the roles allows anything in it,
+// e.g. publishing for an edge-device or a collector. An empty allow list in a user JWT
+// means everything is allowed, so it must never be issued.
+func denyUngranted(permissions *natsjwt.Permissions) {
+	if len(permissions.Pub.Allow) == 0 {
+		permissions.Pub.Deny.Add(">")
+	}
+	if len(permissions.Sub.Allow) == 0 {
+		permissions.Sub.Deny.Add(">")
+	}
+}
+
+// addConsentSubjects adds the subscriptions for all active consents of the client and
+// tracks the earliest consent expiry.
+func (g *grant) addConsentSubjects(ctx context.Context, templates []*template.Template, vars subjectVars, consents ConsentStore) error {
+	if consents == nil {
+		glog.Warnf("No consent store configured, %q gets no consent based subjects", vars.ClientID)
+		return nil
+	}
+
+	active, err := consents.ActiveConsents(ctx, vars.ClientID, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to look up consents: %w", err)
+	}
+	if len(active) == 0 {
+		glog.Infof("Client %q has no active consent", vars.ClientID)
+	}
+
+	for _, consent := range active {
+		for _, family := range consent.Families {
+			consentVars := subjectVars{VIN: consent.VIN, ClientID: vars.ClientID, Family: family}
+			if err := addSubjects(&g.Permissions.Sub.Allow, templates, consentVars); err != nil {
+				return err
+			}
+		}
+		if !consent.Expires.IsZero() && (g.Expires.IsZero() || consent.Expires.Before(g.Expires)) {
+			g.Expires = consent.Expires
+		}
+	}
+	return nil
+}
+
+func (p *Policy) isIgnored(role string) bool {
+	for _, ignored := range p.IgnoredRoles {
+		if ignored == role {
+			return true
+		}
+	}
+	return false
+}
+
+func addSubjects(list *natsjwt.StringList, templates []*template.Template, vars subjectVars) error {
+	for _, tmpl := range templates {
+		subject, err := renderSubject(tmpl, vars)
+		if err != nil {
+			return err
+		}
+		if !isValidSubject(subject) {
+			return fmt.Errorf("subject %q rendered from %q is invalid", subject, tmpl.Name())
+		}
+		list.Add(subject)
+		glog.Debugf("Adding subject %s", subject)
+	}
+	return nil
+}
+
+// validate checks the connection types and networks of the limits.
+func (l *LimitsPolicy) validate() error {
+	if l == nil {
+		return nil
+	}
+	var errs []error
+	for _, t := range l.ConnectionTypes {
+		if !slices.Contains(connectionTypes, t) {
+			errs = append(errs, fmt.Errorf("unknown connection type %q, expected one of %v", t, connectionTypes))
+		}
+	}
+	for _, cidr := range l.SourceCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid source CIDR %q", cidr))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *LimitsPolicy) connectionTypes() []string {
+	if l == nil || len(l.ConnectionTypes) == 0 {
+		return nil
+	}
+	return slices.Clone(l.ConnectionTypes)
+}
+
+func (l *LimitsPolicy) sourceCIDRs() []string {
+	if l == nil || len(l.SourceCIDRs) == 0 {
+		return nil
+	}
+	return slices.Clone(l.SourceCIDRs)
+}
+
+// mergeRestriction returns the union of two allow lists. nil allows everything, so
+// it wins like an unset limit.
+func mergeRestriction(a, b []string) []string {
+	if a == nil || b == nil {
+		return nil
+	}
+	for _, value := range b {
+		if !slices.Contains(a, value) {
+			a = append(a, value)
+		}
+	}
+	return a
+}
+
+// allowsConnection checks the client of an auth request against the connection types
+// and source networks of the grant before the user JWT is issued. The NATS server
+// enforces the connection types of the user JWT for auth callout users as well, but not
+// the source networks, so this is the only place they are enforced. Checking the
+// connection type here too rejects it with a reason instead of a plain authorization error.
+func (g *grant) allowsConnection(client natsjwt.ClientInformation) error {
+	if g.ConnectionTypes != nil {
+		types := clientConnectionTypes(client)
+		if !slices.ContainsFunc(types, func(t string) bool { return slices.Contains(g.ConnectionTypes, t) }) {
+			return fmt.Errorf("connection type %s is not in %v", strings.Join(types, "/"), g.ConnectionTypes)
+		}
+	}
+	if g.SourceCIDRs != nil {
+		addr, err := netip.ParseAddr(client.Host)
+		if err != nil {
+			return fmt.Errorf("client address %q can't be checked against %v", client.Host, g.SourceCIDRs)
+		}
+		addr = addr.Unmap()
+		if !slices.ContainsFunc(g.SourceCIDRs, func(cidr string) bool { return netip.MustParsePrefix(cidr).Contains(addr) }) {
+			return fmt.Errorf("client address %s is not in %v", addr, g.SourceCIDRs)
+		}
+	}
+	return nil
+}
+
+// clientConnectionTypes maps the client kind and type of an auth request to the
+// connection types of user JWTs. Leafnode and MQTT connections over websocket can't be
+// told apart from plain ones, so both types match.
+func clientConnectionTypes(client natsjwt.ClientInformation) []string {
+	switch {
+	case client.Kind == "Leafnode":
+		return []string{natsjwt.ConnectionTypeLeafnode, natsjwt.ConnectionTypeLeafnodeWS}
+	case client.Type == "nats":
+		return []string{natsjwt.ConnectionTypeStandard}
+	case client.Type == "websocket":
+		return []string{natsjwt.ConnectionTypeWebsocket}
+	case client.Type == "mqtt":
+		return []string{natsjwt.ConnectionTypeMqtt, natsjwt.ConnectionTypeMqttWS}
+	default:
+		return []string{"unknown"}
+	}
+}
+
+// natsLimits converts the role limits. Unset values and a missing limits section mean no limit.
+func (l *LimitsPolicy) natsLimits() natsjwt.NatsLimits {
+	limits := natsjwt.NatsLimits{Subs: natsjwt.NoLimit, Data: natsjwt.NoLimit, Payload: natsjwt.NoLimit}
+	if l == nil {
+		return limits
+	}
+	if l.Subs != nil {
+		limits.Subs = *l.Subs
+	}
+	if l.Data != nil {
+		limits.Data = *l.Data
+	}
+	if l.Payload != nil {
+		limits.Payload = *l.Payload
+	}
+	return limits
+}
+
+// mergeLimits returns the more permissive value of each limit.
+func mergeLimits(a, b natsjwt.NatsLimits) natsjwt.NatsLimits {
+	return natsjwt.NatsLimits{
+		Subs:    mergeLimit(a.Subs, b.Subs),
+		Data:    mergeLimit(a.Data, b.Data),
+		Payload: mergeLimit(a.Payload, b.Payload),
+	}
+}
+
+func mergeLimit(a, b int64) int64 {
+	if a < 0 || b < 0 {
+		return natsjwt.NoLimit
+	}
+	return max(a, b)
+}
+
+// policyStore holds the active policy and reloads it when the policy file changes.
+type policyStore struct {
+	file   *watchedFile
+	policy atomic.Pointer[Policy]
+}
+
+// newPolicyStore loads the policy from path, or the built-in default policy if path is empty.
+func newPolicyStore(path string) (*policyStore, error) {
+	s := &policyStore{}
+	data := defaultPolicy
+	if path != "" {
+		s.file = &watchedFile{path: path}
+		var err error
+		data, _, err = s.file.readIfChanged()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	policy, err := parsePolicy(data)
+	if err != nil {
+		return nil, err
+	}
+	s.policy.Store(policy)
+	if s.file != nil {
+		s.file.commit(data)
+	}
+	glog.Infof("Loaded policy with roles %v", policy.roleNames())
+	return s, nil
+}
+
+func (s *policyStore) current() *Policy {
+	return s.policy.Load()
+}
+
+// reload re-reads the policy file and activates it if it changed and is valid.
+// An invalid file is rejected and the previous policy stays active.
+func (s *policyStore) reload() (bool, error) {
+	data, changed, err := s.file.readIfChanged()
+	if err != nil || !changed {
+		return false, err
+	}
+
+	policy, err := parsePolicy(data)
+	if err != nil {
+		return false, err
+	}
+	s.policy.Store(policy)
+	s.file.commit(data)
+	glog.Infof("Activated policy with roles %v", policy.roleNames())
+	return true, nil
+}
+
+// watch reloads the policy file every interval until the context is cancelled.
+func (s *policyStore) watch(ctx context.Context, interval time.Duration) {
+	if s.file == nil {
+		return
+	}
+	watchFile(ctx, "policy", interval, s.reload)
+}
+
+func (p *Policy) roleNames() []string {
+	names := make([]string, 0, len(p.Roles))
+	for name := range p.Roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
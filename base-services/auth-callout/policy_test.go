@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	natsjwt "github.com/nats-io/jwt/v2"
+)
+
+const testPolicy = `
+roles:
+  edge-device:
+    sub:
+      allow: ["commands.{{.VIN}}.>"]
+    pub:
+      allow: ["telemetry.{{.VIN}}.>"]
+      deny: ["telemetry.{{.VIN}}.internal"]
+    resp:
+      maxMsgs: 1
+      expires: 5s
+    limits:
+      subs: 10
+      payload: 1024
+  telemetry-collector:
+    sub:
+      allow: ["telemetry.{{.VIN}}.>"]
+    limits:
+      subs: 100
+      payload: 512
+      data: 4096
+ignoredRoles:
+  - offline_access
+`
+
+func TestParsePolicyValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr string
+	}{
+		{name: "valid", policy: testPolicy},
+		{name: "no roles", policy: "roles: {}", wantErr: "no roles"},
+		{name: "unknown field", policy: "roles:\n  r:\n    publish: {}", wantErr: "field publish not found"},
+		{name: "invalid template", policy: "roles:\n  r:\n    pub:\n      allow: [\"a.{{.VIN\"]", wantErr: "invalid template"},
+		{name: "unknown template value", policy: "roles:\n  r:\n    pub:\n      allow: [\"a.{{.Brand}}\"]", wantErr: "failed to render subject"},
+		{name: "empty token", policy: "roles:\n  r:\n    sub:\n      allow: [\"a..b\"]", wantErr: "invalid subject"},
+		{name: "wildcard not last", policy: "roles:\n  r:\n    sub:\n      deny: [\"a.>.b\"]", wantErr: "invalid subject"},
+		{name: "negative response", policy: "roles:\n  r:\n    resp:\n      maxMsgs: -1", wantErr: "must not be negative"},
+		{name: "unknown connection type", policy: "roles:\n  r:\n    limits:\n      connectionTypes: [standard]", wantErr: "unknown connection type"},
+		{name: "invalid source CIDR", policy: "roles:\n  r:\n    limits:\n      sourceCidrs: [10.0.0.1]", wantErr: "invalid source CIDR"},
+		{name: "json", policy: `{"roles": {"r": {"pub": {"allow": ["a.{{.VIN}}"]}}}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePolicy([]byte(tt.policy))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDefaultPolicyIsValid(t *testing.T) {
+	policy, err := parsePolicy(defaultPolicy)
+	if err != nil {
+		t.Fatalf("default policy is invalid: %v", err)
+	}
+	want := []string{"edge-device", "fleet-collector", "telemetry-client", "telemetry-collector"}
+	if got := policy.roleNames(); !slices.Equal(got, want) {
+		t.Errorf("expected roles %v, got %v", want, got)
+	}
+}
+
+func TestPolicyResolve(t *testing.T) {
+	policy, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := policy.resolve(context.Background(), []string{"edge-device", "offline_access", "unknown"}, subjectVars{VIN: "VIN1", ClientID: "VIN1"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(g.Roles, []string{"edge-device"}) {
+		t.Errorf("expected only edge-device to be granted, got %v", g.Roles)
+	}
+	if !g.Permissions.Sub.Allow.Contains("commands.VIN1.>") {
+		t.Errorf("missing sub allow, got %v", g.Permissions.Sub.Allow)
+	}
+	if !g.Permissions.Pub.Allow.Contains("telemetry.VIN1.>") || !g.Permissions.Pub.Deny.Contains("telemetry.VIN1.internal") {
+		t.Errorf("unexpected pub permissions %+v", g.Permissions.Pub)
+	}
+	if g.Permissions.Resp == nil || g.Permissions.Resp.MaxMsgs != 1 || g.Permissions.Resp.Expires != 5*time.Second {
+		t.Errorf("unexpected response permission %+v", g.Permissions.Resp)
+	}
+	want := natsjwt.NatsLimits{Subs: 10, Data: natsjwt.NoLimit, Payload: 1024}
+	if g.Limits != want {
+		t.Errorf("expected limits %+v, got %+v", want, g.Limits)
+	}
+}
+
+func TestPolicyResolveDeniesUngrantedDirections(t *testing.T) {
+	policy, err := parsePolicy([]byte(`
+roles:
+  telemetry-client:
+    pub:
+      allow: ["telemetry.{{.VIN}}.>"]
+  telemetry-collector:
+    sub:
+      allow: ["telemetry.{{.VIN}}.>"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := subjectVars{VIN: "VIN1", ClientID: "VIN1"}
+
+	// A role that only subscribes must not be able to publish anything
+	g, err := policy.resolve(context.Background(), []string{"telemetry-collector"}, vars, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Permissions.Pub.Allow) != 0 || !slices.Equal([]string(g.Permissions.Pub.Deny), []string{">"}) {
+		t.Errorf("expected publishing to be denied, got %+v", g.Permissions.Pub)
+	}
+	if g.Permissions.Sub.Deny.Contains(">") {
+		t.Errorf("expected subscriptions to be allowed, got %+v", g.Permissions.Sub)
+	}
+
+	// And a role that only publishes must not be able to subscribe
+	g, err = policy.resolve(context.Background(), []string{"telemetry-client"}, vars, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Permissions.Sub.Allow) != 0 || !slices.Equal([]string(g.Permissions.Sub.Deny), []string{">"}) {
+		t.Errorf("expected subscriptions to be denied, got %+v", g.Permissions.Sub)
+	}
+
+	// Roles are additive, together they allow both directions
+	g, err = policy.resolve(context.Background(), []string{"telemetry-collector", "telemetry-client"}, vars, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Permissions.Pub.Deny.Contains(">") || g.Permissions.Sub.Deny.Contains(">") {
+		t.Errorf("expected no full deny, got %+v", g.Permissions)
+	}
+}
+
+func TestPolicyResolveMergesLimits(t *testing.T) {
+	policy, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := policy.resolve(context.Background(), []string{"edge-device", "telemetry-collector"}, subjectVars{VIN: "VIN1", ClientID: "VIN1"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := natsjwt.NatsLimits{Subs: 100, Data: natsjwt.NoLimit, Payload: 1024}
+	if g.Limits != want {
+		t.Errorf("expected limits %+v, got %+v", want, g.Limits)
+	}
+}
+
+func TestPolicyResolveMergesConnectionRestrictions(t *testing.T) {
+	policy, err := parsePolicy([]byte(`
+roles:
+  edge-device:
+    sub:
+      allow: ["commands.{{.VIN}}.>"]
+    limits:
+      connectionTypes: [STANDARD]
+      sourceCidrs: [10.0.0.0/8]
+  dashboard:
+    sub:
+      allow: ["status.{{.VIN}}"]
+    limits:
+      connectionTypes: [WEBSOCKET, STANDARD]
+  operator:
+    sub:
+      allow: ["status.>"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := subjectVars{VIN: "VIN1", ClientID: "VIN1"}
+
+	g, err := policy.resolve(context.Background(), []string{"edge-device", "dashboard"}, vars, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(g.ConnectionTypes, []string{"STANDARD", "WEBSOCKET"}) {
+		t.Errorf("expected the connection types of both roles, got %v", g.ConnectionTypes)
+	}
+	if g.SourceCIDRs != nil {
+		t.Errorf("expected no source restriction from a role without one, got %v", g.SourceCIDRs)
+	}
+
+	// An unrestricted role lifts the restrictions, like an unset limit.
+	g, err = policy.resolve(context.Background(), []string{"edge-device", "operator"}, vars, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.ConnectionTypes != nil || g.SourceCIDRs != nil {
+		t.Errorf("expected no connection restrictions, got %v and %v", g.ConnectionTypes, g.SourceCIDRs)
+	}
+}
+
+func TestGrantAllowsConnection(t *testing.T) {
+	g := &grant{ConnectionTypes: []string{"STANDARD", "WEBSOCKET"}, SourceCIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}}
+	tests := []struct {
+		name    string
+		client  natsjwt.ClientInformation
+		allowed bool
+	}{
+		{name: "standard", client: natsjwt.ClientInformation{Host: "10.1.2.3", Kind: "Client", Type: "nats"}, allowed: true},
+		{name: "websocket", client: natsjwt.ClientInformation{Host: "10.1.2.3", Kind: "Client", Type: "websocket"}, allowed: true},
+		{name: "ipv6", client: natsjwt.ClientInformation{Host: "2001:db8::1", Kind: "Client", Type: "nats"}, allowed: true},
+		{name: "ipv4 mapped", client: natsjwt.ClientInformation{Host: "::ffff:10.1.2.3", Kind: "Client", Type: "nats"}, allowed: true},
+		{name: "leafnode", client: natsjwt.ClientInformation{Host: "10.1.2.3", Kind: "Leafnode"}},
+		{name: "mqtt", client: natsjwt.ClientInformation{Host: "10.1.2.3", Kind: "Client", Type: "mqtt"}},
+		{name: "other network", client: natsjwt.ClientInformation{Host: "192.168.1.1", Kind: "Client", Type: "nats"}},
+		{name: "unknown address", client: natsjwt.ClientInformation{Kind: "Client", Type: "nats"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := g.allowsConnection(tt.client)
+			if tt.allowed && err != nil {
+				t.Errorf("expected the connection to be allowed, got %v", err)
+			}
+			if !tt.allowed && err == nil {
+				t.Error("expected the connection to be rejected")
+			}
+		})
+	}
+
+	if err := (&grant{}).allowsConnection(natsjwt.ClientInformation{Kind: "Leafnode"}); err != nil {
+		t.Errorf("expected an unrestricted grant to allow any connection, got %v", err)
+	}
+}
+
+func TestPolicyResolveRejects(t *testing.T) {
+	policy, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		roles []string
+		vars  subjectVars
+	}{
+		{name: "no known role", roles: []string{"offline_access", "unknown"}, vars: subjectVars{VIN: "VIN1", ClientID: "VIN1"}},
+		{name: "no roles", roles: nil, vars: subjectVars{VIN: "VIN1", ClientID: "VIN1"}},
+		{name: "wildcard vin", roles: []string{"edge-device"}, vars: subjectVars{VIN: "*", ClientID: "*"}},
+		{name: "multi token vin", roles: []string{"edge-device"}, vars: subjectVars{VIN: "a.b", ClientID: "a.b"}},
+		{name: "empty vin", roles: []string{"edge-device"}, vars: subjectVars{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := policy.resolve(context.Background(), tt.roles, tt.vars, nil, nil); err == nil {
+				t.Fatal("expected resolve to fail")
+			}
+		})
+	}
+}
+
+func TestPolicyStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(testPolicy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newPolicyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, err := store.reload(); err != nil || changed {
+		t.Fatalf("expected unchanged policy, got changed=%v err=%v", changed, err)
+	}
+
+	// An invalid update is rejected and the previous policy stays active.
+	if err := os.WriteFile(path, []byte("roles: {}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.reload(); err == nil {
+		t.Fatal("expected invalid policy to be rejected")
+	}
+	if _, ok := store.current().Roles["edge-device"]; !ok {
+		t.Fatal("expected previous policy to stay active")
+	}
+
+	updated := "roles:\n  fleet-operator:\n    sub:\n      allow: [\"telemetry.*.>\"]\n"
+	if err := os.WriteFile(path, []byte(updated), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := store.reload(); err != nil || !changed {
+		t.Fatalf("expected policy to be reloaded, got changed=%v err=%v", changed, err)
+	}
+	if got := store.current().roleNames(); !slices.Equal(got, []string{"fleet-operator"}) {
+		t.Errorf("unexpected roles after reload: %v", got)
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	glog "github.com/labstack/gommon/log"
+	"github.com/nats-io/nats.go"
+	"gopkg.in/yaml.v3"
+)
+
+const reasonRevoked = "revoked"
+
+// revocationValue restricts revoked values to characters that are valid in KV keys.
+var revocationValue = regexp.MustCompile(`^[-_=a-zA-Z0-9]+$`)
+
+// Revocation blocks issuing NATS credentials for a token (jti), a vehicle (vin) or a
+// Keycloak client (clientId), e.g. for a stolen vehicle or a compromised key.
+// Exactly one of them is set.
+type Revocation struct {
+	TokenID  string    `json:"jti,omitempty" yaml:"jti,omitempty"`
+	VIN      string    `json:"vin,omitempty" yaml:"vin,omitempty"`
+	ClientID string    `json:"clientId,omitempty" yaml:"clientId,omitempty"`
+	Reason   string    `json:"reason,omitempty" yaml:"reason,omitempty"`
+	Created  time.Time `json:"created,omitzero" yaml:"created,omitempty"`
+}
+
+// key returns the KV key of the revocation, e.g. "vin.WDD1234567890".
+func (r Revocation) key() (string, error) {
+	var kind, value string
+	count := 0
+	for _, field := range []struct{ kind, value string }{
+		{"jti", r.TokenID}, {"vin", r.VIN}, {"client", r.ClientID},
+	} {
+		if field.value != "" {
+			kind, value = field.kind, field.value
+			count++
+		}
+	}
+	if count != 1 {
+		return "", errors.New("revocation needs exactly one of jti, vin and clientId")
+	}
+	if !revocationValue.MatchString(value) {
+		return "", fmt.Errorf("invalid %s %q", kind, value)
+	}
+	return kind + "." + value, nil
+}
+
+func (r Revocation) String() string {
+	switch {
+	case r.TokenID != "":
+		return "token " + r.TokenID
+	case r.VIN != "":
+		return "vehicle " + r.VIN
+	default:
+		return "client " + r.ClientID
+	}
+}
+
+// matches reports whether the revocation applies to the token.
+func (r Revocation) matches(claims *tokenClaims) bool {
+	return (r.TokenID != "" && r.TokenID == claims.TokenID) ||
+		(r.VIN != "" && r.VIN == claims.VIN) ||
+		(r.ClientID != "" && r.ClientID == claims.ClientID)
+}
+
+// revocationIndex holds revocations by key.
+type revocationIndex map[string]Revocation
+
+func (idx revocationIndex) match(claims *tokenClaims) (Revocation, bool) {
+	for _, key := range []string{"jti." + claims.TokenID, "vin." + claims.VIN, "client." + claims.ClientID} {
+		if r, ok := idx[key]; ok && r.matches(claims) {
+			return r, true
+		}
+	}
+	return Revocation{}, false
+}
+
+// RevocationStore holds the revoked tokens, vehicles and clients. It is checked on
+// every auth request, so lookups are served from memory.
+type RevocationStore interface {
+	// Revoked returns the revocation that applies to the token, if any.
+	Revoked(claims *tokenClaims) (Revocation, bool)
+}
+
+// revocationDocument is the format of the file read by fileRevocationStore.
+type revocationDocument struct {
+	Revocations []Revocation `json:"revocations" yaml:"revocations"`
+}
+
+func parseRevocations(data []byte) (*revocationDocument, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	var doc revocationDocument
+	if err := decoder.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to decode revocations: %w", err)
+	}
+	for i, r := range doc.Revocations {
+		if _, err := r.key(); err != nil {
+			return nil, fmt.Errorf("revocation %d: %w", i, err)
+		}
+	}
+	return &doc, nil
+}
+
+func (doc *revocationDocument) index() revocationIndex {
+	idx := revocationIndex{}
+	for _, r := range doc.Revocations {
+		key, _ := r.key()
+		idx[key] = r
+	}
+	return idx
+}
+
+// fileRevocationStore reads revocations from a YAML or JSON file that is reloaded
+// when it changes. onRevoke is called for every revocation added by a reload.
+type fileRevocationStore struct {
+	file     *watchedFile
+	index    atomic.Pointer[revocationIndex]
+	onRevoke func(Revocation)
+}
+
+func newFileRevocationStore(path string, onRevoke func(Revocation)) (*fileRevocationStore, error) {
+	s := &fileRevocationStore{file: &watchedFile{path: path}, onRevoke: onRevoke}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileRevocationStore) Revoked(claims *tokenClaims) (Revocation, bool) {
+	return s.index.Load().match(claims)
+}
+
+// reload re-reads the revocation file. An invalid file is rejected and the previous
+// revocations stay active.
+func (s *fileRevocationStore) reload() (bool, error) {
+	data, changed, err := s.file.readIfChanged()
+	if err != nil || !changed {
+		return false, err
+	}
+	doc, err := parseRevocations(data)
+	if err != nil {
+		return false, err
+	}
+
+	idx := doc.index()
+	previous := s.index.Swap(&idx)
+	s.file.commit(data)
+	glog.Infof("Loaded %d revocations from %s", len(idx), s.file.path)
+
+	if previous != nil && s.onRevoke != nil {
+		for key, r := range idx {
+			if _, ok := (*previous)[key]; !ok {
+				s.onRevoke(r)
+			}
+		}
+	}
+	return true, nil
+}
+
+func (s *fileRevocationStore) watch(ctx context.Context, interval time.Duration) {
+	watchFile(ctx, "revocations", interval, s.reload)
+}
+
+// kvRevocationStore keeps the revocations of a NATS KV bucket in memory. The bucket
+// is watched, so revocations of all callout replicas and the admin command take
+// effect immediately. onRevoke is called for every revocation added after startup.
+type kvRevocationStore struct {
+	kv       nats.KeyValue
+	onRevoke func(Revocation)
+
+	mu    sync.RWMutex
+	index revocationIndex
+}
+
+// openRevocationBucket binds the KV bucket, and creates it if it doesn't exist.
+func openRevocationBucket(nc *nats.Conn, bucket string) (nats.KeyValue, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket, Description: "Revoked tokens, vehicles and clients of the auth callout"})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open KV bucket %q: %w", bucket, err)
+	}
+	return kv, nil
+}
+
+// newKVRevocationStore loads all revocations of the bucket before it returns, so no
+// request is authorized before the revocations are known.
+func newKVRevocationStore(kv nats.KeyValue, onRevoke func(Revocation)) (*kvRevocationStore, error) {
+	s := &kvRevocationStore{kv: kv, onRevoke: onRevoke, index: revocationIndex{}}
+
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch revocations: %w", err)
+	}
+	// The watcher delivers all current values, then nil
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		s.apply(entry, false)
+	}
+	glog.Infof("Loaded %d revocations from KV bucket %s", len(s.index), kv.Bucket())
+
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry != nil {
+				s.apply(entry, true)
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *kvRevocationStore) Revoked(claims *tokenClaims) (Revocation, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index.match(claims)
+}
+
+func (s *kvRevocationStore) apply(entry nats.KeyValueEntry, notify bool) {
+	if entry.Operation() != nats.KeyValuePut {
+		s.mu.Lock()
+		delete(s.index, entry.Key())
+		s.mu.Unlock()
+		glog.Infof("Revocation %s removed", entry.Key())
+		return
+	}
+
+	var r Revocation
+	if err := json.Unmarshal(entry.Value(), &r); err != nil {
+		glog.Errorf("Ignoring invalid revocation %s: %v", entry.Key(), err)
+		return
+	}
+	if key, err := r.key(); err != nil || key != entry.Key() {
+		glog.Errorf("Ignoring revocation %s that doesn't match its key", entry.Key())
+		return
+	}
+
+	s.mu.Lock()
+	_, known := s.index[entry.Key()]
+	s.index[entry.Key()] = r
+	s.mu.Unlock()
+
+	if notify && !known {
+		glog.Infof("Revoked %s: %s", r, r.Reason)
+		if s.onRevoke != nil {
+			s.onRevoke(r)
+		}
+	}
+}
+
+// revocationAdmin edits the revocations, it is used by the revoke command.
+type revocationAdmin interface {
+	add(r Revocation) error
+	remove(r Revocation) error
+	list() ([]Revocation, error)
+}
+
+// fileRevocationAdmin edits a revocation file. The running callout picks up the
+// change with its next reload.
+type fileRevocationAdmin struct {
+	path string
+}
+
+func (a *fileRevocationAdmin) read() (*revocationDocument, error) {
+	data, err := os.ReadFile(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &revocationDocument{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseRevocations(data)
+}
+
+// write replaces the file atomically, so the callout never reads a partial file.
+func (a *fileRevocationAdmin) write(doc *revocationDocument) error {
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), ".revocations-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), a.path)
+}
+
+func (a *fileRevocationAdmin) add(r Revocation) error {
+	key, err := r.key()
+	if err != nil {
+		return err
+	}
+	doc, err := a.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := doc.index()[key]; ok {
+		return fmt.Errorf("%s is already revoked", r)
+	}
+	doc.Revocations = append(doc.Revocations, r)
+	return a.write(doc)
+}
+
+func (a *fileRevocationAdmin) remove(r Revocation) error {
+	key, err := r.key()
+	if err != nil {
+		return err
+	}
+	doc, err := a.read()
+	if err != nil {
+		return err
+	}
+	kept := doc.Revocations[:0]
+	for _, existing := range doc.Revocations {
+		if existingKey, _ := existing.key(); existingKey != key {
+			kept = append(kept, existing)
+		}
+	}
+	if len(kept) == len(doc.Revocations) {
+		return fmt.Errorf("%s is not revoked", r)
+	}
+	doc.Revocations = kept
+	return a.write(doc)
+}
+
+func (a *fileRevocationAdmin) list() ([]Revocation, error) {
+	doc, err := a.read()
+	if err != nil {
+		return nil, err
+	}
+	return doc.Revocations, nil
+}
+
+// kvRevocationAdmin edits the revocations in a NATS KV bucket.
+type kvRevocationAdmin struct {
+	kv nats.KeyValue
+}
+
+func (a *kvRevocationAdmin) add(r Revocation) error {
+	key, err := r.key()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := a.kv.Create(key, data); errors.Is(err, nats.ErrKeyExists) {
+		return fmt.Errorf("%s is already revoked", r)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *kvRevocationAdmin) remove(r Revocation) error {
+	key, err := r.key()
+	if err != nil {
+		return err
+	}
+	if _, err := a.kv.Get(key); errors.Is(err, nats.ErrKeyNotFound) {
+		return fmt.Errorf("%s is not revoked", r)
+	} else if err != nil {
+		return err
+	}
+	return a.kv.Delete(key)
+}
+
+func (a *kvRevocationAdmin) list() ([]Revocation, error) {
+	keys, err := a.kv.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	var revocations []Revocation
+	for _, key := range keys {
+		entry, err := a.kv.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		var r Revocation
+		if err := json.Unmarshal(entry.Value(), &r); err != nil {
+			return nil, fmt.Errorf("invalid revocation %s: %w", key, err)
+		}
+		revocations = append(revocations, r)
+	}
+	return revocations, nil
+}
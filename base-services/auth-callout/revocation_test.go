@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRevocationKey(t *testing.T) {
+	tests := []struct {
+		revocation Revocation
+		want       string
+	}{
+		{Revocation{TokenID: "0b7c6a2e-1f4d-4c55-9a8e-5d2d1c0f7b3a"}, "jti.0b7c6a2e-1f4d-4c55-9a8e-5d2d1c0f7b3a"},
+		{Revocation{VIN: "WDD1234567890", Reason: "stolen"}, "vin.WDD1234567890"},
+		{Revocation{ClientID: "collector"}, "client.collector"},
+		{Revocation{}, ""},
+		{Revocation{VIN: "VIN1", ClientID: "collector"}, ""},
+		{Revocation{VIN: "VIN.*"}, ""},
+	}
+	for _, tt := range tests {
+		got, err := tt.revocation.key()
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("expected %+v to be rejected, got key %q", tt.revocation, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("expected key %q for %+v, got %q (%v)", tt.want, tt.revocation, got, err)
+		}
+	}
+}
+
+func TestFileRevocationStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.yaml")
+	if err := os.WriteFile(path, []byte("revocations:\n  - vin: VIN1\n    reason: stolen\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var revoked []Revocation
+	store, err := newFileRevocationStore(path, func(r Revocation) { revoked = append(revoked, r) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r, ok := store.Revoked(&tokenClaims{ClientID: "VIN1", VIN: "VIN1"}); !ok || r.Reason != "stolen" {
+		t.Errorf("expected VIN1 to be revoked, got %+v, %v", r, ok)
+	}
+	if _, ok := store.Revoked(&tokenClaims{ClientID: "VIN2", VIN: "VIN2", TokenID: "token-1"}); ok {
+		t.Error("expected VIN2 not to be revoked")
+	}
+	if len(revoked) != 0 {
+		t.Errorf("expected no notification for the initial revocations, got %+v", revoked)
+	}
+
+	// Revocations added by a reload are reported, so their connections can be kicked.
+	if err := os.WriteFile(path, []byte("revocations:\n  - vin: VIN1\n  - jti: token-1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Revoked(&tokenClaims{ClientID: "VIN2", VIN: "VIN2", TokenID: "token-1"}); !ok {
+		t.Error("expected token-1 to be revoked")
+	}
+	if len(revoked) != 1 || revoked[0].TokenID != "token-1" {
+		t.Errorf("expected a notification for token-1, got %+v", revoked)
+	}
+
+	// Invalid revocations are rejected on reload and the previous ones stay active.
+	if err := os.WriteFile(path, []byte("revocations:\n  - vin: VIN1\n    clientId: VIN1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.reload(); err == nil {
+		t.Fatal("expected invalid revocation file to be rejected")
+	}
+	if _, ok := store.Revoked(&tokenClaims{TokenID: "token-1"}); !ok {
+		t.Error("expected previous revocations to stay active")
+	}
+}
+
+func testRevocationAdmin(t *testing.T, admin revocationAdmin) {
+	t.Helper()
+	if err := admin.add(Revocation{VIN: "VIN1", Reason: "stolen"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.add(Revocation{ClientID: "collector"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.add(Revocation{VIN: "VIN1"}); err == nil {
+		t.Error("expected adding a revocation twice to fail")
+	}
+	if err := admin.add(Revocation{}); err == nil {
+		t.Error("expected an empty revocation to be rejected")
+	}
+
+	if err := admin.remove(Revocation{ClientID: "collector"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.remove(Revocation{ClientID: "collector"}); err == nil {
+		t.Error("expected removing an unknown revocation to fail")
+	}
+
+	revocations, err := admin.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revocations) != 1 || revocations[0].VIN != "VIN1" || revocations[0].Reason != "stolen" {
+		t.Errorf("expected only VIN1 to be revoked, got %+v", revocations)
+	}
+}
+
+func TestFileRevocationAdmin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.yaml")
+	testRevocationAdmin(t, &fileRevocationAdmin{path: path})
+
+	// The edited file is read by the store
+	store, err := newFileRevocationStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Revoked(&tokenClaims{VIN: "VIN1"}); !ok {
+		t.Error("expected VIN1 to be revoked")
+	}
+}
+
+func TestKVRevocationStore(t *testing.T) {
+	nc := runJetStreamServer(t)
+	kv, err := openRevocationBucket(nc, "revocations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := &kvRevocationAdmin{kv: kv}
+	if err := admin.add(Revocation{TokenID: "token-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	revoked := make(chan Revocation, 10)
+	store, err := newKVRevocationStore(kv, func(r Revocation) { revoked <- r })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Revoked(&tokenClaims{TokenID: "token-1"}); !ok {
+		t.Error("expected revocations to be loaded before the store is returned")
+	}
+	if err := admin.remove(Revocation{TokenID: "token-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	testRevocationAdmin(t, admin)
+	select {
+	case r := <-revoked:
+		if r.VIN != "VIN1" {
+			t.Errorf("expected a notification for VIN1, got %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification for the new revocation")
+	}
+
+	// The removal reaches the store through the watcher
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, ok := store.Revoked(&tokenClaims{ClientID: "collector"})
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the removed revocation to be dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAuthorizeRejectsRevokedTokens(t *testing.T) {
+	now := time.Now()
+	callout := newTestCallout(t, expiryTestPolicy)
+	revocations := &fileRevocationStore{}
+	idx := revocationIndex{"jti.token-1": {TokenID: "token-1"}, "vin.VIN2": {VIN: "VIN2"}}
+	revocations.index.Store(&idx)
+	callout.revocations = revocations
+
+	tests := []struct {
+		name    string
+		vin     string
+		jti     string
+		revoked bool
+	}{
+		{name: "revoked token", vin: "VIN1", jti: "token-1", revoked: true},
+		{name: "revoked vehicle", vin: "VIN2", jti: "token-2", revoked: true},
+		{name: "valid token", vin: "VIN1", jti: "token-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims(now)
+			claims["azp"] = tt.vin
+			claims["jti"] = tt.jti
+
+			_, err := callout.authorize(t, callout.signer.sign(t, claims))
+			var authErr *authError
+			switch {
+			case tt.revoked && (!errors.As(err, &authErr) || authErr.Reason != reasonRevoked):
+				t.Errorf("expected a %s rejection, got %v", reasonRevoked, err)
+			case !tt.revoked && err != nil:
+				t.Errorf("expected the token to be accepted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConnectionTrackerDisconnect(t *testing.T) {
+	now := time.Now()
+	var kicked []uint64
+	tracker := newConnectionTracker(func(serverID string, cid uint64) error {
+		kicked = append(kicked, cid)
+		if cid == 4 {
+			return errors.New("no such client")
+		}
+		return nil
+	})
+	tracker.now = func() time.Time { return now }
+
+	tracker.add("server-1", 1, &tokenClaims{ClientID: "VIN1", VIN: "VIN1", TokenID: "token-1"}, now.Add(time.Minute))
+	tracker.add("server-1", 2, &tokenClaims{ClientID: "VIN1", VIN: "VIN1", TokenID: "token-2"}, now.Add(time.Minute))
+	tracker.add("server-2", 3, &tokenClaims{ClientID: "VIN1", VIN: "VIN1", TokenID: "token-3"}, now.Add(-time.Minute))
+	tracker.add("server-2", 4, &tokenClaims{ClientID: "VIN1", VIN: "VIN1", TokenID: "token-4"}, now.Add(time.Minute))
+	tracker.add("server-2", 5, &tokenClaims{ClientID: "VIN2", VIN: "VIN2", TokenID: "token-5"}, now.Add(time.Minute))
+
+	if n := tracker.disconnect(Revocation{VIN: "VIN1"}); n != 2 {
+		t.Errorf("expected 2 connections to be kicked, got %d", n)
+	}
+	// The expired connection is not kicked, the NATS server closed it already
+	if len(kicked) != 3 || kicked[0] != 1 || kicked[1] != 2 || kicked[2] != 4 {
+		t.Errorf("expected clients 1, 2 and 4 to be kicked, got %v", kicked)
+	}
+	if len(tracker.connections) != 1 || tracker.connections[0].cid != 5 {
+		t.Errorf("expected only client 5 to be tracked, got %+v", tracker.connections)
+	}
+}
+
+func TestConnectionTrackerPrunesExpired(t *testing.T) {
+	now := time.Now()
+	tracker := newConnectionTracker(func(string, uint64) error { return nil })
+	tracker.now = func() time.Time { return now }
+
+	// Without revocations, the connections of a long running service still expire
+	for cid := range uint64(100 * minPruneSize) {
+		now = now.Add(time.Second)
+		tracker.add("server-1", cid, &tokenClaims{ClientID: "VIN1", VIN: "VIN1"}, now.Add(time.Minute))
+	}
+	if n := len(tracker.connections); n > 2*minPruneSize {
+		t.Errorf("expected at most %d tracked connections, got %d", 2*minPruneSize, n)
+	}
+
+	// Connections that didn't expire yet are kept
+	last := tracker.connections[len(tracker.connections)-1]
+	if last.cid != 100*minPruneSize-1 {
+		t.Errorf("expected the last connection to be tracked, got %+v", last)
+	}
+	// One connection per second for a minute
+	if n := tracker.disconnect(Revocation{VIN: "VIN1"}); n != 60 {
+		t.Errorf("expected the 60 unexpired connections to be kicked, got %d", n)
+	}
+}
+
+func TestRevokeCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.yaml")
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := runRevokeCommand(append(args, "-file", path), &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	if code, _, stderr := run("add", "-vin", "VIN1", "-reason", "stolen"); code != 0 {
+		t.Fatalf("add failed: %s", stderr)
+	}
+	if code, _, _ := run("add", "-vin", "VIN1", "-jti", "token-1"); code != 1 {
+		t.Errorf("expected add with two identifiers to fail, got exit code %d", code)
+	}
+	code, stdout, stderr := run("list")
+	if code != 0 {
+		t.Fatalf("list failed: %s", stderr)
+	}
+	if !strings.HasPrefix(stdout, "vehicle VIN1\t") || !strings.HasSuffix(stdout, "\tstolen\n") {
+		t.Errorf("unexpected list output %q", stdout)
+	}
+	if code, _, stderr := run("remove", "-vin", "VIN1"); code != 0 {
+		t.Fatalf("remove failed: %s", stderr)
+	}
+	if code, _, _ := run("unknown"); code != 2 {
+		t.Errorf("expected an unknown action to fail with exit code 2, got %d", code)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const revokeUsage = `Usage: auth-callout revoke add|remove|list [flags]
+
+Revokes tokens, vehicles or clients in the revocation store of the callout, the
+file of REVOCATION_FILE or the KV bucket of REVOCATION_KV_BUCKET on NATS_URL.
+
+Flags:
+`
+
+// runRevokeCommand runs "auth-callout revoke" and returns the exit code.
+func runRevokeCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, revokeUsage)
+		flags.PrintDefaults()
+	}
+	var r Revocation
+	flags.StringVar(&r.TokenID, "jti", "", "ID of the token")
+	flags.StringVar(&r.VIN, "vin", "", "VIN of the vehicle")
+	flags.StringVar(&r.ClientID, "client-id", "", "Keycloak client ID")
+	flags.StringVar(&r.Reason, "reason", "", "why the entry is revoked")
+	file := flags.String("file", os.Getenv("REVOCATION_FILE"), "revocation file")
+	bucket := flags.String("bucket", os.Getenv("REVOCATION_KV_BUCKET"), "revocation KV bucket")
+
+	if len(args) == 0 {
+		flags.Usage()
+		return 2
+	}
+	action := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	admin, closeAdmin, err := openRevocationAdmin(*file, *bucket)
+	if err != nil {
+		fmt.Fprintf(stderr, "revoke: %v\n", err)
+		return 1
+	}
+	defer closeAdmin()
+
+	switch action {
+	case "add":
+		r.Created = time.Now().UTC().Truncate(time.Second)
+		err = admin.add(r)
+	case "remove":
+		err = admin.remove(r)
+	case "list":
+		var revocations []Revocation
+		revocations, err = admin.list()
+		for _, r := range revocations {
+			fmt.Fprintf(stdout, "%s\t%s\t%s\n", r, r.Created.Format(time.RFC3339), r.Reason)
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "revoke %s: %v\n", action, err)
+		return 1
+	}
+	return 0
+}
+
+// openRevocationAdmin opens the revocation file or connects to the KV bucket.
+func openRevocationAdmin(file, bucket string) (revocationAdmin, func(), error) {
+	switch {
+	case file != "" && bucket != "":
+		return nil, nil, errors.New("only one of -file and -bucket can be set")
+	case file != "":
+		return &fileRevocationAdmin{path: file}, func() {}, nil
+	case bucket != "":
+		env := &envReader{getenv: os.Getenv}
+		cfg := loadNatsConfig(env)
+		if err := errors.Join(env.errs...); err != nil {
+			return nil, nil, err
+		}
+		nc, err := nats.Connect(cfg.url, cfg.options()...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error connecting to NATS: %w", err)
+		}
+		kv, err := openRevocationBucket(nc, bucket)
+		if err != nil {
+			nc.Close()
+			return nil, nil, err
+		}
+		return &kvRevocationAdmin{kv: kv}, nc.Close, nil
+	default:
+		return nil, nil, errors.New("either -file or -bucket must be set")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// runJetStreamServer starts an embedded NATS server with JetStream.
+func runJetStreamServer(t *testing.T) *nats.Conn {
+	t.Helper()
+	srv := startServer(t, &natsserver.Options{JetStream: true})
+	return connect(t, srv.ClientURL())
+}
+
+// calloutServer is an embedded NATS server that authorizes clients with a testCallout.
+type calloutServer struct {
+	*natsserver.Server
+	// nc, sub and pool receive the auth requests like in main. closed is closed with nc.
+	nc     *nats.Conn
+	sub    *nats.Subscription
+	pool   *workerPool
+	closed chan struct{}
+}
+
+// Users of the embedded callout server that authenticate with a password instead of the callout.
+const (
+	calloutUser = "auth-callout-service"
+	adminUser   = "admin"
+	testPass    = "secret"
+)
+
+// runCalloutServer starts an embedded NATS server that sends the auth requests of all
+// clients, except the callout and an admin user in the global account, to the callout.
+// The global account has JetStream enabled.
+func runCalloutServer(t testing.TB, callout *testCallout) *calloutServer {
+	t.Helper()
+	return runCalloutServerWithPool(t, callout, defaultWorkers, defaultQueueSize, defaultRequestTimeout)
+}
+
+// runCalloutServerWithPool is runCalloutServer with the given worker pool settings.
+func runCalloutServerWithPool(t testing.TB, callout *testCallout, workers, queueSize int, timeout time.Duration) *calloutServer {
+	t.Helper()
+	issuer, err := callout.accountKeyPair.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authAccount := natsserver.NewAccount("AUTH")
+	srv := startServer(t, &natsserver.Options{
+		JetStream: true,
+		Accounts:  []*natsserver.Account{authAccount},
+		Users: []*natsserver.User{
+			{Username: calloutUser, Password: testPass, Account: authAccount},
+			{Username: adminUser, Password: testPass},
+		},
+		AuthCallout: &natsserver.AuthCallout{
+			Issuer:    issuer,
+			Account:   authAccount.Name,
+			AuthUsers: []string{calloutUser, adminUser},
+		},
+	})
+	if err := srv.GlobalAccount().EnableJetStream(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &calloutServer{Server: srv, closed: make(chan struct{})}
+	s.pool = newWorkerPool(workers, queueSize, timeout, callout.handleRequest, callout.shed)
+	t.Cleanup(s.pool.stop)
+	s.nc = connect(t, srv.ClientURL(), nats.UserInfo(calloutUser, testPass),
+		nats.ClosedHandler(func(*nats.Conn) { close(s.closed) }))
+	if s.sub, err = s.nc.QueueSubscribe("$SYS.REQ.USER.AUTH", defaultQueueGroup, s.pool.submit); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// admin connects the admin user to the global account, without the callout.
+func (s *calloutServer) admin(t testing.TB) *nats.Conn {
+	t.Helper()
+	return connect(t, s.ClientURL(), nats.UserInfo(adminUser, testPass))
+}
+
+// connectWithToken connects a client that is authorized by the callout.
+func (s *calloutServer) connectWithToken(t testing.TB, token string, opts ...nats.Option) (*nats.Conn, error) {
+	t.Helper()
+	opts = append([]nats.Option{nats.Token(token), nats.MaxReconnects(0)}, opts...)
+	nc, err := nats.Connect(s.ClientURL(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(nc.Close)
+	return nc, nil
+}
+
+func startServer(t testing.TB, opts *natsserver.Options) *natsserver.Server {
+	t.Helper()
+	opts.Host = "127.0.0.1"
+	opts.Port = -1
+	opts.NoLog = true
+	opts.NoSigs = true
+	if opts.JetStream {
+		opts.StoreDir = t.TempDir()
+	}
+	srv, err := natsserver.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Start()
+	t.Cleanup(srv.Shutdown)
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	return srv
+}
+
+func connect(t testing.TB, url string, opts ...nats.Option) *nats.Conn {
+	t.Helper()
+	nc, err := nats.Connect(url, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	glog "github.com/labstack/gommon/log"
+)
+
+// Reason codes of rejected tokens.
+const (
+	reasonMalformedToken   = "malformed_token"
+	reasonUnknownKey       = "unknown_key"
+	reasonInvalidSignature = "invalid_signature"
+	reasonInvalidAlgorithm = "invalid_algorithm"
+	reasonExpired          = "token_expired"
+	reasonNotYetValid      = "token_not_yet_valid"
+	reasonTooOld           = "token_too_old"
+	reasonInvalidIssuer    = "invalid_issuer"
+	reasonInvalidAudience  = "invalid_audience"
+	reasonInvalidType      = "invalid_token_type"
+)
+
+// defaultTokenLeeway is the clock skew tolerated for exp, nbf and iat.
+const defaultTokenLeeway = 30 * time.Second
+
+// tokenValidator validates Keycloak tokens: the signature against the realm keys and
+// the issuer, audience, type and age of the token.
+type tokenValidator struct {
+	keys *keySet
+	// issuers are the accepted iss claims, e.g. one per realm. The issuer isn't checked if empty.
+	issuers []string
+	// audiences are the accepted aud values, one of them must be present. The audience
+	// isn't checked if empty.
+	audiences []string
+	// types are the accepted typ claims, e.g. "Bearer".
+	types []string
+	// maxAge rejects tokens issued longer ago, based on the iat claim. Zero disables the check.
+	maxAge time.Duration
+	leeway time.Duration
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+// validate verifies the token and returns its claims. Rejections are returned as
+// authError with a reason code.
+func (v *tokenValidator) validate(ctx context.Context, tokenString string) (jwt.MapClaims, error) {
+	now := time.Now
+	if v.now != nil {
+		now = v.now
+	}
+
+	parser := jwt.NewParser(
+		jwt.WithLeeway(v.leeway),
+		jwt.WithTimeFunc(now),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+
+	claims := jwt.MapClaims{}
+	token, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		return v.lookupKey(ctx, token)
+	})
+	if err != nil {
+		return nil, classifyParseError(err)
+	}
+	if !token.Valid {
+		return nil, newAuthError(reasonInvalidSignature, "token is not valid")
+	}
+
+	if err := v.validateClaims(claims, now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// lookupKey returns the public key for the kid in the token header. The key must
+// match the algorithm of the token, see checkAlgorithm.
+func (v *tokenValidator) lookupKey(ctx context.Context, token *jwt.Token) (any, error) {
+	keyID, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, newAuthError(reasonMalformedToken, "expecting JWT header to have string kid")
+	}
+
+	key, err := v.keys.lookup(ctx, keyID)
+	if err != nil {
+		return nil, &authError{Reason: reasonUnknownKey, Err: err}
+	}
+
+	var rawKey any
+	if err := key.Raw(&rawKey); err != nil {
+		return nil, newAuthError(reasonUnknownKey, "failed to create public key: %s", err)
+	}
+
+	alg := token.Method.Alg()
+	if keyAlg := key.Algorithm(); keyAlg != "" && keyAlg != alg {
+		return nil, newAuthError(reasonInvalidAlgorithm, "token algorithm %s doesn't match algorithm %s of key %s", alg, keyAlg, keyID)
+	}
+	if err := checkAlgorithm(alg, rawKey); err != nil {
+		return nil, &authError{Reason: reasonInvalidAlgorithm, Err: fmt.Errorf("key %s: %w", keyID, err)}
+	}
+	glog.Debugf("Found %s public key %s", alg, keyID)
+	return rawKey, nil
+}
+
+// checkAlgorithm checks that the key type (and curve) fits the signing algorithm of
+// the token. Otherwise a token could pick an algorithm the key was never meant for,
+// e.g. HS256 with the public RSA key as HMAC secret.
+func checkAlgorithm(alg string, key any) error {
+	switch alg {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		if _, ok := key.(*rsa.PublicKey); !ok {
+			return fmt.Errorf("algorithm %s requires an RSA key, got %T", alg, key)
+		}
+	case "ES256", "ES384", "ES512":
+		curve := map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521()}[alg]
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s requires an EC key, got %T", alg, key)
+		}
+		if ecKey.Curve != curve {
+			return fmt.Errorf("algorithm %s requires curve %s, got %s", alg, curve.Params().Name, ecKey.Curve.Params().Name)
+		}
+	case "EdDSA":
+		if _, ok := key.(ed25519.PublicKey); !ok {
+			return fmt.Errorf("algorithm %s requires an Ed25519 key, got %T", alg, key)
+		}
+	default:
+		return fmt.Errorf("algorithm %s is not supported", alg)
+	}
+	return nil
+}
+
+// classifyParseError maps the errors of the jwt parser to reason codes.
+func classifyParseError(err error) error {
+	var authErr *authError
+	switch {
+	case errors.As(err, &authErr):
+		return authErr
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return &authError{Reason: reasonExpired, Err: err}
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return &authError{Reason: reasonNotYetValid, Err: err}
+	case errors.Is(err, jwt.ErrTokenRequiredClaimMissing):
+		return &authError{Reason: reasonMissingClaim, Err: err}
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return &authError{Reason: reasonInvalidSignature, Err: err}
+	default:
+		return &authError{Reason: reasonMalformedToken, Err: err}
+	}
+}
+
+func (v *tokenValidator) validateClaims(claims jwt.MapClaims, now time.Time) error {
+	if len(v.issuers) > 0 {
+		issuer, err := claims.GetIssuer()
+		if err != nil {
+			return &authError{Reason: reasonMalformedClaim, Err: err}
+		}
+		if !slices.Contains(v.issuers, issuer) {
+			return newAuthError(reasonInvalidIssuer, "unexpected issuer %q", issuer)
+		}
+	}
+
+	if len(v.audiences) > 0 {
+		audiences, err := claims.GetAudience()
+		if err != nil {
+			return &authError{Reason: reasonMalformedClaim, Err: err}
+		}
+		if !slices.ContainsFunc(audiences, func(aud string) bool { return slices.Contains(v.audiences, aud) }) {
+			return newAuthError(reasonInvalidAudience, "token audience %v contains none of %v", []string(audiences), v.audiences)
+		}
+	}
+
+	if len(v.types) > 0 {
+		typ, ok := claims["typ"].(string)
+		if !ok {
+			return newAuthError(reasonMissingClaim, "token has no typ claim")
+		}
+		if !slices.Contains(v.types, typ) {
+			return newAuthError(reasonInvalidType, "token type %q is not allowed", typ)
+		}
+	}
+
+	if v.maxAge > 0 {
+		issuedAt, err := claims.GetIssuedAt()
+		if err != nil {
+			return &authError{Reason: reasonMalformedClaim, Err: err}
+		}
+		if issuedAt == nil {
+			return newAuthError(reasonMissingClaim, "token has no iat claim")
+		}
+		if age := now.Sub(issuedAt.Time); age > v.maxAge+v.leeway {
+			return newAuthError(reasonTooOld, "token was issued %s ago, max age is %s", age.Round(time.Second), v.maxAge)
+		}
+	}
+
+	return nil
+}
+
+// String describes the checks of the validator for the startup log.
+func (v *tokenValidator) String() string {
+	return fmt.Sprintf("issuers=%v audiences=%v types=%v maxAge=%s leeway=%s", v.issuers, v.audiences, v.types, v.maxAge, v.leeway)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+const testIssuer = "https://keycloak.example.com/realms/sdv-telemetry"
+
+// testSigner signs tokens with a key that is published under kid.
+type testSigner struct {
+	kid    string
+	key    crypto.Signer
+	method jwt.SigningMethod
+}
+
+// newTestSigner creates an RS256 signer.
+func newTestSigner(t testing.TB, kid string) *testSigner {
+	t.Helper()
+	return newTestSignerWithMethod(t, kid, jwt.SigningMethodRS256)
+}
+
+// newTestSignerWithMethod creates a signer with a new key of the type the method requires.
+func newTestSignerWithMethod(t testing.TB, kid string, method jwt.SigningMethod) *testSigner {
+	t.Helper()
+	var key crypto.Signer
+	var err error
+	switch method.Alg() {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ES512":
+		key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatalf("unsupported method %s", method.Alg())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{kid: kid, key: key, method: method}
+}
+
+func (s *testSigner) jwk(t testing.TB) jwk.Key {
+	t.Helper()
+	key, err := jwk.New(s.key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = key.Set(jwk.KeyIDKey, s.kid)
+	return key
+}
+
+func (s *testSigner) sign(t testing.TB, claims jwt.MapClaims) string {
+	t.Helper()
+	return s.signWith(t, s.method, s.key, claims)
+}
+
+// signWith signs the token under the kid of the signer, but with any method and key.
+func (s *testSigner) signWith(t testing.TB, method jwt.SigningMethod, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = s.kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// validClaims returns the claims of a Keycloak access token issued at now.
+func validClaims(now time.Time) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":          testIssuer,
+		"aud":          []string{"nats", "account"},
+		"typ":          "Bearer",
+		"azp":          "VIN1",
+		"iat":          now.Unix(),
+		"exp":          now.Add(5 * time.Minute).Unix(),
+		"realm_access": map[string]any{"roles": []string{"edge-device"}},
+	}
+}
+
+func TestTokenValidator(t *testing.T) {
+	now := time.Now()
+	signer := newTestSigner(t, "key-1")
+	otherSigner := newTestSigner(t, "key-1")
+	unknownSigner := newTestSigner(t, "key-2")
+
+	validator := &tokenValidator{
+		keys:      newStaticKeySet(newTestJwkSet(signer.jwk(t))),
+		issuers:   []string{testIssuer, "https://keycloak.example.com/realms/brand-b"},
+		audiences: []string{"nats"},
+		types:     []string{"Bearer"},
+		maxAge:    10 * time.Minute,
+		leeway:    30 * time.Second,
+		now:       func() time.Time { return now },
+	}
+
+	with := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := validClaims(now)
+		for k, v := range changes {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantReason string
+	}{
+		{name: "valid", token: signer.sign(t, validClaims(now))},
+		{name: "other accepted issuer", token: signer.sign(t, with(jwt.MapClaims{"iss": "https://keycloak.example.com/realms/brand-b"}))},
+		{name: "single audience", token: signer.sign(t, with(jwt.MapClaims{"aud": "nats"}))},
+		{name: "expired within leeway", token: signer.sign(t, with(jwt.MapClaims{"exp": now.Add(-10 * time.Second).Unix()}))},
+		{name: "expired", token: signer.sign(t, with(jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()})), wantReason: reasonExpired},
+		{name: "missing exp", token: signer.sign(t, with(jwt.MapClaims{"exp": nil})), wantReason: reasonMissingClaim},
+		{name: "not yet valid", token: signer.sign(t, with(jwt.MapClaims{"nbf": now.Add(time.Minute).Unix()})), wantReason: reasonNotYetValid},
+		{name: "issued in the future", token: signer.sign(t, with(jwt.MapClaims{"iat": now.Add(time.Minute).Unix()})), wantReason: reasonNotYetValid},
+		{name: "too old", token: signer.sign(t, with(jwt.MapClaims{"iat": now.Add(-time.Hour).Unix()})), wantReason: reasonTooOld},
+		{name: "missing iat", token: signer.sign(t, with(jwt.MapClaims{"iat": nil})), wantReason: reasonMissingClaim},
+		{name: "wrong issuer", token: signer.sign(t, with(jwt.MapClaims{"iss": "https://evil.example.com/realms/sdv-telemetry"})), wantReason: reasonInvalidIssuer},
+		{name: "missing issuer", token: signer.sign(t, with(jwt.MapClaims{"iss": nil})), wantReason: reasonInvalidIssuer},
+		{name: "wrong audience", token: signer.sign(t, with(jwt.MapClaims{"aud": []string{"account"}})), wantReason: reasonInvalidAudience},
+		{name: "missing audience", token: signer.sign(t, with(jwt.MapClaims{"aud": nil})), wantReason: reasonInvalidAudience},
+		{name: "id token", token: signer.sign(t, with(jwt.MapClaims{"typ": "ID"})), wantReason: reasonInvalidType},
+		{name: "refresh token", token: signer.sign(t, with(jwt.MapClaims{"typ": "Refresh"})), wantReason: reasonInvalidType},
+		{name: "missing type", token: signer.sign(t, with(jwt.MapClaims{"typ": nil})), wantReason: reasonMissingClaim},
+		{name: "unknown kid", token: unknownSigner.sign(t, validClaims(now)), wantReason: reasonUnknownKey},
+		{name: "wrong signature", token: otherSigner.sign(t, validClaims(now)), wantReason: reasonInvalidSignature},
+		{name: "garbage", token: "not-a-token", wantReason: reasonMalformedToken},
+		{name: "empty", token: "", wantReason: reasonMalformedToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := validator.validate(context.Background(), tt.token)
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if claims["azp"] != "VIN1" {
+					t.Errorf("unexpected claims %v", claims)
+				}
+				return
+			}
+
+			var authErr *authError
+			if !errors.As(err, &authErr) {
+				t.Fatalf("expected authError with reason %q, got %v", tt.wantReason, err)
+			}
+			if authErr.Reason != tt.wantReason {
+				t.Errorf("expected reason %q, got %q (%v)", tt.wantReason, authErr.Reason, err)
+			}
+		})
+	}
+}
+
+func TestTokenValidatorWithoutOptionalChecks(t *testing.T) {
+	now := time.Now()
+	signer := newTestSigner(t, "key-1")
+	validator := &tokenValidator{keys: newStaticKeySet(newTestJwkSet(signer.jwk(t)))}
+
+	claims := validClaims(now)
+	claims["iss"] = "https://other.example.com"
+	claims["aud"] = "account"
+	claims["typ"] = "ID"
+	claims["iat"] = now.Add(-24 * time.Hour).Unix()
+
+	if _, err := validator.validate(context.Background(), signer.sign(t, claims)); err != nil {
+		t.Fatalf("expected token to be accepted without issuer, audience, type and age checks: %v", err)
+	}
+}
+
+func TestTokenValidatorAlgorithms(t *testing.T) {
+	now := time.Now()
+	methods := []jwt.SigningMethod{
+		jwt.SigningMethodRS256, jwt.SigningMethodRS512, jwt.SigningMethodPS256,
+		jwt.SigningMethodES256, jwt.SigningMethodES384, jwt.SigningMethodES512,
+		jwt.SigningMethodEdDSA,
+	}
+
+	for _, method := range methods {
+		t.Run(method.Alg(), func(t *testing.T) {
+			signer := newTestSignerWithMethod(t, "key-"+method.Alg(), method)
+			validator := &tokenValidator{keys: newStaticKeySet(newTestJwkSet(signer.jwk(t)))}
+
+			if _, err := validator.validate(context.Background(), signer.sign(t, validClaims(now))); err != nil {
+				t.Fatalf("expected %s token to be valid: %v", method.Alg(), err)
+			}
+		})
+	}
+}
+
+func TestTokenValidatorRejectsAlgorithmConfusion(t *testing.T) {
+	now := time.Now()
+	rsaSigner := newTestSigner(t, "rsa")
+	ecSigner := newTestSignerWithMethod(t, "ec", jwt.SigningMethodES256)
+	edSigner := newTestSignerWithMethod(t, "ed", jwt.SigningMethodEdDSA)
+
+	// A JWK that declares its algorithm only accepts tokens with that algorithm
+	restricted := newTestSigner(t, "rs512-only")
+	restrictedJwk := restricted.jwk(t)
+	_ = restrictedJwk.Set(jwk.AlgorithmKey, "RS512")
+
+	validator := &tokenValidator{keys: newStaticKeySet(newTestJwkSet(rsaSigner.jwk(t), ecSigner.jwk(t), edSigner.jwk(t), restrictedJwk))}
+
+	// The public key as HMAC secret, as an attacker would use it
+	der, err := x509.MarshalPKIXPublicKey(rsaSigner.key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantReason string
+	}{
+		{name: "HS256 with RSA public key", token: rsaSigner.signWith(t, jwt.SigningMethodHS256, rsaPEM, validClaims(now)), wantReason: reasonInvalidAlgorithm},
+		{name: "HS256 with raw key bytes", token: edSigner.signWith(t, jwt.SigningMethodHS256, []byte(edSigner.key.Public().(ed25519.PublicKey)), validClaims(now)), wantReason: reasonInvalidAlgorithm},
+		{name: "none", token: rsaSigner.signWith(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, validClaims(now)), wantReason: reasonInvalidAlgorithm},
+		{name: "ES256 for RSA key", token: rsaSigner.signWith(t, jwt.SigningMethodES256, ecSigner.key, validClaims(now)), wantReason: reasonInvalidAlgorithm},
+		{name: "RS256 for EC key", token: ecSigner.signWith(t, jwt.SigningMethodRS256, rsaSigner.key, validClaims(now)), wantReason: reasonInvalidAlgorithm},
+		{name: "ES384 for P-256 key", token: ecSigner.signWith(t, jwt.SigningMethodES384, p384Key, validClaims(now)), wantReason: reasonInvalidAlgorithm},
+		{name: "EdDSA for EC key", token: ecSigner.signWith(t, jwt.SigningMethodEdDSA, edSigner.key, validClaims(now)), wantReason: reasonInvalidAlgorithm},
+		{name: "algorithm of JWK", token: restricted.sign(t, validClaims(now)), wantReason: reasonInvalidAlgorithm},
+		{name: "EC signature of other key", token: ecSigner.signWith(t, jwt.SigningMethodES256, newTestSignerWithMethod(t, "other", jwt.SigningMethodES256).key, validClaims(now)), wantReason: reasonInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validator.validate(context.Background(), tt.token)
+			var authErr *authError
+			if !errors.As(err, &authErr) {
+				t.Fatalf("expected authError with reason %q, got %v", tt.wantReason, err)
+			}
+			if authErr.Reason != tt.wantReason {
+				t.Errorf("expected reason %q, got %q (%v)", tt.wantReason, authErr.Reason, err)
+			}
+		})
+	}
+}
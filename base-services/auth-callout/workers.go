@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Defaults of the worker pool that handles the auth requests.
+const (
+	// defaultQueueGroup is the queue group the replicas share the auth requests in.
+	defaultQueueGroup = "auth-callout"
+	// defaultWorkers is the number of auth requests handled concurrently. Requests are
+	// mostly signature checks, but consent and fleet lookups may wait on the network.
+	defaultWorkers = 32
+	// defaultQueueSize is the number of auth requests waiting for a worker before new
+	// requests are shed.
+	defaultQueueSize = 1024
+	// defaultRequestTimeout matches the default auth timeout of the NATS server, after
+	// which the server no longer waits for the response.
+	defaultRequestTimeout = 2 * time.Second
+)
+
+// pendingRequest is an auth request waiting for a worker.
+type pendingRequest struct {
+	msg      *nats.Msg
+	received time.Time
+}
+
+// workerPool handles auth requests with a bounded number of workers. The NATS
+// subscription only queues the requests, so a burst of connects doesn't serialize
+// behind slow requests. Requests that don't fit into the queue are shed right away,
+// instead of piling up until the NATS server times them out.
+type workerPool struct {
+	queue   chan pendingRequest
+	timeout time.Duration
+	// handle authorizes a request before the deadline of the context.
+	handle func(ctx context.Context, msg *nats.Msg)
+	// shed rejects a request that doesn't fit into the queue.
+	shed func(msg *nats.Msg)
+	wg   sync.WaitGroup
+
+	// mu guards the queue against being closed while a request is submitted.
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// newWorkerPool starts the workers of the pool. Every request must be handled within
+// timeout of being received, including the time it waited in the queue.
+func newWorkerPool(workers, queueSize int, timeout time.Duration, handle func(context.Context, *nats.Msg), shed func(*nats.Msg)) *workerPool {
+	p := &workerPool{
+		queue:   make(chan pendingRequest, queueSize),
+		timeout: timeout,
+		handle:  handle,
+		shed:    shed,
+	}
+	p.wg.Add(workers)
+	for range workers {
+		go p.work()
+	}
+	return p
+}
+
+// submit queues a request for the workers, it is the message handler of the
+// subscription. A request is shed if the queue is full or the pool is stopped.
+func (p *workerPool) submit(msg *nats.Msg) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		p.shed(msg)
+		return
+	}
+	select {
+	case p.queue <- pendingRequest{msg: msg, received: time.Now()}:
+		pendingRequests.Inc()
+	default:
+		p.shed(msg)
+	}
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for req := range p.queue {
+		pendingRequests.Dec()
+		ctx, cancel := context.WithDeadline(context.Background(), req.received.Add(p.timeout))
+		p.handle(ctx, req.msg)
+		cancel()
+	}
+}
+
+// stop handles the queued requests and waits for the workers to finish. Requests
+// submitted after stop are shed.
+func (p *workerPool) stop() {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	glog "github.com/labstack/gommon/log"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWorkerPoolShedsWhenFull(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var handled, shed atomic.Int32
+	pool := newWorkerPool(1, 1, time.Minute, func(ctx context.Context, msg *nats.Msg) {
+		if handled.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+	}, func(*nats.Msg) { shed.Add(1) })
+
+	// The first request occupies the worker, the second waits in the queue
+	pool.submit(&nats.Msg{})
+	<-started
+	pool.submit(&nats.Msg{})
+	pool.submit(&nats.Msg{})
+	if got := shed.Load(); got != 1 {
+		t.Fatalf("expected one request to be shed, got %d", got)
+	}
+
+	close(release)
+	pool.stop()
+	if got := handled.Load(); got != 2 {
+		t.Errorf("expected the queued request to be handled, %d handled", got)
+	}
+}
+
+func TestWorkerPoolDeadline(t *testing.T) {
+	deadlines := make(chan time.Time, 1)
+	pool := newWorkerPool(1, 1, 100*time.Millisecond, func(ctx context.Context, msg *nats.Msg) {
+		deadline, _ := ctx.Deadline()
+		deadlines <- deadline
+	}, func(*nats.Msg) {})
+	defer pool.stop()
+
+	submitted := time.Now()
+	pool.submit(&nats.Msg{})
+	deadline := <-deadlines
+	if deadline.Before(submitted) || deadline.After(submitted.Add(100*time.Millisecond+10*time.Millisecond)) {
+		t.Errorf("expected the deadline within 100ms of the request, got %s", deadline.Sub(submitted))
+	}
+}
+
+// blockingFleets is a FleetStore that doesn't respond before the request is cancelled.
+// Lookups are signalled on called.
+type blockingFleets struct {
+	called chan struct{}
+}
+
+func (f blockingFleets) FleetVehicles(ctx context.Context, _ string) ([]string, error) {
+	select {
+	case f.called <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// recordingAuditSink collects the audit events for tests.
+type recordingAuditSink struct {
+	mu     sync.Mutex
+	events []*auditEvent
+}
+
+func (s *recordingAuditSink) write(event *auditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *recordingAuditSink) reasons() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var reasons []string
+	for _, event := range s.events {
+		reasons = append(reasons, event.Reason)
+	}
+	return reasons
+}
+
+// fleetToken returns a token with a fleet role, whose authorization waits for the fleet store.
+func fleetToken(t testing.TB, callout *testCallout, clientID string) string {
+	t.Helper()
+	claims := validClaims(time.Now())
+	claims["azp"] = clientID
+	claims["fleets"] = []string{"f1"}
+	claims["realm_access"] = map[string]any{"roles": []string{"fleet-collector"}}
+	return callout.signer.sign(t, claims)
+}
+
+func TestCalloutRequestTimeout(t *testing.T) {
+	callout := newTestCallout(t, fleetTestPolicy)
+	callout.fleets = blockingFleets{}
+	audit := &recordingAuditSink{}
+	callout.auditSink = audit
+	srv := runCalloutServerWithPool(t, callout, 1, 1, 200*time.Millisecond)
+
+	if _, err := srv.connectWithToken(t, fleetToken(t, callout, "ops")); err == nil {
+		t.Fatal("expected the connection to be rejected")
+	}
+	if want := []string{reasonTimeout}; !slices.Equal(audit.reasons(), want) {
+		t.Errorf("expected rejections %v, got %v", want, audit.reasons())
+	}
+}
+
+func TestCalloutShedsRequests(t *testing.T) {
+	callout := newTestCallout(t, fleetTestPolicy)
+	fleets := blockingFleets{called: make(chan struct{}, 1)}
+	callout.fleets = fleets
+	audit := &recordingAuditSink{}
+	callout.auditSink = audit
+	srv := runCalloutServerWithPool(t, callout, 1, 0, time.Second)
+
+	// The first client occupies the only worker until its request times out
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := srv.connectWithToken(t, fleetToken(t, callout, "ops-1"))
+		blocked <- err
+	}()
+	<-fleets.called
+
+	// The second client is rejected right away instead of waiting for the timeout
+	start := time.Now()
+	if _, err := srv.connectWithToken(t, fleetToken(t, callout, "ops-2")); err == nil {
+		t.Fatal("expected the connection to be rejected")
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("expected the request to be shed right away, took %s", elapsed)
+	}
+	if err := <-blocked; err == nil {
+		t.Fatal("expected the blocked connection to be rejected")
+	}
+	if want := []string{reasonOverloaded, reasonTimeout}; !slices.Equal(audit.reasons(), want) {
+		t.Errorf("expected rejections %v, got %v", want, audit.reasons())
+	}
+}
+
+// BenchmarkConcurrentConnects connects thousands of clients at once, like a fleet coming
+// online after an outage, and reports how long the connects took and how many were shed.
+//
+//	go test -run '^$' -bench ConcurrentConnects -benchtime 5x
+func BenchmarkConcurrentConnects(b *testing.B) {
+	const clients = 2000
+	callout := newTestCallout(b, expiryTestPolicy)
+	srv := runCalloutServer(b, callout)
+	// A log line per connect would dominate the benchmark
+	glog.SetLevel(glog.WARN)
+	b.Cleanup(func() { glog.SetLevel(glog.INFO) })
+
+	// Signing the tokens is the work of Keycloak, not part of the benchmark
+	tokens := make([]string, 100)
+	for i := range tokens {
+		claims := validClaims(time.Now())
+		claims["azp"] = fmt.Sprintf("VIN%04d", i)
+		claims["realm_access"] = map[string]any{"roles": []string{"edge-device"}}
+		tokens[i] = callout.signer.sign(b, claims)
+	}
+
+	var latencies []time.Duration
+	var rejected int
+	shed := authRequests.WithLabelValues(outcomeError, reasonOverloaded)
+	shedBefore := testutil.ToFloat64(shed)
+	b.ResetTimer()
+	for range b.N {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		conns := make([]*nats.Conn, 0, clients)
+		for i := range clients {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				nc, err := nats.Connect(srv.ClientURL(), nats.Token(tokens[i%len(tokens)]), nats.MaxReconnects(0), nats.Timeout(10*time.Second))
+				elapsed := time.Since(start)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					rejected++
+					return
+				}
+				latencies = append(latencies, elapsed)
+				conns = append(conns, nc)
+			}()
+		}
+		wg.Wait()
+
+		b.StopTimer()
+		for _, nc := range conns {
+			nc.Close()
+		}
+		b.StartTimer()
+	}
+
+	slices.Sort(latencies)
+	if len(latencies) > 0 {
+		b.ReportMetric(float64(latencies[len(latencies)/2].Milliseconds()), "p50-ms")
+		b.ReportMetric(float64(latencies[len(latencies)*99/100].Milliseconds()), "p99-ms")
+	}
+	b.ReportMetric(float64(rejected)/float64(b.N), "rejected/op")
+	b.ReportMetric((testutil.ToFloat64(shed)-shedBefore)/float64(b.N), "shed/op")
+}
+
+// slowFleets is a FleetStore that takes delay to look up a fleet.
+type slowFleets struct {
+	staticFleets
+	delay  time.Duration
+	called chan struct{}
+}
+
+func (f slowFleets) FleetVehicles(ctx context.Context, fleet string) ([]string, error) {
+	select {
+	case f.called <- struct{}{}:
+	default:
+	}
+	time.Sleep(f.delay)
+	return f.staticFleets.FleetVehicles(ctx, fleet)
+}
+
+func TestDrainAnswersPendingRequests(t *testing.T) {
+	callout := newTestCallout(t, fleetTestPolicy)
+	fleets := slowFleets{staticFleets: staticFleets{"f1": {"VIN1"}}, delay: 200 * time.Millisecond, called: make(chan struct{}, 1)}
+	callout.fleets = fleets
+	srv := runCalloutServerWithPool(t, callout, 1, 10, 5*time.Second)
+
+	// Three clients wait for the only worker when the callout shuts down
+	results := make(chan error, 3)
+	for i := range 3 {
+		go func() {
+			_, err := srv.connectWithToken(t, fleetToken(t, callout, fmt.Sprintf("ops-%d", i)))
+			results <- err
+		}()
+	}
+	<-fleets.called
+	for len(srv.pool.queue) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	drain(srv.nc, srv.sub, srv.pool, srv.closed, 5*time.Second)
+
+	// The requests received before the shutdown are still granted
+	for range 3 {
+		if err := <-results; err != nil {
+			t.Errorf("expected the pending connect to be granted, got %v", err)
+		}
+	}
+	if !srv.nc.IsClosed() {
+		t.Error("expected the connection to be closed after draining")
+	}
+}
@@ -0,0 +1,32 @@
+package live
+
+import (
+	"data-api/api/gen/telemetry"
+	"strings"
+)
+
+// Source delivers the telemetry messages of the vehicles as they arrive.
+type Source interface {
+	// Subscribe calls the handler for every telemetry message of the vehicle until the
+	// subscription is stopped. The subscription is active when Subscribe returns.
+	Subscribe(vehicleId string, handler func(msg *telemetry.TelemetryMessage)) (Subscription, error)
+}
+
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// Checks that the vehicle id is a single NATS subject token, so a subscription can't
+// match the telemetry of other vehicles through wildcards.
+func IsValidVehicleId(vehicleId string) bool {
+	return vehicleId != "" && !strings.ContainsAny(vehicleId, ".*> \t\r\n")
+}
+
+// Returns the column the telemetry connector stores a reading in, "family:qualifier".
+func Column(reading *telemetry.SensorReading) string {
+	family := "static"
+	if reading.GetDataType() == telemetry.DataType_DYNAMIC {
+		family = "dynamic"
+	}
+	return family + ":" + reading.GetSensor()
+}
@@ -0,0 +1,63 @@
+package live
+
+import (
+	"data-api/api/gen/telemetry"
+	"fmt"
+	"sync"
+)
+
+var _ Source = (*MemorySource)(nil)
+
+// MemorySource delivers the messages passed to Publish to the subscribers of their device.
+// It is meant for tests and local development.
+type MemorySource struct {
+	mu     sync.Mutex
+	nextId int
+	subs   map[string]map[int]func(msg *telemetry.TelemetryMessage)
+}
+
+func NewMemorySource() *MemorySource {
+	return &MemorySource{subs: make(map[string]map[int]func(msg *telemetry.TelemetryMessage))}
+}
+
+func (s *MemorySource) Subscribe(vehicleId string, handler func(msg *telemetry.TelemetryMessage)) (Subscription, error) {
+	if !IsValidVehicleId(vehicleId) {
+		return nil, fmt.Errorf("invalid vehicle id %q", vehicleId)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs[vehicleId] == nil {
+		s.subs[vehicleId] = make(map[int]func(msg *telemetry.TelemetryMessage))
+	}
+	s.nextId++
+	s.subs[vehicleId][s.nextId] = handler
+	return &memorySubscription{source: s, vehicleId: vehicleId, id: s.nextId}, nil
+}
+
+// Publish delivers the message synchronously to the subscribers of msg.DeviceId.
+func (s *MemorySource) Publish(msg *telemetry.TelemetryMessage) {
+	s.mu.Lock()
+	var handlers []func(msg *telemetry.TelemetryMessage)
+	for _, handler := range s.subs[msg.DeviceId] {
+		handlers = append(handlers, handler)
+	}
+	s.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+}
+
+type memorySubscription struct {
+	source    *MemorySource
+	vehicleId string
+	id        int
+}
+
+func (m *memorySubscription) Unsubscribe() error {
+	m.source.mu.Lock()
+	defer m.source.mu.Unlock()
+	delete(m.source.subs[m.vehicleId], m.id)
+	return nil
+}
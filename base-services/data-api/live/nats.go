@@ -0,0 +1,56 @@
+package live
+
+import (
+	"data-api/api/gen/telemetry"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+var _ Source = (*NATSSource)(nil)
+
+// NATSSource subscribes to the telemetry.<vin>.> subjects the vehicles publish to.
+type NATSSource struct {
+	log *zap.Logger
+	nc  *nats.Conn
+}
+
+func NewNATSSource(log *zap.Logger, nc *nats.Conn) *NATSSource {
+	return &NATSSource{log: log, nc: nc}
+}
+
+func (s *NATSSource) Subscribe(vehicleId string, handler func(msg *telemetry.TelemetryMessage)) (Subscription, error) {
+	if !IsValidVehicleId(vehicleId) {
+		return nil, fmt.Errorf("invalid vehicle id %q", vehicleId)
+	}
+
+	subject := fmt.Sprintf("telemetry.%s.>", vehicleId)
+	sub, err := s.nc.Subscribe(subject, func(m *nats.Msg) {
+		var msg telemetry.TelemetryMessage
+		if err := proto.Unmarshal(m.Data, &msg); err != nil {
+			s.log.Warn("Skipping malformed telemetry message", zap.String("subject", m.Subject), zap.Error(err))
+			return
+		}
+		// The connector stores the readings under the device id, so messages of another device are skipped.
+		if msg.DeviceId != vehicleId {
+			s.log.Warn("Skipping telemetry message of another device",
+				zap.String("subject", m.Subject),
+				zap.String("device_id", msg.DeviceId),
+			)
+			return
+		}
+		handler(&msg)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+	}
+
+	// Make sure the server has registered the subscription before it's reported as active.
+	if err := s.nc.Flush(); err != nil {
+		sub.Unsubscribe()
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+	}
+	return sub, nil
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	dataapiv1 "data-api/api/gen/dataapi/v1"
+	"data-api/store"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// AggregateTelemetry streams one point per time bucket with the requested aggregates.
+// The buckets are computed while scanning the rows, so only the current bucket is kept in memory.
+func (s *Server) AggregateTelemetry(req *dataapiv1.AggregateTelemetryRequest, stream dataapiv1.TelemetryDataAPI_AggregateTelemetryServer) error {
+	ctx := stream.Context()
+	s.log.Debug("Received AggregateTelemetry request",
+		zap.String("vehicle_id", req.VehicleId),
+		zap.String("data_types", strings.Join(req.GetDataTypes(), "")),
+		zap.Any("time_selector", req.TimeSelector),
+		zap.Duration("bucket_width", req.GetBucketWidth().AsDuration()),
+		zap.Any("functions", req.GetFunctions()),
+	)
+
+	// 1. Validate request and calculate effective time window
+	eff, err := computeEffectiveWindow(req, s.opt.MaxLookback)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	width := req.GetBucketWidth().AsDuration()
+	if width <= 0 {
+		return status.Error(codes.InvalidArgument, "Bucket_width must be positive.")
+	}
+	if len(req.Functions) == 0 {
+		return status.Error(codes.InvalidArgument, "At least one aggregation function is needed.")
+	}
+	for _, f := range req.Functions {
+		if _, ok := dataapiv1.AggregationFunction_name[int32(f)]; !ok || f == dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_UNSPECIFIED {
+			return status.Errorf(codes.InvalidArgument, "Unknown aggregation function %s.", f)
+		}
+	}
+
+	// 2. Scan the rows and send each bucket as soon as the scan has passed it
+	agg := newBucketAggregator(width, req.Functions)
+	var sendErr, valueErr error
+	err = s.store.QueryTelemetry(
+		ctx,
+		store.QueryOptions{
+			VehicleId: req.VehicleId,
+			StartTime: eff.Start,
+			EndTime:   eff.End,
+			Columns:   req.DataTypes,
+		},
+		func(r store.Row) bool {
+			ts, ok := store.ParseTimestampFromRowKey(r.Key)
+			if !ok {
+				s.log.Warn("Skipping malformed row key", zap.String("key", r.Key))
+				return true // Skip malformed row and continue
+			}
+
+			if done := agg.flushBefore(ts); done != nil {
+				if sendErr = stream.Send(done); sendErr != nil {
+					return false // Client likely disconnected. Stop the scan.
+				}
+			}
+			if valueErr = agg.add(ts, r.Values); valueErr != nil {
+				return false
+			}
+			return true // Continue scanning.
+		},
+	)
+	if err != nil {
+		s.log.Error("Query execution failed", zap.Error(err))
+		return status.Error(codes.Internal, "failed to execute query")
+	}
+	if valueErr != nil {
+		return status.Error(codes.InvalidArgument, valueErr.Error())
+	}
+	if sendErr != nil {
+		return nil
+	}
+
+	// 3. Send the last bucket
+	if done := agg.flush(); done != nil {
+		if err := stream.Send(done); err != nil {
+			return nil // Client likely disconnected.
+		}
+	}
+	return nil
+}
+
+// bucketAggregator aggregates the values of the rows of the current bucket. The rows
+// must be added in chronological order.
+type bucketAggregator struct {
+	width     time.Duration
+	functions []dataapiv1.AggregationFunction
+	numeric   bool // whether the values have to be parsed, i.e. not only COUNT is requested
+
+	start  time.Time // of the current bucket, zero if there is none
+	values map[string]*aggregate
+}
+
+// aggregate accumulates the values of one data type in a bucket.
+type aggregate struct {
+	min, max, sum, first, last float64
+	count                      uint64
+}
+
+func newBucketAggregator(width time.Duration, functions []dataapiv1.AggregationFunction) *bucketAggregator {
+	numeric := false
+	for _, f := range functions {
+		if f != dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_COUNT {
+			numeric = true
+		}
+	}
+	return &bucketAggregator{width: width, functions: functions, numeric: numeric}
+}
+
+// Returns the bucket that starts at the same or a multiple of the width since the Unix epoch.
+func (b *bucketAggregator) bucketStart(ts time.Time) time.Time {
+	epoch := time.Unix(0, 0).UTC()
+	return epoch.Add(ts.Sub(epoch) / b.width * b.width)
+}
+
+// Returns the current bucket if the row at ts belongs to a later one, otherwise nil.
+func (b *bucketAggregator) flushBefore(ts time.Time) *dataapiv1.AggregatedPoint {
+	if b.start.IsZero() || b.bucketStart(ts).Equal(b.start) {
+		return nil
+	}
+	return b.flush()
+}
+
+func (b *bucketAggregator) add(ts time.Time, values map[string][]byte) error {
+	if b.start.IsZero() {
+		b.start = b.bucketStart(ts)
+		b.values = make(map[string]*aggregate)
+	}
+
+	for dataType, raw := range values {
+		var v float64
+		if b.numeric {
+			var err error
+			v, err = strconv.ParseFloat(strings.TrimSpace(string(raw)), 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return fmt.Errorf("Data type %s is not numeric: value %q at %s.", dataType, raw, ts.UTC().Format(time.RFC3339Nano))
+			}
+		}
+
+		a, ok := b.values[dataType]
+		if !ok {
+			b.values[dataType] = &aggregate{min: v, max: v, sum: v, first: v, last: v, count: 1}
+			continue
+		}
+		a.min = math.Min(a.min, v)
+		a.max = math.Max(a.max, v)
+		a.sum += v
+		a.last = v
+		a.count++
+	}
+	return nil
+}
+
+// Returns the current bucket as a point and starts a new one, nil if there is no data.
+func (b *bucketAggregator) flush() *dataapiv1.AggregatedPoint {
+	if b.start.IsZero() {
+		return nil
+	}
+
+	point := &dataapiv1.AggregatedPoint{
+		BucketStart: timestamppb.New(b.start),
+		BucketEnd:   timestamppb.New(b.start.Add(b.width)),
+		Values:      make(map[string]*dataapiv1.Aggregates, len(b.values)),
+	}
+	for dataType, a := range b.values {
+		out := &dataapiv1.Aggregates{}
+		for _, f := range b.functions {
+			switch f {
+			case dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_MIN:
+				out.Min = proto.Float64(a.min)
+			case dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_MAX:
+				out.Max = proto.Float64(a.max)
+			case dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_AVG:
+				out.Avg = proto.Float64(a.sum / float64(a.count))
+			case dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_SUM:
+				out.Sum = proto.Float64(a.sum)
+			case dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_COUNT:
+				out.Count = proto.Uint64(a.count)
+			case dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_FIRST:
+				out.First = proto.Float64(a.first)
+			case dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_LAST:
+				out.Last = proto.Float64(a.last)
+			}
+		}
+		point.Values[dataType] = out
+	}
+
+	b.start = time.Time{}
+	b.values = nil
+	return point
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dataapiv1 "data-api/api/gen/dataapi/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestAggregateTelemetry(t *testing.T) {
+	srv, _ := newTestServer(t, map[time.Time]map[string]string{
+		testNow.Add(-50 * time.Minute): {"dynamic:speed": "10", "static:make": "Ford"},
+		testNow.Add(-40 * time.Minute): {"dynamic:speed": " 20.5 "},
+		testNow.Add(-20 * time.Minute): {"dynamic:speed": "-1e1"},
+	})
+	request := func(width time.Duration, dataTypes []string, functions ...dataapiv1.AggregationFunction) *dataapiv1.AggregateTelemetryRequest {
+		return &dataapiv1.AggregateTelemetryRequest{
+			VehicleId:    "VIN1",
+			DataTypes:    dataTypes,
+			TimeSelector: &dataapiv1.AggregateTelemetryRequest_LastDuration{LastDuration: durationpb.New(time.Hour)},
+			BucketWidth:  durationpb.New(width),
+			Functions:    functions,
+		}
+	}
+
+	t.Run("buckets", func(t *testing.T) {
+		stream := &fakeStream[dataapiv1.AggregatedPoint]{ctx: context.Background()}
+		err := srv.AggregateTelemetry(request(30*time.Minute, []string{"dynamic:speed"},
+			dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_SUM,
+			dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_COUNT,
+		), stream)
+		require.NoError(t, err)
+		require.Len(t, stream.sent, 2)
+
+		// 09:56 falls into the bucket starting at 09:30, 10:06 and 10:26 into the one at 10:00
+		first, second := stream.sent[0], stream.sent[1]
+		require.Equal(t, time.Date(2024, 1, 15, 9, 30, 0, 0, time.UTC), first.BucketStart.AsTime())
+		require.Equal(t, time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC), first.BucketEnd.AsTime())
+		require.Equal(t, 10.0, first.Values["dynamic:speed"].GetSum())
+		require.Equal(t, uint64(1), first.Values["dynamic:speed"].GetCount())
+		require.Nil(t, first.Values["dynamic:speed"].Min)
+
+		require.Equal(t, time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC), second.BucketStart.AsTime())
+		require.Equal(t, 10.5, second.Values["dynamic:speed"].GetSum())
+		require.Equal(t, uint64(2), second.Values["dynamic:speed"].GetCount())
+	})
+
+	tests := []struct {
+		name string
+		req  *dataapiv1.AggregateTelemetryRequest
+	}{
+		{"no bucket width", request(0, []string{"dynamic:speed"}, dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_MAX)},
+		{"no functions", request(time.Hour, []string{"dynamic:speed"})},
+		{"unspecified function", request(time.Hour, []string{"dynamic:speed"}, dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_UNSPECIFIED)},
+		{"unknown function", request(time.Hour, []string{"dynamic:speed"}, dataapiv1.AggregationFunction(42))},
+		{"non-numeric values", request(time.Hour, []string{"static:make"}, dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_MAX)},
+		{"no time selector", &dataapiv1.AggregateTelemetryRequest{
+			VehicleId:   "VIN1",
+			BucketWidth: durationpb.New(time.Hour),
+			Functions:   []dataapiv1.AggregationFunction{dataapiv1.AggregationFunction_AGGREGATION_FUNCTION_MAX},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &fakeStream[dataapiv1.AggregatedPoint]{ctx: context.Background()}
+			err := srv.AggregateTelemetry(tt.req, stream)
+			require.Equal(t, codes.InvalidArgument, status.Code(err), "error: %v", err)
+		})
+	}
+}
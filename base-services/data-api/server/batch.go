@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	dataapiv1 "data-api/api/gen/dataapi/v1"
+	"data-api/store"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BatchGetTelemetryData streams the telemetry of several vehicles, each point tagged with its vehicle.
+//
+// Range queries split the vehicles into up to BatchParallelism groups that are scanned
+// concurrently, each group with a single multi-range read. 'latest' needs separate scans per
+// vehicle, so up to BatchParallelism vehicles are queried concurrently instead.
+func (s *Server) BatchGetTelemetryData(req *dataapiv1.BatchGetTelemetryDataRequest, stream dataapiv1.TelemetryDataAPI_BatchGetTelemetryDataServer) error {
+	s.log.Debug("Received BatchGetTelemetryData request",
+		zap.Any("vehicles", req.Vehicles),
+		zap.String("data_types", strings.Join(req.GetDataTypes(), "")),
+		zap.Any("time_selector", req.TimeSelector),
+	)
+
+	// 1. Validate request, calculate effective time window and resolve the vehicles
+	eff, err := computeEffectiveWindow(req, s.opt.MaxLookback)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	vehicleIds, err := s.batchVehicleIds(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+
+	// 2. Run the scans concurrently, the stream only sends one point at a time
+	var mu sync.Mutex
+	clientGone := false
+	send := func(point *dataapiv1.TelemetryPoint) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := stream.Send(point); err != nil {
+			clientGone = true
+			return err
+		}
+		return nil
+	}
+
+	g, ctx := errgroup.WithContext(stream.Context())
+	g.SetLimit(max(s.opt.BatchParallelism, 1))
+	if isLatest(req) {
+		for _, vin := range vehicleIds {
+			g.Go(func() error {
+				return s.sendTelemetryPoints(ctx, true, store.QueryOptions{
+					VehicleId: vin,
+					StartTime: eff.Start,
+					EndTime:   eff.End,
+					Columns:   req.DataTypes,
+				}, func(point *dataapiv1.TelemetryPoint) error {
+					point.VehicleId = vin
+					return send(point)
+				})
+			})
+		}
+	} else {
+		for _, group := range splitVehicles(vehicleIds, max(s.opt.BatchParallelism, 1)) {
+			g.Go(func() error {
+				return s.sendBatchTelemetryPoints(ctx, store.BatchQueryOptions{
+					VehicleIds: group,
+					StartTime:  eff.Start,
+					EndTime:    eff.End,
+					Columns:    req.DataTypes,
+				}, send)
+			})
+		}
+	}
+
+	err = g.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if clientGone {
+		return nil
+	}
+	return err
+}
+
+// Returns the sorted, distinct vehicles of the request, either listed or matching the prefix.
+func (s *Server) batchVehicleIds(ctx context.Context, req *dataapiv1.BatchGetTelemetryDataRequest) ([]string, error) {
+	switch vehicles := req.Vehicles.(type) {
+	case *dataapiv1.BatchGetTelemetryDataRequest_VehicleIds:
+		ids := slices.Clone(vehicles.VehicleIds.GetVehicleIds())
+		for _, id := range ids {
+			if id == "" || strings.Contains(id, "#") {
+				return nil, status.Error(codes.InvalidArgument, "Vehicle_ids must not be empty or contain '#'.")
+			}
+		}
+		slices.Sort(ids)
+		ids = slices.Compact(ids)
+		if len(ids) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "At least one vehicle id is needed.")
+		}
+		if len(ids) > s.opt.MaxBatchVehicles {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("At most %d vehicle ids are allowed.", s.opt.MaxBatchVehicles))
+		}
+		return ids, nil
+
+	case *dataapiv1.BatchGetTelemetryDataRequest_VehicleIdPrefix:
+		if vehicles.VehicleIdPrefix == "" || strings.Contains(vehicles.VehicleIdPrefix, "#") {
+			return nil, status.Error(codes.InvalidArgument, "Vehicle_id_prefix must not be empty or contain '#'.")
+		}
+		ids, err := s.store.ListVehicleIds(ctx, vehicles.VehicleIdPrefix, s.opt.MaxBatchVehicles+1)
+		if err != nil {
+			s.log.Error("Listing the vehicles failed", zap.Error(err))
+			return nil, status.Error(codes.Internal, "failed to list the vehicles")
+		}
+		if len(ids) > s.opt.MaxBatchVehicles {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("More than %d vehicles match the prefix.", s.opt.MaxBatchVehicles))
+		}
+		return ids, nil
+
+	default:
+		return nil, status.Error(codes.InvalidArgument, "Vehicle_ids or vehicle_id_prefix is needed.")
+	}
+}
+
+// Queries the telemetry of several vehicles in one scan and passes the points, tagged with
+// their vehicle, to send.
+func (s *Server) sendBatchTelemetryPoints(
+	ctx context.Context,
+	queryOptions store.BatchQueryOptions,
+	send func(*dataapiv1.TelemetryPoint) error,
+) error {
+	var sendErr error
+	err := s.store.QueryTelemetryBatch(ctx, queryOptions, func(r store.Row) bool {
+		point, ok := s.parseRowToTelemetryPoint(r)
+		if !ok {
+			return true // Skip malformed row and continue
+		}
+		point.VehicleId = store.VehicleIdFromRowKey(r.Key)
+
+		if sendErr = send(point); sendErr != nil {
+			return false // Client likely disconnected. Stop the scan.
+		}
+		return true
+	})
+	if sendErr != nil {
+		return sendErr
+	}
+	if err != nil {
+		s.log.Error("Query execution failed", zap.Error(err))
+		return status.Error(codes.Internal, "failed to execute query")
+	}
+	return nil
+}
+
+// Splits the sorted vehicles into at most n groups of consecutive vehicles, so the row
+// ranges of each group stay in row key order.
+func splitVehicles(vehicleIds []string, n int) [][]string {
+	size := (len(vehicleIds) + n - 1) / n
+	var groups [][]string
+	for group := range slices.Chunk(vehicleIds, max(size, 1)) {
+		groups = append(groups, group)
+	}
+	return groups
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	dataapiv1 "data-api/api/gen/dataapi/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestBatchGetTelemetryData(t *testing.T) {
+	srv, _ := newTestServer(t, map[time.Time]map[string]string{
+		testNow.Add(-30 * time.Minute): {"dynamic:speed": "10.0"},
+		testNow.Add(-10 * time.Minute): {"dynamic:speed": "11.0"},
+	})
+	write := func(vin string, ts time.Time, dataType, value string) {
+		require.NoError(t, srv.store.WriteTelemetry(context.Background(), vin, ts, map[string][]byte{dataType: []byte(value)}))
+	}
+	write("VIN10", testNow.Add(-20*time.Minute), "dynamic:speed", "20.0")
+	write("VIN2", testNow.Add(-5*time.Minute), "dynamic:speed", "30.0")
+	write("VIN2", testNow.Add(-2*time.Hour), "dynamic:speed", "31.0")
+	write("XYZ1", testNow.Add(-time.Minute), "dynamic:speed", "40.0")
+
+	vehicleIds := func(ids ...string) *dataapiv1.BatchGetTelemetryDataRequest_VehicleIds {
+		return &dataapiv1.BatchGetTelemetryDataRequest_VehicleIds{VehicleIds: &dataapiv1.VehicleIds{VehicleIds: ids}}
+	}
+	lastHour := &dataapiv1.BatchGetTelemetryDataRequest_LastDuration{LastDuration: durationpb.New(time.Hour)}
+
+	tests := []struct {
+		name     string
+		req      *dataapiv1.BatchGetTelemetryDataRequest
+		want     []string
+		wantCode codes.Code
+	}{
+		{
+			name: "vehicle ids",
+			req: &dataapiv1.BatchGetTelemetryDataRequest{
+				Vehicles:     vehicleIds("VIN2", "VIN1", "VIN10", "VIN1", "VIN3"),
+				DataTypes:    []string{"dynamic:speed"},
+				TimeSelector: lastHour,
+			},
+			want: []string{
+				"VIN1 2024-01-15T10:16:00Z dynamic:speed=10.0",
+				"VIN1 2024-01-15T10:36:00Z dynamic:speed=11.0",
+				"VIN10 2024-01-15T10:26:00Z dynamic:speed=20.0",
+				"VIN2 2024-01-15T10:41:00Z dynamic:speed=30.0",
+			},
+		},
+		{
+			name: "prefix",
+			req: &dataapiv1.BatchGetTelemetryDataRequest{
+				Vehicles:     &dataapiv1.BatchGetTelemetryDataRequest_VehicleIdPrefix{VehicleIdPrefix: "VIN1"},
+				DataTypes:    []string{"dynamic:speed"},
+				TimeSelector: lastHour,
+			},
+			want: []string{
+				"VIN1 2024-01-15T10:16:00Z dynamic:speed=10.0",
+				"VIN1 2024-01-15T10:36:00Z dynamic:speed=11.0",
+				"VIN10 2024-01-15T10:26:00Z dynamic:speed=20.0",
+			},
+		},
+		{
+			name: "latest",
+			req: &dataapiv1.BatchGetTelemetryDataRequest{
+				Vehicles:     vehicleIds("VIN1", "VIN2", "XYZ1"),
+				DataTypes:    []string{"dynamic:speed"},
+				TimeSelector: &dataapiv1.BatchGetTelemetryDataRequest_Latest{Latest: true},
+			},
+			want: []string{
+				"VIN1 2024-01-15T10:36:00Z dynamic:speed=11.0",
+				"VIN2 2024-01-15T10:41:00Z dynamic:speed=30.0",
+				"XYZ1 2024-01-15T10:45:00Z dynamic:speed=40.0",
+			},
+		},
+		{
+			name:     "missing vehicles",
+			req:      &dataapiv1.BatchGetTelemetryDataRequest{DataTypes: []string{"dynamic:speed"}, TimeSelector: lastHour},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "invalid vehicle id",
+			req:      &dataapiv1.BatchGetTelemetryDataRequest{Vehicles: vehicleIds("VIN1", "VIN1#2024"), TimeSelector: lastHour},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "too many vehicles",
+			req:      &dataapiv1.BatchGetTelemetryDataRequest{Vehicles: vehicleIds("VIN1", "VIN2", "VIN3", "VIN4", "VIN5"), TimeSelector: lastHour},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "missing time selector",
+			req:      &dataapiv1.BatchGetTelemetryDataRequest{Vehicles: vehicleIds("VIN1")},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &fakeStream[dataapiv1.TelemetryPoint]{ctx: context.Background()}
+			err := srv.BatchGetTelemetryData(tt.req, stream)
+			require.Equal(t, tt.wantCode, status.Code(err), "error: %v", err)
+			require.Equal(t, tt.want, vehiclePointStrings(stream.sent))
+		})
+	}
+
+	t.Run("more vehicles match the prefix than allowed", func(t *testing.T) {
+		write("VIN3", testNow.Add(-time.Minute), "dynamic:speed", "50.0")
+		write("VIN4", testNow.Add(-time.Minute), "dynamic:speed", "60.0")
+		stream := &fakeStream[dataapiv1.TelemetryPoint]{ctx: context.Background()}
+		err := srv.BatchGetTelemetryData(&dataapiv1.BatchGetTelemetryDataRequest{
+			Vehicles:     &dataapiv1.BatchGetTelemetryDataRequest_VehicleIdPrefix{VehicleIdPrefix: "VIN"},
+			DataTypes:    []string{"dynamic:speed"},
+			TimeSelector: lastHour,
+		}, stream)
+		require.Equal(t, codes.InvalidArgument, status.Code(err), "error: %v", err)
+	})
+}
+
+func TestBatchGetTelemetryDataClientGone(t *testing.T) {
+	srv, _ := newTestServer(t, map[time.Time]map[string]string{
+		testNow.Add(-time.Minute): {"dynamic:speed": "60.0"},
+	})
+	require.NoError(t, srv.store.WriteTelemetry(context.Background(), "VIN2", testNow.Add(-time.Minute), map[string][]byte{"dynamic:speed": []byte("70.0")}))
+
+	stream := &fakeStream[dataapiv1.TelemetryPoint]{ctx: context.Background(), sendErr: errors.New("client gone")}
+	err := srv.BatchGetTelemetryData(&dataapiv1.BatchGetTelemetryDataRequest{
+		Vehicles:     &dataapiv1.BatchGetTelemetryDataRequest_VehicleIds{VehicleIds: &dataapiv1.VehicleIds{VehicleIds: []string{"VIN1", "VIN2"}}},
+		DataTypes:    []string{"dynamic:speed"},
+		TimeSelector: &dataapiv1.BatchGetTelemetryDataRequest_LastDuration{LastDuration: durationpb.New(time.Hour)},
+	}, stream)
+	require.NoError(t, err)
+	require.Empty(t, stream.sent)
+}
+
+func TestSplitVehicles(t *testing.T) {
+	require.Equal(t, [][]string{{"A", "B"}, {"C", "D"}, {"E"}}, splitVehicles([]string{"A", "B", "C", "D", "E"}, 3))
+	require.Equal(t, [][]string{{"A"}, {"B"}}, splitVehicles([]string{"A", "B"}, 8))
+	require.Empty(t, splitVehicles(nil, 8))
+}
+
+// Like pointStrings with the vehicle in front, sorted because the vehicles are scanned concurrently.
+func vehiclePointStrings(points []*dataapiv1.TelemetryPoint) []string {
+	var out []string
+	for _, p := range points {
+		for _, s := range pointStrings([]*dataapiv1.TelemetryPoint{p}) {
+			out = append(out, p.VehicleId+" "+s)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
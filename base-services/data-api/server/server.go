@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	dataapiv1 "data-api/api/gen/dataapi/v1"
+	"data-api/live"
+	"data-api/store"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Holds default settings and options for the Server.
+type Options struct {
+	MaxLookback time.Duration
+
+	// Longest time the connector takes to store a published value. SubscribeTelemetry scans
+	// the history of this window again once it passed since the subscription started, so values
+	// that were published before but stored after the history was replayed aren't lost.
+	HandoverWindow time.Duration
+	// Number of live messages buffered per subscription, e.g. while the history is replayed.
+	// The subscription fails if the client can't keep up.
+	LiveBufferSize int
+
+	// Number of scans BatchGetTelemetryData runs concurrently per request.
+	BatchParallelism int
+	// Maximum number of vehicles of a BatchGetTelemetryData request, listed or matching the prefix.
+	MaxBatchVehicles int
+
+	// Key of the HMAC that makes the continuation tokens of GetTelemetryData tamper-evident.
+	// All replicas must share it, tokens are invalid after it changes.
+	TokenSecret []byte
+}
+
+// Server is the implementation of the TelemetryDataAPIServer.
+type Server struct {
+	dataapiv1.UnimplementedTelemetryDataAPIServer
+	log    *zap.Logger
+	store  store.TelemetryStore
+	source live.Source // nil if live telemetry is not available
+	opt    Options
+}
+
+func NewServer(log *zap.Logger, store store.TelemetryStore, source live.Source, opt Options) *Server {
+	log.Info("Server started.")
+	log.Debug("Server server started in Debug mode.")
+	return &Server{log: log, store: store, source: source, opt: opt}
+}
+
+// GetTelemetryData is the main RPC method.
+func (s *Server) GetTelemetryData(req *dataapiv1.GetTelemetryDataRequest, stream dataapiv1.TelemetryDataAPI_GetTelemetryDataServer) error {
+	ctx := stream.Context()
+	s.log.Debug("Received GetTelemetryData request",
+		zap.String("vehicle_id", req.VehicleId),
+		zap.String("data_types", strings.Join(req.GetDataTypes(), "")),
+		zap.Any("time_selector", req.TimeSelector),
+	)
+
+	// 1. Validate request and calculate effective time window
+	eff, err := computeEffectiveWindow(req, s.opt.MaxLookback)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	paged := req.PageSize > 0 || req.ContinuationToken != ""
+	if paged && isLatest(req) {
+		return status.Error(codes.InvalidArgument, "Page_size and continuation_token are not supported with latest.")
+	}
+
+	// 2. Resume after the last point of the previous page, within its window
+	queryOptions := store.QueryOptions{
+		VehicleId: req.VehicleId,
+		StartTime: eff.Start,
+		EndTime:   eff.End,
+		Columns:   req.DataTypes,
+	}
+	if req.ContinuationToken != "" {
+		cursor, err := s.parseContinuationToken(req)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		eff = cursor.window()
+		queryOptions.StartTime, queryOptions.EndTime = eff.Start, eff.End
+		queryOptions.StartAfterKey = cursor.LastKey
+	}
+
+	// 3. Query the window and stream the results to the client
+	if req.PageSize > 0 {
+		return s.sendTelemetryPage(ctx, req, eff, queryOptions, stream.Send)
+	}
+	return s.sendTelemetryPoints(ctx, isLatest(req), queryOptions, stream.Send)
+}
+
+// Streams up to PageSize points. Each point is held back until the next row is read, so the
+// last point of the page only carries a continuation token if more points follow.
+func (s *Server) sendTelemetryPage(
+	ctx context.Context,
+	req *dataapiv1.GetTelemetryDataRequest,
+	eff Window,
+	queryOptions store.QueryOptions,
+	send func(*dataapiv1.TelemetryPoint) error,
+) error {
+	var (
+		pending    *dataapiv1.TelemetryPoint
+		pendingKey string
+		sent       uint32
+		clientGone bool
+		tokenErr   error
+	)
+	err := s.store.QueryTelemetry(ctx, queryOptions, func(r store.Row) bool {
+		point, ok := s.parseRowToTelemetryPoint(r)
+		if !ok {
+			return true // Skip malformed row and continue
+		}
+
+		if pending != nil {
+			if sent+1 == req.PageSize {
+				// The page is full and more points follow.
+				pending.ContinuationToken, tokenErr = s.newContinuationToken(req, pageCursor{
+					LastKey: pendingKey,
+					Start:   eff.Start.UnixNano(),
+					End:     eff.End.UnixNano(),
+				})
+				if tokenErr != nil {
+					return false
+				}
+			}
+			if err := send(pending); err != nil {
+				clientGone = true
+				return false // Client likely disconnected. Stop the scan.
+			}
+			sent++
+			if sent == req.PageSize {
+				pending = nil
+				return false
+			}
+		}
+		pending, pendingKey = point, r.Key
+		return true
+	})
+	if tokenErr != nil {
+		s.log.Error("Creating the continuation token failed", zap.Error(tokenErr))
+		return status.Error(codes.Internal, "failed to create the continuation token")
+	}
+	if err != nil {
+		s.log.Error("Query execution failed", zap.Error(err))
+		return status.Error(codes.Internal, "failed to execute query")
+	}
+	if clientGone {
+		return nil
+	}
+
+	// The last point of the window
+	if pending != nil {
+		if err := send(pending); err != nil {
+			return nil // Client likely disconnected.
+		}
+	}
+	return nil
+}
+
+// Queries the telemetry, the latest per data type if latest is set, and passes the points to send.
+func (s *Server) sendTelemetryPoints(
+	ctx context.Context,
+	latest bool,
+	queryOptions store.QueryOptions,
+	send func(*dataapiv1.TelemetryPoint) error,
+) error {
+	// 1. Set the query method based on the time selector
+	queryMethod := s.store.QueryTelemetry
+	if latest {
+		queryMethod = s.store.QueryLatestTelemetry
+	}
+
+	// 2. Execute the selected query method with a callback that sends all results
+	err := queryMethod(
+		ctx,
+		queryOptions,
+		func(r store.Row) bool {
+			point, ok := s.parseRowToTelemetryPoint(r)
+			if !ok {
+				return true // Skip malformed row and continue
+			}
+
+			if err := send(point); err != nil {
+				return false // Client likely disconnected. Stop the scan.
+			}
+			return true // Continue scanning.
+		},
+	)
+	if err != nil {
+		// Log the error from the query method itself.
+		s.log.Error("Query execution failed", zap.Error(err))
+		return status.Error(codes.Internal, "failed to execute query")
+	}
+
+	return nil
+}
+
+// Parses Rows from the store into TelemetryPoints that are ready to be streamed to the client.
+func (s *Server) parseRowToTelemetryPoint(r store.Row) (*dataapiv1.TelemetryPoint, bool) {
+	ts, ok := store.ParseTimestampFromRowKey(r.Key)
+	if !ok {
+		s.log.Warn("Skipping malformed row key", zap.String("key", r.Key))
+		return nil, false
+	}
+
+	point := &dataapiv1.TelemetryPoint{
+		Timestamp: timestamppb.New(ts),
+		Values:    make(map[string][]byte),
+	}
+
+	// The values are keyed by "family:qualifier".
+	for column, value := range r.Values {
+		point.Values[column] = value
+	}
+
+	if len(point.Values) == 0 {
+		return nil, false
+	}
+	return point, true
+}
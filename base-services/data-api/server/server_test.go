@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	dataapiv1 "data-api/api/gen/dataapi/v1"
+	"data-api/live"
+	"data-api/store"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeStream collects the points sent by the server.
+type fakeStream[T any] struct {
+	grpc.ServerStream
+	ctx     context.Context
+	mu      sync.Mutex
+	sent    []*T
+	sendErr error
+	headers chan struct{} // closed when the headers are sent, if not nil
+	gate    chan struct{} // Send waits for it, if not nil
+}
+
+func (s *fakeStream[T]) Context() context.Context { return s.ctx }
+
+func (s *fakeStream[T]) SendHeader(metadata.MD) error {
+	if s.headers != nil {
+		close(s.headers)
+	}
+	return nil
+}
+
+func (s *fakeStream[T]) Send(m *T) error {
+	if s.gate != nil {
+		<-s.gate
+	}
+	if s.sendErr != nil {
+		return s.sendErr
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+// Returns a copy of the points sent so far.
+func (s *fakeStream[T]) sentSoFar() []*T {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*T(nil), s.sent...)
+}
+
+// testNow is the fixed time of the TEST_ENV.
+var testNow = time.Date(2024, 1, 15, 10, 46, 0, 0, time.UTC)
+
+func newTestServer(t *testing.T, rows map[time.Time]map[string]string) (*Server, *live.MemorySource) {
+	t.Helper()
+	t.Setenv("TEST_ENV", "true")
+
+	st := store.NewMemoryStore()
+	for ts, values := range rows {
+		raw := make(map[string][]byte)
+		for k, v := range values {
+			raw[k] = []byte(v)
+		}
+		require.NoError(t, st.WriteTelemetry(context.Background(), "VIN1", ts, raw))
+	}
+	source := live.NewMemorySource()
+	return NewServer(zap.NewNop(), st, source, Options{
+		MaxLookback:      365 * 24 * time.Hour,
+		HandoverWindow:   5 * time.Minute,
+		LiveBufferSize:   100,
+		BatchParallelism: 2,
+		MaxBatchVehicles: 4,
+		TokenSecret:      []byte("test-secret"),
+	}), source
+}
+
+// Flattens the points to "timestamp data_type=value" for easy comparison.
+func pointStrings(points []*dataapiv1.TelemetryPoint) []string {
+	var out []string
+	for _, p := range points {
+		for k, v := range p.Values {
+			out = append(out, p.Timestamp.AsTime().Format(time.RFC3339)+" "+k+"="+string(v))
+		}
+	}
+	return out
+}
+
+func TestGetTelemetryData(t *testing.T) {
+	srv, _ := newTestServer(t, map[time.Time]map[string]string{
+		testNow.Add(-2 * time.Hour):    {"dynamic:speed": "60.0"},
+		testNow.Add(-30 * time.Minute): {"dynamic:speed": "70.0", "static:make": "Ford"},
+		testNow.Add(-10 * time.Minute): {"dynamic:location.lat": "52.52"},
+		testNow.Add(time.Hour):         {"dynamic:speed": "99.0"}, // in the future
+	})
+
+	tests := []struct {
+		name     string
+		req      *dataapiv1.GetTelemetryDataRequest
+		want     []string
+		wantCode codes.Code
+	}{
+		{
+			name: "last duration",
+			req: &dataapiv1.GetTelemetryDataRequest{
+				VehicleId:    "VIN1",
+				DataTypes:    []string{"dynamic:speed"},
+				TimeSelector: &dataapiv1.GetTelemetryDataRequest_LastDuration{LastDuration: durationpb.New(time.Hour)},
+			},
+			want: []string{"2024-01-15T10:16:00Z dynamic:speed=70.0"},
+		},
+		{
+			name: "time range",
+			req: &dataapiv1.GetTelemetryDataRequest{
+				VehicleId: "VIN1",
+				DataTypes: []string{"dynamic:speed", "dynamic:location.lat"},
+				TimeSelector: &dataapiv1.GetTelemetryDataRequest_TimeRange{TimeRange: &dataapiv1.TimeRange{
+					Start: timestamppb.New(testNow.Add(-3 * time.Hour)),
+					End:   timestamppb.New(testNow.Add(2 * time.Hour)),
+				}},
+			},
+			want: []string{
+				"2024-01-15T08:46:00Z dynamic:speed=60.0",
+				"2024-01-15T10:16:00Z dynamic:speed=70.0",
+				"2024-01-15T10:36:00Z dynamic:location.lat=52.52",
+			},
+		},
+		{
+			name: "latest",
+			req: &dataapiv1.GetTelemetryDataRequest{
+				VehicleId:    "VIN1",
+				DataTypes:    []string{"static:make", "dynamic:speed"},
+				TimeSelector: &dataapiv1.GetTelemetryDataRequest_Latest{Latest: true},
+			},
+			want: []string{
+				"2024-01-15T10:16:00Z static:make=Ford",
+				"2024-01-15T10:16:00Z dynamic:speed=70.0",
+			},
+		},
+		{
+			name: "unknown vehicle",
+			req: &dataapiv1.GetTelemetryDataRequest{
+				VehicleId:    "VIN2",
+				DataTypes:    []string{"dynamic:speed"},
+				TimeSelector: &dataapiv1.GetTelemetryDataRequest_Latest{Latest: true},
+			},
+		},
+		{
+			name:     "missing time selector",
+			req:      &dataapiv1.GetTelemetryDataRequest{VehicleId: "VIN1", DataTypes: []string{"dynamic:speed"}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "negative duration",
+			req: &dataapiv1.GetTelemetryDataRequest{
+				VehicleId:    "VIN1",
+				TimeSelector: &dataapiv1.GetTelemetryDataRequest_LastDuration{LastDuration: durationpb.New(-time.Hour)},
+			},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &fakeStream[dataapiv1.TelemetryPoint]{ctx: context.Background()}
+			err := srv.GetTelemetryData(tt.req, stream)
+			require.Equal(t, tt.wantCode, status.Code(err), "error: %v", err)
+			require.Equal(t, tt.want, pointStrings(stream.sent))
+		})
+	}
+}
+
+func TestGetTelemetryDataClientGone(t *testing.T) {
+	srv, _ := newTestServer(t, map[time.Time]map[string]string{
+		testNow.Add(-2 * time.Minute): {"dynamic:speed": "60.0"},
+		testNow.Add(-time.Minute):     {"dynamic:speed": "70.0"},
+	})
+
+	stream := &fakeStream[dataapiv1.TelemetryPoint]{ctx: context.Background(), sendErr: errors.New("client gone")}
+	err := srv.GetTelemetryData(&dataapiv1.GetTelemetryDataRequest{
+		VehicleId:    "VIN1",
+		DataTypes:    []string{"dynamic:speed"},
+		TimeSelector: &dataapiv1.GetTelemetryDataRequest_LastDuration{LastDuration: durationpb.New(time.Hour)},
+	}, stream)
+	require.NoError(t, err)
+	require.Empty(t, stream.sent)
+}
+
+func TestGetTelemetryDataPages(t *testing.T) {
+	rows := make(map[time.Time]map[string]string)
+	for i := range 5 {
+		rows[testNow.Add(time.Duration(i-5)*time.Minute)] = map[string]string{"dynamic:speed": strconv.Itoa(i)}
+	}
+	srv, _ := newTestServer(t, rows)
+
+	req := &dataapiv1.GetTelemetryDataRequest{
+		VehicleId:    "VIN1",
+		DataTypes:    []string{"dynamic:speed"},
+		TimeSelector: &dataapiv1.GetTelemetryDataRequest_LastDuration{LastDuration: durationpb.New(time.Hour)},
+		PageSize:     2,
+	}
+	var pages [][]string
+	for {
+		stream := &fakeStream[dataapiv1.TelemetryPoint]{ctx: context.Background()}
+		require.NoError(t, srv.GetTelemetryData(req, stream))
+		pages = append(pages, pointStrings(stream.sent))
+
+		// Only the last point of a page carries the token
+		for _, point := range stream.sent[:len(stream.sent)-1] {
+			require.Empty(t, point.ContinuationToken)
+		}
+		token := stream.sent[len(stream.sent)-1].ContinuationToken
+		if token == "" {
+			break
+		}
+		req.ContinuationToken = token
+	}
+	require.Equal(t, [][]string{
+		{"2024-01-15T10:41:00Z dynamic:speed=0", "2024-01-15T10:42:00Z dynamic:speed=1"},
+		{"2024-01-15T10:43:00Z dynamic:speed=2", "2024-01-15T10:44:00Z dynamic:speed=3"},
+		{"2024-01-15T10:45:00Z dynamic:speed=4"},
+	}, pages)
+
+	t.Run("the rest without page size", func(t *testing.T) {
+		req.PageSize = 4
+		req.ContinuationToken = ""
+		stream := &fakeStream[dataapiv1.TelemetryPoint]{ctx: context.Background()}
+		require.NoError(t, srv.GetTelemetryData(req, stream))
+		require.NotEmpty(t, stream.sent[3].ContinuationToken)
+
+		req.PageSize = 0
+		req.ContinuationToken = stream.sent[3].ContinuationToken
+		stream = &fakeStream[dataapiv1.TelemetryPoint]{ctx: context.Background()}
+		require.NoError(t, srv.GetTelemetryData(req, stream))
+		require.Equal(t, []string{"2024-01-15T10:45:00Z dynamic:speed=4"}, pointStrings(stream.sent))
+	})
+
+	t.Run("latest", func(t *testing.T) {
+		stream := &fakeStream[dataapiv1.TelemetryPoint]{ctx: context.Background()}
+		err := srv.GetTelemetryData(&dataapiv1.GetTelemetryDataRequest{
+			VehicleId:    "VIN1",
+			DataTypes:    []string{"dynamic:speed"},
+			TimeSelector: &dataapiv1.GetTelemetryDataRequest_Latest{Latest: true},
+			PageSize:     2,
+		}, stream)
+		require.Equal(t, codes.InvalidArgument, status.Code(err), "error: %v", err)
+	})
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	dataapiv1 "data-api/api/gen/dataapi/v1"
+	"data-api/api/gen/telemetry"
+	"data-api/live"
+	"data-api/store"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Identifies a value for the deduplication of the handover from history to live telemetry.
+type valueKey struct {
+	ts     int64 // Unix nanoseconds
+	column string
+}
+
+// SubscribeTelemetry replays the history of the time selector and continues with the live telemetry.
+//
+// The live subscription starts before the history is queried, so values that arrive meanwhile
+// are buffered instead of lost. Values that were published before the subscription but written
+// to the store only after the history was queried are caught by a second scan of the handover
+// window, once HandoverWindow passed since the subscription started. Sent values are remembered
+// and skipped when they arrive live or by the second scan, so a value isn't sent twice as long
+// as the connector writes it within HandoverWindow.
+func (s *Server) SubscribeTelemetry(req *dataapiv1.SubscribeTelemetryRequest, stream dataapiv1.TelemetryDataAPI_SubscribeTelemetryServer) error {
+	ctx := stream.Context()
+	s.log.Debug("Received SubscribeTelemetry request",
+		zap.String("vehicle_id", req.VehicleId),
+		zap.String("data_types", strings.Join(req.GetDataTypes(), "")),
+		zap.Any("time_selector", req.TimeSelector),
+	)
+
+	// 1. Validate request and calculate the history window
+	if s.source == nil {
+		return status.Error(codes.Unavailable, "live telemetry is not available")
+	}
+	if !live.IsValidVehicleId(req.VehicleId) {
+		return status.Error(codes.InvalidArgument, "Vehicle_id must not be empty or contain '.', '*', '>' or whitespace.")
+	}
+	history := historyRequest(req)
+	var eff Window
+	if history != nil {
+		var err error
+		if eff, err = computeEffectiveWindow(history, s.opt.MaxLookback); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	// 2. Subscribe before the history is queried
+	subscribed := time.Now()
+	messages := make(chan *telemetry.TelemetryMessage, s.opt.LiveBufferSize)
+	overflow := make(chan struct{})
+	var overflowOnce sync.Once
+	sub, err := s.source.Subscribe(req.VehicleId, func(msg *telemetry.TelemetryMessage) {
+		select {
+		case messages <- msg:
+		default:
+			overflowOnce.Do(func() { close(overflow) })
+		}
+	})
+	if err != nil {
+		s.log.Error("Live subscription failed", zap.Error(err))
+		return status.Error(codes.Unavailable, "failed to subscribe to live telemetry")
+	}
+	defer sub.Unsubscribe()
+
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return nil // Client likely disconnected.
+	}
+
+	// 3. Replay the history and remember what was sent
+	sent := make(map[valueKey]bool)
+	// newest is the timestamp of the newest sent value per column, only kept for 'latest',
+	// so the second scan of the handover window doesn't send older values.
+	var newest map[string]time.Time
+	remember := history != nil
+	send := func(point *dataapiv1.TelemetryPoint) error {
+		if remember {
+			ts := point.Timestamp.AsTime()
+			for column := range point.Values {
+				sent[valueKey{ts: ts.UnixNano(), column: column}] = true
+				if newest != nil && ts.After(newest[column]) {
+					newest[column] = ts
+				}
+			}
+		}
+		return stream.Send(point)
+	}
+	var rescan <-chan time.Time
+	if history != nil {
+		if isLatest(history) {
+			newest = make(map[string]time.Time)
+		}
+		err := s.sendTelemetryPoints(ctx, isLatest(history), store.QueryOptions{
+			VehicleId: req.VehicleId,
+			StartTime: eff.Start,
+			EndTime:   eff.End,
+			Columns:   req.DataTypes,
+		}, send)
+		if err != nil {
+			return err
+		}
+
+		timer := time.NewTimer(s.opt.HandoverWindow - time.Since(subscribed))
+		defer timer.Stop()
+		rescan = timer.C
+	}
+
+	// 4. Continue with the live telemetry until the client is gone
+	columns := make(map[string]bool)
+	for _, dataType := range req.DataTypes {
+		if _, _, ok := store.SplitDataType(dataType); ok {
+			columns[dataType] = true
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-overflow:
+			s.log.Warn("Live subscription overflowed", zap.String("vehicle_id", req.VehicleId))
+			return status.Error(codes.ResourceExhausted, "the client can't keep up with the live telemetry")
+		case <-rescan:
+			// Values published before the subscription are stored by now, send the ones the
+			// history missed. Later live values don't need to be remembered.
+			rescan = nil
+			handoverStart := eff.End.Add(-s.opt.HandoverWindow)
+			if handoverStart.Before(eff.Start) {
+				handoverStart = eff.Start
+			}
+			err := s.sendTelemetryPoints(ctx, false, store.QueryOptions{
+				VehicleId: req.VehicleId,
+				StartTime: handoverStart,
+				EndTime:   now(),
+				Columns:   req.DataTypes,
+			}, func(point *dataapiv1.TelemetryPoint) error {
+				if point = unsentValues(point, sent, newest); point == nil {
+					return nil
+				}
+				return send(point)
+			})
+			if err != nil {
+				return err
+			}
+			remember = false
+		case msg := <-messages:
+			for _, point := range liveTelemetryPoints(msg, columns, sent) {
+				if err := send(point); err != nil {
+					return nil // Client likely disconnected.
+				}
+			}
+		}
+	}
+}
+
+// Converts the subscription's time selector to the GetTelemetryData request of its history,
+// nil if no history is requested.
+func historyRequest(req *dataapiv1.SubscribeTelemetryRequest) *dataapiv1.GetTelemetryDataRequest {
+	history := &dataapiv1.GetTelemetryDataRequest{VehicleId: req.VehicleId, DataTypes: req.DataTypes}
+	switch selector := req.TimeSelector.(type) {
+	case *dataapiv1.SubscribeTelemetryRequest_Latest:
+		history.TimeSelector = &dataapiv1.GetTelemetryDataRequest_Latest{Latest: selector.Latest}
+	case *dataapiv1.SubscribeTelemetryRequest_LastDuration:
+		history.TimeSelector = &dataapiv1.GetTelemetryDataRequest_LastDuration{LastDuration: selector.LastDuration}
+	case *dataapiv1.SubscribeTelemetryRequest_Since:
+		// The end is capped to now by computeEffectiveWindow
+		history.TimeSelector = &dataapiv1.GetTelemetryDataRequest_TimeRange{TimeRange: &dataapiv1.TimeRange{
+			Start: selector.Since,
+			End:   timestamppb.New(now()),
+		}}
+	default:
+		return nil
+	}
+	return history
+}
+
+// Reduces the point to the values that weren't sent yet. With newest, values that aren't newer
+// than the newest sent value of their column are dropped as well. Nil if nothing is left.
+func unsentValues(point *dataapiv1.TelemetryPoint, sent map[valueKey]bool, newest map[string]time.Time) *dataapiv1.TelemetryPoint {
+	ts := point.Timestamp.AsTime()
+	for column := range point.Values {
+		if sent[valueKey{ts: ts.UnixNano(), column: column}] {
+			delete(point.Values, column)
+		} else if sentTs, ok := newest[column]; ok && !ts.After(sentTs) {
+			delete(point.Values, column)
+		}
+	}
+	if len(point.Values) == 0 {
+		return nil
+	}
+	return point
+}
+
+// Groups the readings of the requested columns by timestamp into points, like the rows the
+// connector stores them in. Values that were already sent are skipped.
+func liveTelemetryPoints(msg *telemetry.TelemetryMessage, columns map[string]bool, sent map[valueKey]bool) []*dataapiv1.TelemetryPoint {
+	var points []*dataapiv1.TelemetryPoint
+	byTime := make(map[int64]*dataapiv1.TelemetryPoint)
+	for _, reading := range msg.SensorData {
+		column := live.Column(reading)
+		if !columns[column] || reading.Timestamp == nil {
+			continue
+		}
+		ts := reading.Timestamp.AsTime()
+		if sent[valueKey{ts: ts.UnixNano(), column: column}] {
+			continue
+		}
+
+		point, ok := byTime[ts.UnixNano()]
+		if !ok {
+			point = &dataapiv1.TelemetryPoint{
+				Timestamp: timestamppb.New(ts),
+				Values:    make(map[string][]byte),
+			}
+			byTime[ts.UnixNano()] = point
+			points = append(points, point)
+		}
+		point.Values[column] = []byte(reading.Value)
+	}
+	return points
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dataapiv1 "data-api/api/gen/dataapi/v1"
+	"data-api/api/gen/telemetry"
+	"data-api/store"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func reading(ts time.Time, dataType telemetry.DataType, sensor, value string) *telemetry.SensorReading {
+	return &telemetry.SensorReading{Timestamp: timestamppb.New(ts), DataType: dataType, Sensor: sensor, Value: value}
+}
+
+// Starts the subscription in the background and waits until it's active.
+// The subscription ends with the error on done, e.g. after cancel.
+func subscribe(t *testing.T, srv *Server, req *dataapiv1.SubscribeTelemetryRequest, stream *fakeStream[dataapiv1.TelemetryPoint]) (cancel context.CancelFunc, done <-chan error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream.ctx = ctx
+	stream.headers = make(chan struct{})
+
+	result := make(chan error, 1)
+	go func() { result <- srv.SubscribeTelemetry(req, stream) }()
+
+	select {
+	case <-stream.headers:
+	case err := <-result:
+		t.Fatalf("subscription ended before it was active: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription not active")
+	}
+	return cancel, result
+}
+
+func TestSubscribeTelemetry(t *testing.T) {
+	srv, source := newTestServer(t, map[time.Time]map[string]string{
+		testNow.Add(-2 * time.Hour):    {"dynamic:speed": "50.0"},
+		testNow.Add(-46 * time.Minute): {"dynamic:speed": "60.0"},
+		testNow.Add(-30 * time.Second): {"dynamic:speed": "70.0", "static:make": "Ford"},
+		testNow.Add(-10 * time.Second): {"static:make": "Ford"},
+	})
+
+	stream := &fakeStream[dataapiv1.TelemetryPoint]{}
+	cancel, done := subscribe(t, srv, &dataapiv1.SubscribeTelemetryRequest{
+		VehicleId:    "VIN1",
+		DataTypes:    []string{"dynamic:speed", "dynamic:location.lat"},
+		TimeSelector: &dataapiv1.SubscribeTelemetryRequest_LastDuration{LastDuration: durationpb.New(time.Hour)},
+	}, stream)
+
+	source.Publish(&telemetry.TelemetryMessage{DeviceId: "VIN1", SensorData: []*telemetry.SensorReading{
+		reading(testNow.Add(-30*time.Second), telemetry.DataType_DYNAMIC, "speed", "70.0"), // already sent with the history
+		reading(testNow.Add(time.Minute), telemetry.DataType_DYNAMIC, "speed", "75.0"),
+		reading(testNow.Add(time.Minute), telemetry.DataType_DYNAMIC, "location.lat", "52.52"),
+		reading(testNow.Add(time.Minute), telemetry.DataType_STATIC, "make", "Ford"), // not requested
+	}})
+	source.Publish(&telemetry.TelemetryMessage{DeviceId: "VIN2", SensorData: []*telemetry.SensorReading{
+		reading(testNow.Add(time.Minute), telemetry.DataType_DYNAMIC, "speed", "99.0"), // other vehicle
+	}})
+	source.Publish(&telemetry.TelemetryMessage{DeviceId: "VIN1", SensorData: []*telemetry.SensorReading{
+		reading(testNow.Add(2*time.Minute), telemetry.DataType_DYNAMIC, "speed", "80.0"),
+	}})
+
+	require.Eventually(t, func() bool { return len(stream.sentSoFar()) >= 4 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	sent := stream.sentSoFar()
+	require.Len(t, sent, 4)
+	require.Equal(t, []string{"2024-01-15T10:00:00Z dynamic:speed=60.0"}, pointStrings(sent[0:1]))
+	require.Equal(t, []string{"2024-01-15T10:45:30Z dynamic:speed=70.0"}, pointStrings(sent[1:2]))
+	require.ElementsMatch(t, []string{"2024-01-15T10:47:00Z dynamic:speed=75.0", "2024-01-15T10:47:00Z dynamic:location.lat=52.52"}, pointStrings(sent[2:3]))
+	require.Equal(t, []string{"2024-01-15T10:48:00Z dynamic:speed=80.0"}, pointStrings(sent[3:4]))
+}
+
+func TestSubscribeTelemetryHandover(t *testing.T) {
+	srv, source := newTestServer(t, map[time.Time]map[string]string{
+		testNow.Add(-2 * time.Hour):         {"dynamic:speed": "50.0"},
+		testNow.Add(-50 * time.Millisecond): {"dynamic:speed": "60.0"},
+	})
+	srv.opt.HandoverWindow = 100 * time.Millisecond
+
+	// The history is queried before the gate opens, the value stored meanwhile is only found by the second scan
+	stream := &fakeStream[dataapiv1.TelemetryPoint]{gate: make(chan struct{})}
+	cancel, done := subscribe(t, srv, &dataapiv1.SubscribeTelemetryRequest{
+		VehicleId:    "VIN1",
+		DataTypes:    []string{"dynamic:speed"},
+		TimeSelector: &dataapiv1.SubscribeTelemetryRequest_LastDuration{LastDuration: durationpb.New(3 * time.Hour)},
+	}, stream)
+	require.NoError(t, srv.store.(*store.MemoryStore).WriteTelemetry(context.Background(), "VIN1",
+		testNow.Add(-20*time.Millisecond), map[string][]byte{"dynamic:speed": []byte("65.0")}))
+	source.Publish(&telemetry.TelemetryMessage{DeviceId: "VIN1", SensorData: []*telemetry.SensorReading{
+		reading(testNow.Add(-2*time.Hour), telemetry.DataType_DYNAMIC, "speed", "50.0"), // late, already sent with the history
+		reading(testNow.Add(time.Minute), telemetry.DataType_DYNAMIC, "speed", "80.0"),
+	}})
+	close(stream.gate)
+
+	require.Eventually(t, func() bool { return len(stream.sentSoFar()) >= 4 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	require.ElementsMatch(t, []string{
+		"2024-01-15T08:46:00Z dynamic:speed=50.0",
+		"2024-01-15T10:45:59Z dynamic:speed=60.0",
+		"2024-01-15T10:45:59Z dynamic:speed=65.0",
+		"2024-01-15T10:47:00Z dynamic:speed=80.0",
+	}, pointStrings(stream.sentSoFar()))
+}
+
+func TestUnsentValues(t *testing.T) {
+	ts := testNow.Add(-time.Minute)
+	point := func() *dataapiv1.TelemetryPoint {
+		return &dataapiv1.TelemetryPoint{Timestamp: timestamppb.New(ts), Values: map[string][]byte{
+			"dynamic:speed":        []byte("60.0"),
+			"dynamic:location.lat": []byte("52.52"),
+		}}
+	}
+	sent := map[valueKey]bool{{ts: ts.UnixNano(), column: "dynamic:speed"}: true}
+
+	require.Equal(t, []string{"2024-01-15T10:45:00Z dynamic:location.lat=52.52"}, pointStrings([]*dataapiv1.TelemetryPoint{unsentValues(point(), sent, nil)}))
+	// For 'latest', values that aren't newer than the sent ones are dropped
+	require.Nil(t, unsentValues(point(), sent, map[string]time.Time{"dynamic:location.lat": ts}))
+	require.NotNil(t, unsentValues(point(), sent, map[string]time.Time{"dynamic:location.lat": ts.Add(-time.Second)}))
+}
+
+func TestSubscribeTelemetryLatest(t *testing.T) {
+	srv, source := newTestServer(t, map[time.Time]map[string]string{
+		testNow.Add(-2 * time.Hour):   {"dynamic:speed": "50.0"},
+		testNow.Add(-1 * time.Hour):   {"dynamic:speed": "60.0"},
+		testNow.Add(-1 * time.Minute): {"static:make": "Ford"},
+	})
+
+	stream := &fakeStream[dataapiv1.TelemetryPoint]{}
+	cancel, done := subscribe(t, srv, &dataapiv1.SubscribeTelemetryRequest{
+		VehicleId:    "VIN1",
+		DataTypes:    []string{"dynamic:speed", "static:make"},
+		TimeSelector: &dataapiv1.SubscribeTelemetryRequest_Latest{Latest: true},
+	}, stream)
+	source.Publish(&telemetry.TelemetryMessage{DeviceId: "VIN1", SensorData: []*telemetry.SensorReading{
+		reading(testNow.Add(time.Minute), telemetry.DataType_DYNAMIC, "speed", "70.0"),
+	}})
+
+	require.Eventually(t, func() bool { return len(stream.sentSoFar()) >= 3 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	require.Equal(t, []string{
+		"2024-01-15T09:46:00Z dynamic:speed=60.0",
+		"2024-01-15T10:45:00Z static:make=Ford",
+		"2024-01-15T10:47:00Z dynamic:speed=70.0",
+	}, pointStrings(stream.sentSoFar()))
+}
+
+func TestSubscribeTelemetryWithoutHistory(t *testing.T) {
+	srv, source := newTestServer(t, map[time.Time]map[string]string{
+		testNow.Add(-time.Minute): {"dynamic:speed": "60.0"},
+	})
+
+	stream := &fakeStream[dataapiv1.TelemetryPoint]{}
+	cancel, done := subscribe(t, srv, &dataapiv1.SubscribeTelemetryRequest{
+		VehicleId: "VIN1",
+		DataTypes: []string{"dynamic:speed"},
+	}, stream)
+	source.Publish(&telemetry.TelemetryMessage{DeviceId: "VIN1", SensorData: []*telemetry.SensorReading{
+		reading(testNow.Add(time.Minute), telemetry.DataType_DYNAMIC, "speed", "70.0"),
+	}})
+
+	require.Eventually(t, func() bool { return len(stream.sentSoFar()) >= 1 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	require.Equal(t, []string{"2024-01-15T10:47:00Z dynamic:speed=70.0"}, pointStrings(stream.sentSoFar()))
+}
+
+func TestSubscribeTelemetryOverflow(t *testing.T) {
+	srv, source := newTestServer(t, map[time.Time]map[string]string{
+		testNow.Add(-time.Minute): {"dynamic:speed": "60.0"},
+	})
+	srv.opt.LiveBufferSize = 1
+
+	// The history point blocks until the gate opens, meanwhile the live messages overflow the buffer
+	stream := &fakeStream[dataapiv1.TelemetryPoint]{gate: make(chan struct{})}
+	_, done := subscribe(t, srv, &dataapiv1.SubscribeTelemetryRequest{
+		VehicleId:    "VIN1",
+		DataTypes:    []string{"dynamic:speed"},
+		TimeSelector: &dataapiv1.SubscribeTelemetryRequest_Latest{Latest: true},
+	}, stream)
+	for i := range 3 {
+		source.Publish(&telemetry.TelemetryMessage{DeviceId: "VIN1", SensorData: []*telemetry.SensorReading{
+			reading(testNow.Add(time.Duration(i)*time.Second), telemetry.DataType_DYNAMIC, "speed", "70.0"),
+		}})
+	}
+	close(stream.gate)
+
+	require.Equal(t, codes.ResourceExhausted, status.Code(<-done))
+}
+
+func TestSubscribeTelemetryInvalid(t *testing.T) {
+	srv, _ := newTestServer(t, nil)
+	withoutSource := NewServer(zap.NewNop(), store.NewMemoryStore(), nil, Options{})
+
+	tests := []struct {
+		name     string
+		srv      *Server
+		req      *dataapiv1.SubscribeTelemetryRequest
+		wantCode codes.Code
+	}{
+		{"wildcard vehicle", srv, &dataapiv1.SubscribeTelemetryRequest{VehicleId: "*"}, codes.InvalidArgument},
+		{"vehicle with subject tokens", srv, &dataapiv1.SubscribeTelemetryRequest{VehicleId: "VIN1.>"}, codes.InvalidArgument},
+		{"empty vehicle", srv, &dataapiv1.SubscribeTelemetryRequest{}, codes.InvalidArgument},
+		{"negative duration", srv, &dataapiv1.SubscribeTelemetryRequest{
+			VehicleId:    "VIN1",
+			TimeSelector: &dataapiv1.SubscribeTelemetryRequest_LastDuration{LastDuration: durationpb.New(-time.Hour)},
+		}, codes.InvalidArgument},
+		{"no live telemetry", withoutSource, &dataapiv1.SubscribeTelemetryRequest{VehicleId: "VIN1"}, codes.Unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &fakeStream[dataapiv1.TelemetryPoint]{ctx: context.Background()}
+			err := tt.srv.SubscribeTelemetry(tt.req, stream)
+			require.Equal(t, tt.wantCode, status.Code(err), "error: %v", err)
+		})
+	}
+}
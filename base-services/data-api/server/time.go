@@ -1,38 +1,60 @@
-package main
+package server
 
 import (
 	dataapiv1 "data-api/api/gen/dataapi/v1"
 	"fmt"
 	"os"
 	"time"
-)
 
-const TimestampFormat = "2006-01-02T15:04:05.000000000Z07:00" // magic timestamp that defines the format consistently
+	"google.golang.org/protobuf/types/known/durationpb"
+)
 
 type Window struct {
 	Start, End time.Time
 }
 
-func computeEffectiveWindow(
-	req *dataapiv1.GetTelemetryDataRequest,
-	maxLookback time.Duration,
-) (Window, error) {
-	now := time.Now().UTC()
-
+func now() time.Time {
 	// --- If we are in a test environment, set "now" to a fixed date. ---
 	if os.Getenv("TEST_ENV") == "true" {
-		now = time.Date(2024, 1, 15, 10, 46, 0, 0, time.UTC)
+		return time.Date(2024, 1, 15, 10, 46, 0, 0, time.UTC)
+	}
+	return time.Now().UTC()
+}
+
+// The time selector shared by the requests, implemented by the generated request messages.
+type timeSelector interface {
+	GetLastDuration() *durationpb.Duration
+	GetTimeRange() *dataapiv1.TimeRange
+}
+
+// Only GetTelemetryData and BatchGetTelemetryData support 'latest'.
+func isLatest(req timeSelector) bool {
+	switch r := req.(type) {
+	case *dataapiv1.GetTelemetryDataRequest:
+		_, latest := r.GetTimeSelector().(*dataapiv1.GetTelemetryDataRequest_Latest)
+		return latest
+	case *dataapiv1.BatchGetTelemetryDataRequest:
+		_, latest := r.GetTimeSelector().(*dataapiv1.BatchGetTelemetryDataRequest_Latest)
+		return latest
+	default:
+		return false
 	}
+}
 
+func computeEffectiveWindow(
+	req timeSelector,
+	maxLookback time.Duration,
+) (Window, error) {
+	now := now()
 	capStart := now.Add(-maxLookback)
 
-	switch selector := req.TimeSelector.(type) {
-	case *dataapiv1.GetTelemetryDataRequest_Latest:
+	switch {
+	case isLatest(req):
 		// For 'latest' we set the window between 1970 and the current time
 		return Window{Start: time.Unix(0, 0), End: now}, nil
 
-	case *dataapiv1.GetTelemetryDataRequest_LastDuration:
-		d := selector.LastDuration.AsDuration()
+	case req.GetLastDuration() != nil:
+		d := req.GetLastDuration().AsDuration()
 		if d <= 0 {
 			return Window{}, fmt.Errorf("Last_duration must be positive.")
 		}
@@ -43,9 +65,9 @@ func computeEffectiveWindow(
 		// For 'LastDuration' we set the window between the queried time and the current time.
 		return Window{Start: start, End: now}, nil
 
-	case *dataapiv1.GetTelemetryDataRequest_TimeRange:
-		start := selector.TimeRange.Start.AsTime()
-		end := selector.TimeRange.End.AsTime()
+	case req.GetTimeRange() != nil:
+		start := req.GetTimeRange().GetStart().AsTime()
+		end := req.GetTimeRange().GetEnd().AsTime()
 		if end.Before(start) {
 			return Window{}, fmt.Errorf("Time range End cannot be before Start.")
 		}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	dataapiv1 "data-api/api/gen/dataapi/v1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var errInvalidToken = errors.New("Invalid continuation token.")
+
+// The position of a paged GetTelemetryData stream, carried by its continuation tokens.
+type pageCursor struct {
+	LastKey string `json:"k"` // Row key of the last point sent
+	Start   int64  `json:"s"` // Effective window of the first request in Unix nanoseconds
+	End     int64  `json:"e"`
+}
+
+// Encodes the cursor as "<payload>.<signature>", both base64url. The HMAC signature covers
+// the payload and the request parameters, so the token can't be altered or used for
+// another request.
+func (s *Server) newContinuationToken(req *dataapiv1.GetTelemetryDataRequest, cursor pageCursor) (string, error) {
+	payload, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	signature, err := s.signToken(req, payload)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verifies the continuation token of the request and returns its cursor.
+func (s *Server) parseContinuationToken(req *dataapiv1.GetTelemetryDataRequest) (pageCursor, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(req.ContinuationToken, ".")
+	if !ok {
+		return pageCursor{}, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return pageCursor{}, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return pageCursor{}, errInvalidToken
+	}
+	expected, err := s.signToken(req, payload)
+	if err != nil || !hmac.Equal(signature, expected) {
+		return pageCursor{}, errInvalidToken
+	}
+
+	var cursor pageCursor
+	if err := json.Unmarshal(payload, &cursor); err != nil {
+		return pageCursor{}, errInvalidToken
+	}
+	return cursor, nil
+}
+
+// Computes the HMAC of the payload and the request without its paging parameters.
+func (s *Server) signToken(req *dataapiv1.GetTelemetryDataRequest, payload []byte) ([]byte, error) {
+	params := proto.Clone(req).(*dataapiv1.GetTelemetryDataRequest)
+	params.PageSize = 0
+	params.ContinuationToken = ""
+	binding, err := proto.MarshalOptions{Deterministic: true}.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	paramsHash := sha256.Sum256(binding)
+
+	mac := hmac.New(sha256.New, s.opt.TokenSecret)
+	mac.Write(paramsHash[:])
+	mac.Write(payload)
+	return mac.Sum(nil), nil
+}
+
+// Returns the effective window the cursor was created for.
+func (c pageCursor) window() Window {
+	return Window{Start: time.Unix(0, c.Start).UTC(), End: time.Unix(0, c.End).UTC()}
+}
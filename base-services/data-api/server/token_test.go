@@ -0,0 +1,71 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	dataapiv1 "data-api/api/gen/dataapi/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestContinuationToken(t *testing.T) {
+	srv := &Server{opt: Options{TokenSecret: []byte("secret")}}
+	req := &dataapiv1.GetTelemetryDataRequest{
+		VehicleId:    "VIN1",
+		DataTypes:    []string{"dynamic:speed"},
+		TimeSelector: &dataapiv1.GetTelemetryDataRequest_LastDuration{LastDuration: durationpb.New(time.Hour)},
+		PageSize:     10,
+	}
+	cursor := pageCursor{LastKey: "VIN1#2024-01-15T10:00:00.000000000Z", Start: 1, End: 2}
+	token, err := srv.newContinuationToken(req, cursor)
+	require.NoError(t, err)
+
+	resumed := func(modify func(r *dataapiv1.GetTelemetryDataRequest)) *dataapiv1.GetTelemetryDataRequest {
+		r := proto.Clone(req).(*dataapiv1.GetTelemetryDataRequest)
+		r.ContinuationToken = token
+		modify(r)
+		return r
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		// The page size may change between pages
+		parsed, err := srv.parseContinuationToken(resumed(func(r *dataapiv1.GetTelemetryDataRequest) { r.PageSize = 5 }))
+		require.NoError(t, err)
+		require.Equal(t, cursor, parsed)
+	})
+
+	t.Run("other request", func(t *testing.T) {
+		for name, modify := range map[string]func(r *dataapiv1.GetTelemetryDataRequest){
+			"vehicle":    func(r *dataapiv1.GetTelemetryDataRequest) { r.VehicleId = "VIN2" },
+			"data types": func(r *dataapiv1.GetTelemetryDataRequest) { r.DataTypes = append(r.DataTypes, "static:make") },
+			"time selector": func(r *dataapiv1.GetTelemetryDataRequest) {
+				r.TimeSelector = &dataapiv1.GetTelemetryDataRequest_LastDuration{LastDuration: durationpb.New(2 * time.Hour)}
+			},
+		} {
+			_, err := srv.parseContinuationToken(resumed(modify))
+			require.ErrorIs(t, err, errInvalidToken, name)
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		other, err := srv.newContinuationToken(req, pageCursor{LastKey: "VIN1#2024-01-15T11:00:00.000000000Z", Start: 1, End: 2})
+		require.NoError(t, err)
+		payload, _, _ := strings.Cut(other, ".")
+		_, signature, _ := strings.Cut(token, ".")
+
+		for _, tampered := range []string{payload + "." + signature, token + "x", "garbage", ""} {
+			_, err := srv.parseContinuationToken(resumed(func(r *dataapiv1.GetTelemetryDataRequest) { r.ContinuationToken = tampered }))
+			require.ErrorIs(t, err, errInvalidToken, tampered)
+		}
+	})
+
+	t.Run("other secret", func(t *testing.T) {
+		other := &Server{opt: Options{TokenSecret: []byte("other")}}
+		_, err := other.parseContinuationToken(resumed(func(r *dataapiv1.GetTelemetryDataRequest) {}))
+		require.ErrorIs(t, err, errInvalidToken)
+	})
+}
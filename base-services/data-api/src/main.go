@@ -2,13 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	dataapiv1 "data-api/api/gen/dataapi/v1"
+	"data-api/live"
+	"data-api/server"
+	"data-api/store"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/bigtable"
+	"github.com/nats-io/nats.go"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 )
@@ -34,16 +40,65 @@ func main() {
 	gcpProject := os.Getenv("GCP_PROJECT")
 	btInstance := os.Getenv("BT_INSTANCE")
 	btTable := os.Getenv("BT_TABLE")
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	natsURL := os.Getenv("NATS_URL")
+	natsCreds := os.Getenv("NATS_CREDS_FILE")
+	batchParallelism := positiveIntEnv(logger, "BATCH_PARALLELISM", 8)
+	maxBatchVehicles := positiveIntEnv(logger, "MAX_BATCH_VEHICLES", 1000)
+	tokenSecret := []byte(os.Getenv("CONTINUATION_TOKEN_SECRET"))
+	if len(tokenSecret) == 0 {
+		if storageBackend != "memory" {
+			logger.Fatal("CONTINUATION_TOKEN_SECRET is required for the bigtable storage backend")
+		}
+		// Without a shared secret the tokens are only valid for this instance until it restarts.
+		logger.Warn("CONTINUATION_TOKEN_SECRET is not set, using a random one")
+		tokenSecret = make([]byte, 32)
+		if _, err := rand.Read(tokenSecret); err != nil {
+			logger.Fatal("failed to generate the continuation token secret", zap.Error(err))
+		}
+	}
 
-	// --- Bigtable Connection
-	ctx := context.Background()
-	btClient, err := bigtable.NewClient(ctx, gcpProject, btInstance)
-	if err != nil {
-		logger.Fatal("failed to create bigtable client", zap.Error(err))
+	// --- Storage Backend ---
+	var telemetryStore store.TelemetryStore
+	switch storageBackend {
+	case "", "bigtable":
+		ctx := context.Background()
+		btClient, err := bigtable.NewClient(ctx, gcpProject, btInstance)
+		if err != nil {
+			logger.Fatal("failed to create bigtable client", zap.Error(err))
+		}
+		defer btClient.Close()
+
+		telemetryStore = store.NewBigtableStore(logger, btClient.Open(btTable))
+	case "memory":
+		// The in-memory store starts empty and is lost on restart, it's only meant for local development.
+		logger.Warn("using the in-memory storage backend")
+		telemetryStore = store.NewMemoryStore()
+	default:
+		logger.Fatal("unknown storage backend", zap.String("backend", storageBackend))
 	}
-	defer btClient.Close()
 
-	tbl := btClient.Open(btTable)
+	// --- Live Telemetry ---
+	// Without NATS, SubscribeTelemetry is not available
+	var liveSource live.Source
+	if natsURL != "" {
+		opts := []nats.Option{
+			nats.Name("data-api"),
+			nats.MaxReconnects(-1),
+		}
+		if natsCreds != "" {
+			opts = append(opts, nats.UserCredentials(natsCreds))
+		}
+		nc, err := nats.Connect(natsURL, opts...)
+		if err != nil {
+			logger.Fatal("failed to connect to NATS", zap.Error(err))
+		}
+		defer nc.Close()
+
+		liveSource = live.NewNATSSource(logger, nc)
+	} else {
+		logger.Warn("NATS_URL is not set, live telemetry is not available")
+	}
 
 	// --- Server Setup ---
 	lis, err := net.Listen("tcp", grpcAddr)
@@ -52,8 +107,13 @@ func main() {
 	}
 
 	grpcServer := grpc.NewServer()
-	telemetryServer := NewServer(logger, tbl, Options{
-		MaxLookback: 365 * 24 * time.Hour,
+	telemetryServer := server.NewServer(logger, telemetryStore, liveSource, server.Options{
+		MaxLookback:      365 * 24 * time.Hour,
+		HandoverWindow:   5 * time.Minute,
+		LiveBufferSize:   10000,
+		BatchParallelism: batchParallelism,
+		MaxBatchVehicles: maxBatchVehicles,
+		TokenSecret:      tokenSecret,
 	})
 
 	dataapiv1.RegisterTelemetryDataAPIServer(grpcServer, telemetryServer)
@@ -63,3 +123,16 @@ func main() {
 		logger.Fatal("gRPC server failed to serve", zap.Error(err))
 	}
 }
+
+// Reads a positive number from the environment, the default if it is not set.
+func positiveIntEnv(logger *zap.Logger, name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		logger.Fatal("must be a positive number", zap.String("name", name), zap.String("value", v))
+	}
+	return n
+}
@@ -0,0 +1,255 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"go.uber.org/zap"
+)
+
+var _ TelemetryStore = (*BigtableStore)(nil)
+
+// BigtableStore is the TelemetryStore backed by a Bigtable table with one row per vehicle
+// and timestamp and the column families "static" and "dynamic".
+type BigtableStore struct {
+	log *zap.Logger
+	tbl *bigtable.Table
+}
+
+func NewBigtableStore(log *zap.Logger, tbl *bigtable.Table) *BigtableStore {
+	return &BigtableStore{log: log, tbl: tbl}
+}
+
+// Main query function for forward scanning over a specific time range.
+func (s *BigtableStore) QueryTelemetry(
+	ctx context.Context,
+	opts QueryOptions,
+	callback QueryCallback,
+) error {
+	// 1. Build the row key range for an efficient scan.
+	rowRange := s.buildRowRange(opts.VehicleId, opts.StartTime, opts.EndTime)
+	if opts.StartAfterKey != "" {
+		rowRange = bigtable.NewOpenRange(opts.StartAfterKey, RowKey(opts.VehicleId, opts.EndTime))
+	}
+
+	// 2. Build the filter for the specified columns.
+	columnFilter := s.buildColumnFilter(opts.Columns)
+
+	// 3. Execute the scan using the row range and the final combined filter.
+	var err error
+
+	err = s.tbl.ReadRows(
+		ctx,
+		rowRange,
+		rowCallback(callback),
+		bigtable.RowFilter(columnFilter),
+	)
+	if err != nil {
+		return fmt.Errorf("failed during ReadRows: %w", err)
+	}
+
+	return nil
+}
+
+func (s *BigtableStore) QueryLatestTelemetry(
+	ctx context.Context,
+	opts QueryOptions,
+	callback QueryCallback,
+) error {
+	rowRange := s.buildRowRange(opts.VehicleId, opts.StartTime, opts.EndTime)
+
+	for _, data_type := range opts.Columns {
+		columnFilter, ok := s.buildSingleColumnFilter(data_type)
+		if !ok {
+			continue
+		}
+
+		err := s.tbl.ReadRows(
+			ctx,
+			rowRange,
+			rowCallback(callback),
+			bigtable.RowFilter(columnFilter),
+			bigtable.LimitRows(1),  // Only the latest entry is queried
+			bigtable.ReverseScan(), // Starting from the latest entry
+		)
+		if err != nil {
+			return fmt.Errorf("failed during ReadRows: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Reads the rows of all vehicles with one multi-range ReadRows call.
+func (s *BigtableStore) QueryTelemetryBatch(
+	ctx context.Context,
+	opts BatchQueryOptions,
+	callback QueryCallback,
+) error {
+	var rowRanges bigtable.RowRangeList
+	for _, vin := range opts.VehicleIds {
+		rowRanges = append(rowRanges, s.buildRowRange(vin, opts.StartTime, opts.EndTime))
+	}
+	if len(rowRanges) == 0 {
+		return nil
+	}
+
+	err := s.tbl.ReadRows(
+		ctx,
+		rowRanges,
+		rowCallback(callback),
+		bigtable.RowFilter(s.buildColumnFilter(opts.Columns)),
+	)
+	if err != nil {
+		return fmt.Errorf("failed during ReadRows: %w", err)
+	}
+	return nil
+}
+
+// Skips from vehicle to vehicle: each read returns the first row key of the next vehicle
+// only, so the rows of a vehicle are never scanned.
+func (s *BigtableStore) ListVehicleIds(ctx context.Context, prefix string, limit int) ([]string, error) {
+	var ids []string
+	start := prefix
+	for len(ids) < limit {
+		var vin string
+		err := s.tbl.ReadRows(
+			ctx,
+			bigtable.InfiniteRange(start),
+			func(r bigtable.Row) bool {
+				vin = VehicleIdFromRowKey(r.Key())
+				return false
+			},
+			bigtable.RowFilter(bigtable.ChainFilters(
+				bigtable.CellsPerRowLimitFilter(1),
+				bigtable.StripValueFilter(),
+			)),
+			bigtable.LimitRows(1),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed during ReadRows: %w", err)
+		}
+		if vin == "" || !strings.HasPrefix(vin, prefix) {
+			break
+		}
+		ids = append(ids, vin)
+		// '$' follows the '#' separator, so the next read starts after the rows of the vehicle.
+		start = vin + "$"
+	}
+	return ids, nil
+}
+
+func (s *BigtableStore) WriteTelemetry(ctx context.Context, vehicleId string, ts time.Time, values map[string][]byte) error {
+	mut := bigtable.NewMutation()
+	for dataType, value := range values {
+		family, qualifier, ok := SplitDataType(dataType)
+		if !ok {
+			return fmt.Errorf("invalid data type %q: expected 'family:qualifier'", dataType)
+		}
+		mut.Set(family, qualifier, bigtable.Now(), value)
+	}
+
+	rowKey := RowKey(vehicleId, ts)
+	if err := s.tbl.Apply(ctx, rowKey, mut); err != nil {
+		return fmt.Errorf("failed to apply mutation for row key '%s': %w", rowKey, err)
+	}
+	return nil
+}
+
+// Converts the rows read from Bigtable for the callback.
+func rowCallback(callback QueryCallback) func(r bigtable.Row) bool {
+	return func(r bigtable.Row) bool {
+		row := Row{Key: r.Key(), Values: make(map[string][]byte)}
+
+		// Loop over all families present in the row data.
+		for _, items := range r {
+			for _, item := range items {
+				// item.Column is "family:qualifier". We use this full name as the key.
+				row.Values[item.Column] = item.Value
+			}
+		}
+		return callback(row)
+	}
+}
+
+// Constructs a Bigtable row range to scan for a specific VIN within a given time window.
+func (s *BigtableStore) buildRowRange(vin string, startTime, endTime time.Time) bigtable.RowRange {
+	startKey := RowKey(vin, startTime)
+	endKey := RowKey(vin, endTime)
+
+	s.log.Debug(
+		"Building Key Range ",
+		zap.String("from ", startKey),
+		zap.String("to ", endKey),
+	)
+
+	return bigtable.NewRange(startKey, endKey)
+}
+
+// Creates a Bigtable filter to retrieve only the one specified column.
+func (s *BigtableStore) buildSingleColumnFilter(data_type string) (bigtable.Filter, bool) {
+	family, qualifier, ok := SplitDataType(data_type)
+	if !ok {
+		return nil, false
+	}
+
+	qualifierRegex := fmt.Sprintf("^(%s)$", regexp.QuoteMeta(qualifier))
+	return bigtable.ChainFilters(
+		bigtable.FamilyFilter(family),
+		bigtable.ColumnFilter(qualifierRegex),
+	), true
+}
+
+// Creates a Bigtable filter to retrieve only the specified columns.
+func (s *BigtableStore) buildColumnFilter(dataTypes []string) bigtable.Filter {
+	// Group the requested qualifiers by their column family.
+	familyToQualifiers := make(map[string][]string)
+
+	for _, datatype := range dataTypes {
+		if family, qualifier, ok := SplitDataType(datatype); ok {
+			familyToQualifiers[family] = append(familyToQualifiers[family], qualifier)
+		}
+	}
+
+	// If no valid "family:qualifier" strings were found, return a filter that matches nothing.
+	if len(familyToQualifiers) == 0 {
+		return bigtable.BlockAllFilter()
+	}
+
+	// For each family, create a specific "AND" filter for its qualifiers.
+	var familyFilters []bigtable.Filter
+	for family, qualifiers := range familyToQualifiers {
+		// Escape the qualifiers to be safe for regex.
+		var escaped []string
+		for _, q := range qualifiers {
+			escaped = append(escaped, regexp.QuoteMeta(q))
+		}
+		// Build a regex like "^(qualifier_1|qualifier_2|...)$"
+		qualifierRegex := fmt.Sprintf("^(%s)$", strings.Join(escaped, "|"))
+
+		s.log.Debug(
+			"Building Qualifier Filter Regex ",
+			zap.String("regex ", qualifierRegex),
+			zap.String("family ", family),
+		)
+
+		// InterleaveFilters acts as an "AND" for the family and column filter.
+		filter := bigtable.ChainFilters(
+			bigtable.FamilyFilter(family),
+			bigtable.ColumnFilter(qualifierRegex),
+		)
+		familyFilters = append(familyFilters, filter)
+	}
+
+	// If there's only one family, we don't need to interleave.
+	if len(familyFilters) == 1 {
+		return familyFilters[0]
+	}
+
+	// InterleaveFilters acts as an "OR" for the different family filters.
+	return bigtable.InterleaveFilters(familyFilters...)
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ TelemetryStore = (*MemoryStore)(nil)
+
+// MemoryStore is a TelemetryStore that keeps the rows in memory, sorted by row key like
+// Bigtable does. It is meant for tests and local development.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	keys []string // sorted
+	rows map[string]map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{rows: make(map[string]map[string][]byte)}
+}
+
+func (s *MemoryStore) QueryTelemetry(
+	ctx context.Context,
+	opts QueryOptions,
+	callback QueryCallback,
+) error {
+	columns := columnSet(opts.Columns)
+
+	// The rows are collected first, so the callback runs without holding the lock.
+	var rows []Row
+	s.mu.RLock()
+	keys := s.keyRange(opts.VehicleId, opts.StartTime, opts.EndTime)
+	if opts.StartAfterKey != "" {
+		keys = s.keysAfter(opts.StartAfterKey, RowKey(opts.VehicleId, opts.EndTime))
+	}
+	for _, key := range keys {
+		if row, ok := s.filterRow(key, columns); ok {
+			rows = append(rows, row)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, row := range rows {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !callback(row) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) QueryLatestTelemetry(
+	ctx context.Context,
+	opts QueryOptions,
+	callback QueryCallback,
+) error {
+	var rows []Row
+	s.mu.RLock()
+	keys := s.keyRange(opts.VehicleId, opts.StartTime, opts.EndTime)
+	for _, data_type := range opts.Columns {
+		if _, _, ok := SplitDataType(data_type); !ok {
+			continue
+		}
+		// Starting from the latest entry
+		for i := len(keys) - 1; i >= 0; i-- {
+			if row, ok := s.filterRow(keys[i], map[string]bool{data_type: true}); ok {
+				rows = append(rows, row)
+				break
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, row := range rows {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		callback(row)
+	}
+	return nil
+}
+
+func (s *MemoryStore) QueryTelemetryBatch(
+	ctx context.Context,
+	opts BatchQueryOptions,
+	callback QueryCallback,
+) error {
+	columns := columnSet(opts.Columns)
+
+	// Sorted like the row keys, so the rows are in row key order.
+	vins := slices.Clone(opts.VehicleIds)
+	slices.Sort(vins)
+
+	var rows []Row
+	s.mu.RLock()
+	for _, vin := range slices.Compact(vins) {
+		for _, key := range s.keyRange(vin, opts.StartTime, opts.EndTime) {
+			if row, ok := s.filterRow(key, columns); ok {
+				rows = append(rows, row)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, row := range rows {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !callback(row) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListVehicleIds(ctx context.Context, prefix string, limit int) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []string
+	for i := sort.SearchStrings(s.keys, prefix); i < len(s.keys) && len(ids) < limit; i++ {
+		vin := VehicleIdFromRowKey(s.keys[i])
+		if !strings.HasPrefix(vin, prefix) {
+			break
+		}
+		if len(ids) == 0 || ids[len(ids)-1] != vin {
+			ids = append(ids, vin)
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) WriteTelemetry(ctx context.Context, vehicleId string, ts time.Time, values map[string][]byte) error {
+	for dataType := range values {
+		if _, _, ok := SplitDataType(dataType); !ok {
+			return fmt.Errorf("invalid data type %q: expected 'family:qualifier'", dataType)
+		}
+	}
+
+	key := RowKey(vehicleId, ts)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, ok := s.rows[key]
+	if !ok {
+		row = make(map[string][]byte)
+		s.rows[key] = row
+		i, _ := slices.BinarySearch(s.keys, key)
+		s.keys = slices.Insert(s.keys, i, key)
+	}
+	for dataType, value := range values {
+		row[dataType] = slices.Clone(value)
+	}
+	return nil
+}
+
+// Returns the sorted keys of the vehicle from startTime (inclusive) to endTime (exclusive).
+// The caller must hold the lock.
+func (s *MemoryStore) keyRange(vin string, startTime, endTime time.Time) []string {
+	start := sort.SearchStrings(s.keys, RowKey(vin, startTime))
+	end := sort.SearchStrings(s.keys, RowKey(vin, endTime))
+	if end < start {
+		return nil
+	}
+	return s.keys[start:end]
+}
+
+// Returns the sorted keys after startAfter (exclusive) up to endKey (exclusive).
+// The caller must hold the lock.
+func (s *MemoryStore) keysAfter(startAfter, endKey string) []string {
+	start, found := slices.BinarySearch(s.keys, startAfter)
+	if found {
+		start++
+	}
+	end := sort.SearchStrings(s.keys, endKey)
+	if end < start {
+		return nil
+	}
+	return s.keys[start:end]
+}
+
+// Copies the row with only the given columns, false if it has none of them.
+// The caller must hold the lock.
+func (s *MemoryStore) filterRow(key string, columns map[string]bool) (Row, bool) {
+	row := Row{Key: key, Values: make(map[string][]byte)}
+	for dataType, value := range s.rows[key] {
+		if columns[dataType] {
+			row.Values[dataType] = slices.Clone(value)
+		}
+	}
+	return row, len(row.Values) > 0
+}
+
+// Returns the valid "family:qualifier" data types as a set.
+func columnSet(dataTypes []string) map[string]bool {
+	columns := make(map[string]bool)
+	for _, dataType := range dataTypes {
+		if _, _, ok := SplitDataType(dataType); ok {
+			columns[dataType] = true
+		}
+	}
+	return columns
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	base := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+
+	s := NewMemoryStore()
+	write := func(vin string, offset time.Duration, values map[string]string) {
+		raw := make(map[string][]byte)
+		for k, v := range values {
+			raw[k] = []byte(v)
+		}
+		require.NoError(t, s.WriteTelemetry(ctx, vin, base.Add(offset), raw))
+	}
+	// Written out of order on purpose
+	write("VIN1", 2*time.Minute, map[string]string{"dynamic:speed": "70"})
+	write("VIN1", 0, map[string]string{"dynamic:speed": "60", "static:make": "Ford"})
+	write("VIN1", time.Minute, map[string]string{"dynamic:location.lat": "52.5"})
+	write("VIN10", time.Minute, map[string]string{"dynamic:speed": "99"})
+	write("VIN1", 3*time.Minute, map[string]string{"dynamic:speed": "80"})
+
+	collect := func(query func(context.Context, QueryOptions, QueryCallback) error, opts QueryOptions) []Row {
+		var rows []Row
+		require.NoError(t, query(ctx, opts, func(row Row) bool {
+			rows = append(rows, row)
+			return true
+		}))
+		return rows
+	}
+
+	t.Run("range", func(t *testing.T) {
+		rows := collect(s.QueryTelemetry, QueryOptions{
+			VehicleId: "VIN1",
+			StartTime: base,
+			EndTime:   base.Add(3 * time.Minute), // exclusive
+			Columns:   []string{"dynamic:speed", "static:make"},
+		})
+		require.Equal(t, []Row{
+			{Key: RowKey("VIN1", base), Values: map[string][]byte{"dynamic:speed": []byte("60"), "static:make": []byte("Ford")}},
+			{Key: RowKey("VIN1", base.Add(2*time.Minute)), Values: map[string][]byte{"dynamic:speed": []byte("70")}},
+		}, rows)
+	})
+
+	t.Run("range after a row key", func(t *testing.T) {
+		rows := collect(s.QueryTelemetry, QueryOptions{
+			VehicleId:     "VIN1",
+			StartTime:     base,
+			EndTime:       base.Add(time.Hour),
+			Columns:       []string{"dynamic:speed"},
+			StartAfterKey: RowKey("VIN1", base.Add(2*time.Minute)),
+		})
+		require.Equal(t, []Row{
+			{Key: RowKey("VIN1", base.Add(3*time.Minute)), Values: map[string][]byte{"dynamic:speed": []byte("80")}},
+		}, rows)
+	})
+
+	t.Run("range without valid columns", func(t *testing.T) {
+		rows := collect(s.QueryTelemetry, QueryOptions{
+			VehicleId: "VIN1",
+			StartTime: base,
+			EndTime:   base.Add(time.Hour),
+			Columns:   []string{"speed"},
+		})
+		require.Empty(t, rows)
+	})
+
+	t.Run("range stops when the callback returns false", func(t *testing.T) {
+		calls := 0
+		require.NoError(t, s.QueryTelemetry(ctx, QueryOptions{
+			VehicleId: "VIN1",
+			StartTime: base,
+			EndTime:   base.Add(time.Hour),
+			Columns:   []string{"dynamic:speed"},
+		}, func(row Row) bool {
+			calls++
+			return false
+		}))
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("latest", func(t *testing.T) {
+		rows := collect(s.QueryLatestTelemetry, QueryOptions{
+			VehicleId: "VIN1",
+			StartTime: time.Unix(0, 0),
+			EndTime:   base.Add(time.Hour),
+			Columns:   []string{"static:make", "dynamic:speed", "dynamic:unknown", "invalid"},
+		})
+		require.Equal(t, []Row{
+			{Key: RowKey("VIN1", base), Values: map[string][]byte{"static:make": []byte("Ford")}},
+			{Key: RowKey("VIN1", base.Add(3*time.Minute)), Values: map[string][]byte{"dynamic:speed": []byte("80")}},
+		}, rows)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		var rows []Row
+		require.NoError(t, s.QueryTelemetryBatch(ctx, BatchQueryOptions{
+			VehicleIds: []string{"VIN10", "VIN1", "VIN2", "VIN10"},
+			StartTime:  base.Add(time.Minute),
+			EndTime:    base.Add(time.Hour),
+			Columns:    []string{"dynamic:speed"},
+		}, func(row Row) bool {
+			rows = append(rows, row)
+			return true
+		}))
+		require.Equal(t, []Row{
+			{Key: RowKey("VIN1", base.Add(2*time.Minute)), Values: map[string][]byte{"dynamic:speed": []byte("70")}},
+			{Key: RowKey("VIN1", base.Add(3*time.Minute)), Values: map[string][]byte{"dynamic:speed": []byte("80")}},
+			{Key: RowKey("VIN10", base.Add(time.Minute)), Values: map[string][]byte{"dynamic:speed": []byte("99")}},
+		}, rows)
+	})
+
+	t.Run("vehicle ids", func(t *testing.T) {
+		ids, err := s.ListVehicleIds(ctx, "VIN", 10)
+		require.NoError(t, err)
+		require.Equal(t, []string{"VIN1", "VIN10"}, ids)
+
+		ids, err = s.ListVehicleIds(ctx, "VIN", 1)
+		require.NoError(t, err)
+		require.Equal(t, []string{"VIN1"}, ids)
+
+		ids, err = s.ListVehicleIds(ctx, "VIN2", 10)
+		require.NoError(t, err)
+		require.Empty(t, ids)
+	})
+
+	t.Run("invalid data type", func(t *testing.T) {
+		require.Error(t, s.WriteTelemetry(ctx, "VIN1", base, map[string][]byte{"speed": []byte("1")}))
+	})
+}
+
+func TestParseTimestampFromRowKey(t *testing.T) {
+	ts := time.Date(2024, 1, 15, 10, 30, 0, 123, time.UTC)
+
+	parsed, ok := ParseTimestampFromRowKey(RowKey("VIN#1", ts))
+	require.True(t, ok)
+	require.True(t, ts.Equal(parsed))
+	require.Equal(t, "VIN#1", VehicleIdFromRowKey(RowKey("VIN#1", ts)))
+
+	for _, key := range []string{"VIN1", "VIN1#", "VIN1#yesterday"} {
+		_, ok := ParseTimestampFromRowKey(key)
+		require.False(t, ok, key)
+	}
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const TimestampFormat = "2006-01-02T15:04:05.000000000Z07:00" // magic timestamp that defines the format consistently
+
+// A Row holds the values of one vehicle at one point in time.
+type Row struct {
+	// Key is "<vehicle_id>#<timestamp>", see RowKey.
+	Key string
+	// Values are keyed by data type ("family:qualifier") and hold the raw bytes.
+	Values map[string][]byte
+}
+
+// The implementation of this callback type streams the gRPC response.
+// Returning false stops the query.
+type QueryCallback func(row Row) bool
+
+type QueryOptions struct {
+	VehicleId string
+	StartTime time.Time
+	EndTime   time.Time
+	Columns   []string
+
+	// If set, the query starts right after this row key instead of at StartTime.
+	StartAfterKey string
+}
+
+type BatchQueryOptions struct {
+	VehicleIds []string
+	StartTime  time.Time
+	EndTime    time.Time
+	Columns    []string
+}
+
+// TelemetryStore reads and writes the telemetry of the vehicles.
+type TelemetryStore interface {
+	// QueryTelemetry calls the callback for every row of the vehicle from StartTime
+	// (inclusive) to EndTime (exclusive) in chronological order. The rows only contain
+	// the requested columns, rows without any of them are skipped.
+	QueryTelemetry(ctx context.Context, opts QueryOptions, callback QueryCallback) error
+
+	// QueryLatestTelemetry calls the callback once per requested column with the latest
+	// row between StartTime and EndTime that contains it, reduced to that column.
+	QueryLatestTelemetry(ctx context.Context, opts QueryOptions, callback QueryCallback) error
+
+	// QueryTelemetryBatch is QueryTelemetry for several vehicles in a single scan. The rows
+	// are in row key order, so grouped by vehicle and chronological per vehicle.
+	QueryTelemetryBatch(ctx context.Context, opts BatchQueryOptions, callback QueryCallback) error
+
+	// ListVehicleIds returns up to limit ids of the vehicles with telemetry whose id starts
+	// with the prefix, in row key order.
+	ListVehicleIds(ctx context.Context, prefix string, limit int) ([]string, error)
+
+	// WriteTelemetry stores the values of the vehicle at the given time.
+	WriteTelemetry(ctx context.Context, vehicleId string, ts time.Time, values map[string][]byte) error
+}
+
+// Builds the row key of a vehicle at a point in time. Keys of one vehicle sort chronologically.
+func RowKey(vin string, ts time.Time) string {
+	return fmt.Sprintf("%s#%s", vin, ts.UTC().Format(TimestampFormat))
+}
+
+// Returns the vehicle id of a row key, the part before the last '#'.
+func VehicleIdFromRowKey(key string) string {
+	if i := strings.LastIndex(key, "#"); i != -1 {
+		return key[:i]
+	}
+	return key
+}
+
+func ParseTimestampFromRowKey(key string) (time.Time, bool) {
+	// Find the last '#' character in the RowKey after which comes the timestamp.
+	lastHashIndex := strings.LastIndex(key, "#")
+	if lastHashIndex == -1 || lastHashIndex == len(key)-1 {
+		return time.Time{}, false
+	}
+
+	// Extract the timestamp part of the string.
+	timestampStr := key[lastHashIndex+1:]
+
+	// Parse the string using the global format.
+	ts, err := time.Parse(TimestampFormat, timestampStr)
+	if err != nil {
+		// The string after the '#' was not a valid timestamp.
+		return time.Time{}, false
+	}
+
+	return ts, true
+}
+
+// Splits a data type ("family:qualifier") into column family and qualifier.
+func SplitDataType(dataType string) (family, qualifier string, ok bool) {
+	parts := strings.SplitN(dataType, ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
@@ -2,17 +2,26 @@ package integration
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	dataapiv1 "data-api/api/gen/dataapi/v1"
+
 	"github.com/cucumber/godog"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/status"
 )
 
 // Adds the Gherkin steps for API interactions.
 func (ts *TestSuite) registerAssertSteps(ctx *godog.ScenarioContext) {
 	ctx.Step(`^the resulting telemetry should be:$`, ts.theResultingTelemetryShouldBe)
+	ctx.Step(`^the resulting aggregates should be:$`, ts.theResultingAggregatesShouldBe)
+	ctx.Step(`^the request should fail with code "([^"]*)"$`, ts.theRequestShouldFailWithCode)
+	ctx.Step(`^the resulting telemetry of the vehicles should be:$`, ts.theResultingTelemetryOfTheVehiclesShouldBe)
+	ctx.Step(`^the subscription should receive:$`, ts.theSubscriptionShouldReceive)
+	ctx.Step(`^the telemetry should have been received in (\d+) pages$`, ts.theTelemetryShouldHaveBeenReceivedInPages)
 }
 
 func (ts *TestSuite) theResultingTelemetryShouldBe(expected *godog.Table) error {
@@ -20,6 +29,10 @@ func (ts *TestSuite) theResultingTelemetryShouldBe(expected *godog.Table) error
 		return fmt.Errorf("expected a successful response, but got an error: %w", ts.LastError)
 	}
 
+	if len(ts.LastResponse) != len(expected.Rows)-1 {
+		return fmt.Errorf("expected %d points, but got %d", len(expected.Rows)-1, len(ts.LastResponse))
+	}
+
 	// Iterate through each received point and compare it with the expected row.
 	for i, actualPoint := range ts.LastResponse {
 		expectedRow := expected.Rows[i+1] // +1 to skip header
@@ -60,6 +73,119 @@ func (ts *TestSuite) theResultingTelemetryShouldBe(expected *godog.Table) error
 
 }
 
+// Compares the points of several vehicles regardless of their order, as the vehicles are
+// queried concurrently. The table has the columns vehicle_id, timestamp, data_type and value.
+func (ts *TestSuite) theResultingTelemetryOfTheVehiclesShouldBe(expected *godog.Table) error {
+	if ts.LastError != nil {
+		return fmt.Errorf("expected a successful response, but got an error: %w", ts.LastError)
+	}
+
+	// Flatten both to "vehicle_id timestamp data_type=value".
+	var expectedPoints []string
+	for i := 1; i < len(expected.Rows); i++ {
+		cells := expected.Rows[i].Cells
+		timestamp, err := time.Parse(time.RFC3339Nano, cells[1].Value)
+		if err != nil {
+			return fmt.Errorf("failed to parse expected timestamp in row %d: %w", i, err)
+		}
+		expectedPoints = append(expectedPoints, fmt.Sprintf("%s %s %s=%s", cells[0].Value, timestamp.UTC().Format(time.RFC3339Nano), cells[2].Value, cells[3].Value))
+	}
+	var actualPoints []string
+	for _, point := range ts.LastResponse {
+		for dataType, value := range point.Values {
+			actualPoints = append(actualPoints, fmt.Sprintf("%s %s %s=%s", point.VehicleId, point.Timestamp.AsTime().UTC().Format(time.RFC3339Nano), dataType, value))
+		}
+	}
+
+	if !assert.ElementsMatch(new(testing.T), expectedPoints, actualPoints) {
+		return fmt.Errorf("Telemetry assertion failed. Expected %s but got %s.", expectedPoints, actualPoints)
+	}
+	return nil
+}
+
+func (ts *TestSuite) theTelemetryShouldHaveBeenReceivedInPages(pages int) error {
+	if ts.PageCount != pages {
+		return fmt.Errorf("expected %d pages, but got %d", pages, ts.PageCount)
+	}
+	return nil
+}
+
+// Waits for the expected number of points of the subscription, makes sure no more
+// follow shortly after and compares them like a response.
+func (ts *TestSuite) theSubscriptionShouldReceive(expected *godog.Table) error {
+	if ts.SubscriptionPoints == nil {
+		return fmt.Errorf("no subscription was opened")
+	}
+
+	var received []*dataapiv1.TelemetryPoint
+	timeout := time.After(5 * time.Second)
+	for len(received) < len(expected.Rows)-1 {
+		select {
+		case point := <-ts.SubscriptionPoints:
+			received = append(received, point)
+		case err := <-ts.SubscriptionError:
+			return fmt.Errorf("subscription ended after %d points: %w", len(received), err)
+		case <-timeout:
+			return fmt.Errorf("expected %d points, but got %d within 5s", len(expected.Rows)-1, len(received))
+		}
+	}
+	select {
+	case point := <-ts.SubscriptionPoints:
+		return fmt.Errorf("expected %d points, but got an additional one: %s", len(expected.Rows)-1, point)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	ts.LastResponse = received
+	ts.LastError = nil
+	return ts.theResultingTelemetryShouldBe(expected)
+}
+
+func (ts *TestSuite) theResultingAggregatesShouldBe(expected *godog.Table) error {
+	if ts.LastError != nil {
+		return fmt.Errorf("expected a successful response, but got an error: %w", ts.LastError)
+	}
+
+	// Flatten the expected table and the received points to "bucket_start data_type function" -> value.
+	expectedValues := make(map[string]string)
+	for _, row := range expected.Rows[1:] {
+		key := fmt.Sprintf("%s %s %s", row.Cells[0].Value, row.Cells[1].Value, row.Cells[2].Value)
+		expectedValues[key] = row.Cells[3].Value
+	}
+
+	actualValues := make(map[string]string)
+	for _, point := range ts.LastAggregates {
+		bucketStart := point.BucketStart.AsTime().UTC().Format(time.RFC3339)
+		for dataType, agg := range point.Values {
+			values := map[string]*float64{
+				"min": agg.Min, "max": agg.Max, "avg": agg.Avg, "sum": agg.Sum, "first": agg.First, "last": agg.Last,
+			}
+			for function, value := range values {
+				if value != nil {
+					actualValues[fmt.Sprintf("%s %s %s", bucketStart, dataType, function)] = strconv.FormatFloat(*value, 'f', -1, 64)
+				}
+			}
+			if agg.Count != nil {
+				actualValues[fmt.Sprintf("%s %s count", bucketStart, dataType)] = strconv.FormatUint(*agg.Count, 10)
+			}
+		}
+	}
+
+	if !assert.Equal(new(testing.T), expectedValues, actualValues) {
+		return fmt.Errorf("Aggregate assertion failed. Expected %v but got %v.", expectedValues, actualValues)
+	}
+	return nil
+}
+
+func (ts *TestSuite) theRequestShouldFailWithCode(code string) error {
+	if ts.LastError == nil {
+		return fmt.Errorf("expected the request to fail with %s, but it succeeded", code)
+	}
+	if actual := status.Code(ts.LastError).String(); actual != code {
+		return fmt.Errorf("expected the request to fail with %s, but got %s: %v", code, actual, ts.LastError)
+	}
+	return nil
+}
+
 func parseKeyValueString(input string) map[string]string {
 	result := make(map[string]string)
 	if input == "" {
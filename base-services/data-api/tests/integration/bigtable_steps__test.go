@@ -8,6 +8,9 @@ import (
 
 	"cloud.google.com/go/bigtable"
 	"github.com/cucumber/godog"
+	"go.uber.org/zap"
+
+	"data-api/store"
 )
 
 const (
@@ -22,7 +25,12 @@ func (ts *TestSuite) registerBigtableSteps(ctx *godog.ScenarioContext) {
 }
 
 // Connects to the emulator and ensures the table and family exist.
+// The memory store is already fresh for every scenario.
 func (ts *TestSuite) theTelemetryBigtableIsAvailable(ctx context.Context) error {
+	if *storeFlag == "memory" {
+		return nil
+	}
+
 	var err error
 
 	// Create an admin client to manage tables
@@ -51,14 +59,14 @@ func (ts *TestSuite) theTelemetryBigtableIsAvailable(ctx context.Context) error
 		return err
 	}
 	ts.BtTable = ts.BtClient.Open(bigtableTable)
+	ts.Store = store.NewBigtableStore(zap.NewNop(), ts.BtTable)
 
 	return nil
 }
 
-// vehicleHasTheFollowingTelemetryData parses a Gherkin table and writes the data to Bigtable.
+// vehicleHasTheFollowingTelemetryData parses a Gherkin table and writes the data to the store.
 func (ts *TestSuite) vehicleHasTheFollowingTelemetryData(ctx context.Context, vehicleID string, table *godog.Table) error {
-	// We will apply each row as an individual mutation.
-	// While ApplyBulk could be used, a loop of Apply is clearer for this test logic.
+	// We will write each row individually.
 	for i := 1; i < len(table.Rows); i++ {
 		row := table.Rows[i]
 		if len(row.Cells) != 3 {
@@ -69,12 +77,10 @@ func (ts *TestSuite) vehicleHasTheFollowingTelemetryData(ctx context.Context, ve
 		fullDataType := row.Cells[1].Value
 		value := row.Cells[2].Value
 
-		// Parse the data type into family and qualifier.
-		parts := strings.SplitN(fullDataType, ":", 2)
-		if len(parts) != 2 {
+		// Validate the data type format.
+		if len(strings.SplitN(fullDataType, ":", 2)) != 2 {
 			return fmt.Errorf("invalid data_type format in row %d: expected 'family:qualifier', got '%s'", i+1, fullDataType)
 		}
-		family, qualifier := parts[0], parts[1]
 
 		// Parse the timestamp string from the feature file.
 		timestamp, err := time.Parse(time.RFC3339Nano, timestampStr)
@@ -82,16 +88,9 @@ func (ts *TestSuite) vehicleHasTheFollowingTelemetryData(ctx context.Context, ve
 			return fmt.Errorf("failed to parse timestamp in row %d: '%s': %w", i+1, timestampStr, err)
 		}
 
-		// Construct the unique row key for this single data point.
-		rowKey := fmt.Sprintf("%s#%s", vehicleID, timestamp.UTC().Format("2006-01-02T15:04:05.000000000Z07:00"))
-
-		// Create a mutation for this single cell.
-		mut := bigtable.NewMutation()
-		mut.Set(family, qualifier, bigtable.Now(), []byte(value))
-
-		// Apply the mutation for this single row.
-		if err := ts.BtTable.Apply(ctx, rowKey, mut); err != nil {
-			return fmt.Errorf("failed to apply mutation for row key '%s': %w", rowKey, err)
+		// Write this single data point.
+		if err := ts.Store.WriteTelemetry(ctx, vehicleID, timestamp, map[string][]byte{fullDataType: []byte(value)}); err != nil {
+			return err
 		}
 	}
 
@@ -2,13 +2,16 @@ package integration
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log"
+	"strings"
 	"time"
 
 	dataapiv1 "data-api/api/gen/dataapi/v1"
 
 	"github.com/cucumber/godog"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
@@ -19,6 +22,15 @@ func (ts *TestSuite) registerAPISteps(ctx *godog.ScenarioContext) {
 	ctx.Step(`^I request the latest telemetry data for vehicle "([^"]*)" with data types:$`, ts.iRequestTheLatestTelemetry)
 	ctx.Step(`^I request telemetry data for vehicle "([^"]*)" for the last "([^"]*)" \(since testing time\) with data types:$`, ts.iRequestTelemetryForTheLastDuration)
 	ctx.Step(`^I request telemetry data for vehicle "([^"]*)" from "([^"]*)" to "([^"]*)" with data types:$`, ts.iRequestTelemetryForTimeRange)
+	ctx.Step(`^I request the "([^"]*)" of telemetry data for vehicle "([^"]*)" from "([^"]*)" to "([^"]*)" in buckets of "([^"]*)" with data types:$`, ts.iRequestAggregatesForTimeRange)
+	ctx.Step(`^I request the "([^"]*)" of telemetry data for vehicle "([^"]*)" for the last "([^"]*)" \(since testing time\) in buckets of "([^"]*)" with data types:$`, ts.iRequestAggregatesForTheLastDuration)
+	ctx.Step(`^I request telemetry data for vehicle "([^"]*)" from "([^"]*)" to "([^"]*)" in pages of "(\d+)" with data types:$`, ts.iRequestTelemetryForTimeRangeInPages)
+	ctx.Step(`^I continue the request with the continuation token "([^"]*)"$`, ts.iContinueTheRequestWithTheContinuationToken)
+	ctx.Step(`^I request telemetry data for vehicles "([^"]*)" for the last "([^"]*)" \(since testing time\) with data types:$`, ts.iRequestBatchTelemetryForTheLastDuration)
+	ctx.Step(`^I request the latest telemetry data for vehicles with prefix "([^"]*)" with data types:$`, ts.iRequestTheLatestBatchTelemetryForPrefix)
+	ctx.Step(`^I subscribe to the latest telemetry for vehicle "([^"]*)" with data types:$`, ts.iSubscribeToTheLatestTelemetry)
+	ctx.Step(`^I subscribe to telemetry for vehicle "([^"]*)" for the last "([^"]*)" \(since testing time\) with data types:$`, ts.iSubscribeToTelemetryForTheLastDuration)
+	ctx.Step(`^I subscribe to the live telemetry for vehicle "([^"]*)" with data types:$`, ts.iSubscribeToTheLiveTelemetry)
 }
 
 func (ts *TestSuite) iRequestTheLatestTelemetry(ctx context.Context, vehicleID string, dataTypesTbl *godog.Table) error {
@@ -73,8 +85,264 @@ func (ts *TestSuite) iRequestTelemetryForTimeRange(ctx context.Context, vehicleI
 	return ts.sendRequestAndStoreResponse(ctx, req)
 }
 
+// Requests page after page with the continuation token of the previous page until the last
+// page, and stores all points as the response.
+func (ts *TestSuite) iRequestTelemetryForTimeRangeInPages(ctx context.Context, vehicleID, startTimeStr, endTimeStr string, pageSize int, dataTypesTbl *godog.Table) error {
+	startTime, err := time.Parse(time.RFC3339, startTimeStr)
+	if err != nil {
+		return err
+	}
+	endTime, err := time.Parse(time.RFC3339, endTimeStr)
+	if err != nil {
+		return err
+	}
+	req := &dataapiv1.GetTelemetryDataRequest{
+		VehicleId: vehicleID,
+		DataTypes: parseDataTableToStringSlice(dataTypesTbl),
+		TimeSelector: &dataapiv1.GetTelemetryDataRequest_TimeRange{
+			TimeRange: &dataapiv1.TimeRange{
+				Start: timestamppb.New(startTime),
+				End:   timestamppb.New(endTime),
+			},
+		},
+		PageSize: uint32(pageSize),
+	}
+	ts.LastRequest = req
+
+	var allPoints []*dataapiv1.TelemetryPoint
+	ts.PageCount = 0
+	for {
+		if err := ts.sendRequestAndStoreResponse(ctx, req); err != nil || ts.LastError != nil {
+			return err
+		}
+		ts.PageCount++
+		allPoints = append(allPoints, ts.LastResponse...)
+		if len(ts.LastResponse) == 0 || ts.LastResponse[len(ts.LastResponse)-1].ContinuationToken == "" {
+			break
+		}
+		req.ContinuationToken = ts.LastResponse[len(ts.LastResponse)-1].ContinuationToken
+	}
+	ts.LastResponse = allPoints
+
+	return nil
+}
+
+func (ts *TestSuite) iContinueTheRequestWithTheContinuationToken(ctx context.Context, token string) error {
+	if ts.LastRequest == nil {
+		return fmt.Errorf("no request to continue")
+	}
+	req := proto.Clone(ts.LastRequest).(*dataapiv1.GetTelemetryDataRequest)
+	req.ContinuationToken = token
+	return ts.sendRequestAndStoreResponse(ctx, req)
+}
+
+func (ts *TestSuite) iRequestAggregatesForTimeRange(ctx context.Context, functions, vehicleID, startTimeStr, endTimeStr, widthStr string, dataTypesTbl *godog.Table) error {
+	startTime, err := time.Parse(time.RFC3339, startTimeStr)
+	if err != nil {
+		return err
+	}
+	endTime, err := time.Parse(time.RFC3339, endTimeStr)
+	if err != nil {
+		return err
+	}
+	req, err := newAggregateRequest(functions, vehicleID, widthStr, dataTypesTbl)
+	if err != nil {
+		return err
+	}
+	req.TimeSelector = &dataapiv1.AggregateTelemetryRequest_TimeRange{
+		TimeRange: &dataapiv1.TimeRange{
+			Start: timestamppb.New(startTime),
+			End:   timestamppb.New(endTime),
+		},
+	}
+	return ts.sendAggregateRequestAndStoreResponse(ctx, req)
+}
+
+func (ts *TestSuite) iRequestAggregatesForTheLastDuration(ctx context.Context, functions, vehicleID, durationStr, widthStr string, dataTypesTbl *godog.Table) error {
+	duration, err := time.ParseDuration(durationStr)
+	if err != nil {
+		return err
+	}
+	req, err := newAggregateRequest(functions, vehicleID, widthStr, dataTypesTbl)
+	if err != nil {
+		return err
+	}
+	req.TimeSelector = &dataapiv1.AggregateTelemetryRequest_LastDuration{
+		LastDuration: durationpb.New(duration),
+	}
+	return ts.sendAggregateRequestAndStoreResponse(ctx, req)
+}
+
+func (ts *TestSuite) iRequestBatchTelemetryForTheLastDuration(ctx context.Context, vehicleIDs, durationStr string, dataTypesTbl *godog.Table) error {
+	duration, err := time.ParseDuration(durationStr)
+	if err != nil {
+		return err
+	}
+	req := &dataapiv1.BatchGetTelemetryDataRequest{
+		Vehicles: &dataapiv1.BatchGetTelemetryDataRequest_VehicleIds{
+			VehicleIds: &dataapiv1.VehicleIds{VehicleIds: strings.Split(vehicleIDs, ",")},
+		},
+		DataTypes: parseDataTableToStringSlice(dataTypesTbl),
+		TimeSelector: &dataapiv1.BatchGetTelemetryDataRequest_LastDuration{
+			LastDuration: durationpb.New(duration),
+		},
+	}
+	return ts.sendBatchRequestAndStoreResponse(ctx, req)
+}
+
+func (ts *TestSuite) iRequestTheLatestBatchTelemetryForPrefix(ctx context.Context, prefix string, dataTypesTbl *godog.Table) error {
+	req := &dataapiv1.BatchGetTelemetryDataRequest{
+		Vehicles:  &dataapiv1.BatchGetTelemetryDataRequest_VehicleIdPrefix{VehicleIdPrefix: prefix},
+		DataTypes: parseDataTableToStringSlice(dataTypesTbl),
+		TimeSelector: &dataapiv1.BatchGetTelemetryDataRequest_Latest{
+			Latest: true,
+		},
+	}
+	return ts.sendBatchRequestAndStoreResponse(ctx, req)
+}
+
+func (ts *TestSuite) iSubscribeToTheLatestTelemetry(ctx context.Context, vehicleID string, dataTypesTbl *godog.Table) error {
+	return ts.subscribe(&dataapiv1.SubscribeTelemetryRequest{
+		VehicleId:    vehicleID,
+		DataTypes:    parseDataTableToStringSlice(dataTypesTbl),
+		TimeSelector: &dataapiv1.SubscribeTelemetryRequest_Latest{Latest: true},
+	})
+}
+
+func (ts *TestSuite) iSubscribeToTelemetryForTheLastDuration(ctx context.Context, vehicleID, durationStr string, dataTypesTbl *godog.Table) error {
+	duration, err := time.ParseDuration(durationStr)
+	if err != nil {
+		return err
+	}
+	return ts.subscribe(&dataapiv1.SubscribeTelemetryRequest{
+		VehicleId:    vehicleID,
+		DataTypes:    parseDataTableToStringSlice(dataTypesTbl),
+		TimeSelector: &dataapiv1.SubscribeTelemetryRequest_LastDuration{LastDuration: durationpb.New(duration)},
+	})
+}
+
+func (ts *TestSuite) iSubscribeToTheLiveTelemetry(ctx context.Context, vehicleID string, dataTypesTbl *godog.Table) error {
+	return ts.subscribe(&dataapiv1.SubscribeTelemetryRequest{
+		VehicleId: vehicleID,
+		DataTypes: parseDataTableToStringSlice(dataTypesTbl),
+	})
+}
+
 // --- Helper Functions ---
 
+// Opens the subscription and receives its points in the background until the scenario ends.
+func (ts *TestSuite) subscribe(req *dataapiv1.SubscribeTelemetryRequest) error {
+	// The subscription outlives the step, so it gets its own context.
+	ctx, cancel := context.WithCancel(context.Background())
+	ts.CancelSubscription = cancel
+	stream, err := ts.ApiClient.SubscribeTelemetry(ctx, req)
+	if err != nil {
+		ts.LastError = err
+		return nil // Return nil so the test continues to the assertion step.
+	}
+	// The server sends the headers once it is subscribed to the live telemetry.
+	md, err := stream.Header()
+	if err == nil && md == nil {
+		// The stream ended without headers, the status tells why.
+		_, err = stream.Recv()
+	}
+	if err != nil {
+		ts.LastError = err
+		return nil
+	}
+	ts.LastError = nil
+
+	points := make(chan *dataapiv1.TelemetryPoint, 100)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			point, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			points <- point
+		}
+	}()
+	ts.SubscriptionPoints = points
+	ts.SubscriptionError = errs
+
+	return nil
+}
+
+// Builds an aggregate request without time selector from a comma separated list of functions like "min,max".
+func newAggregateRequest(functions, vehicleID, widthStr string, dataTypesTbl *godog.Table) (*dataapiv1.AggregateTelemetryRequest, error) {
+	width, err := time.ParseDuration(widthStr)
+	if err != nil {
+		return nil, err
+	}
+	req := &dataapiv1.AggregateTelemetryRequest{
+		VehicleId:   vehicleID,
+		DataTypes:   parseDataTableToStringSlice(dataTypesTbl),
+		BucketWidth: durationpb.New(width),
+	}
+	for name := range strings.SplitSeq(functions, ",") {
+		value, ok := dataapiv1.AggregationFunction_value["AGGREGATION_FUNCTION_"+strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown aggregation function '%s'", name)
+		}
+		req.Functions = append(req.Functions, dataapiv1.AggregationFunction(value))
+	}
+	return req, nil
+}
+
+func (ts *TestSuite) sendAggregateRequestAndStoreResponse(ctx context.Context, req *dataapiv1.AggregateTelemetryRequest) error {
+	stream, err := ts.ApiClient.AggregateTelemetry(ctx, req)
+	if err != nil {
+		ts.LastError = err
+		return nil // Return nil so the test continues to the assertion step.
+	}
+
+	var receivedPoints []*dataapiv1.AggregatedPoint
+	for {
+		point, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			ts.LastError = err
+			return nil
+		}
+		receivedPoints = append(receivedPoints, point)
+	}
+	log.Printf("Received aggregates: %s", receivedPoints)
+	ts.LastAggregates = receivedPoints
+	ts.LastError = nil
+
+	return nil
+}
+
+func (ts *TestSuite) sendBatchRequestAndStoreResponse(ctx context.Context, req *dataapiv1.BatchGetTelemetryDataRequest) error {
+	stream, err := ts.ApiClient.BatchGetTelemetryData(ctx, req)
+	if err != nil {
+		ts.LastError = err
+		return nil // Return nil so the test continues to the assertion step.
+	}
+
+	var receivedPoints []*dataapiv1.TelemetryPoint
+	for {
+		point, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			ts.LastError = err
+			return nil
+		}
+		receivedPoints = append(receivedPoints, point)
+	}
+	log.Printf("Received points: %s", receivedPoints)
+	ts.LastResponse = receivedPoints
+	ts.LastError = nil
+
+	return nil
+}
+
 func (ts *TestSuite) sendRequestAndStoreResponse(ctx context.Context, req *dataapiv1.GetTelemetryDataRequest) error {
 	// Send the gRPC request.
 	stream, err := ts.ApiClient.GetTelemetryData(ctx, req)
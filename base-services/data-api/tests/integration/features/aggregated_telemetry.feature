@@ -0,0 +1,73 @@
+Feature: Telemetry Data API
+  As a data consuming service
+  I want to query aggregated vehicle telemetry
+  So that I can draw charts without pulling every raw point
+
+  Background:
+    Given the telemetry bigtable is available
+
+  Scenario: Get hourly aggregates for a specific time range
+    Given vehicle "VIN123456789ABCDEF" has the following telemetry data:
+      | timestamp                      | data_type     | value |
+      | 2024-01-15T07:50:00.000000000Z | dynamic:speed |  10.0 |
+      | 2024-01-15T08:10:00.000000000Z | dynamic:speed |  60.0 |
+      | 2024-01-15T08:40:00.000000000Z | dynamic:speed |  70.0 |
+      | 2024-01-15T08:50:00.000000000Z | dynamic:speed |  80.0 |
+      | 2024-01-15T10:05:00.000000000Z | dynamic:speed |  50.0 |
+    When I request the "min,max,avg,count" of telemetry data for vehicle "VIN123456789ABCDEF" from "2024-01-15T08:00:00.000000000Z" to "2024-01-15T11:00:00.000000000Z" in buckets of "1h" with data types:
+      | data_type     |
+      | dynamic:speed |
+    Then the resulting aggregates should be:
+      | bucket_start         | data_type     | function | value |
+      | 2024-01-15T08:00:00Z | dynamic:speed | min      |    60 |
+      | 2024-01-15T08:00:00Z | dynamic:speed | max      |    80 |
+      | 2024-01-15T08:00:00Z | dynamic:speed | avg      |    70 |
+      | 2024-01-15T08:00:00Z | dynamic:speed | count    |     3 |
+      | 2024-01-15T10:00:00Z | dynamic:speed | min      |    50 |
+      | 2024-01-15T10:00:00Z | dynamic:speed | max      |    50 |
+      | 2024-01-15T10:00:00Z | dynamic:speed | avg      |    50 |
+      | 2024-01-15T10:00:00Z | dynamic:speed | count    |     1 |
+
+  Scenario: Get aggregates of multiple data types for the last duration
+    Given vehicle "VIN123456789ABCDEF" has the following telemetry data:
+      | timestamp                      | data_type            | value   |
+      | 2024-01-15T10:00:00.000000000Z | dynamic:speed        |    60.0 |
+      | 2024-01-15T10:10:00.000000000Z | dynamic:location.lat | 52.5200 |
+      | 2024-01-15T10:20:00.000000000Z | dynamic:speed        |    70.0 |
+      | 2024-01-15T10:40:00.000000000Z | dynamic:location.lat | 52.5210 |
+    When I request the "first,last,sum" of telemetry data for vehicle "VIN123456789ABCDEF" for the last "1h" (since testing time) in buckets of "30m" with data types:
+      | data_type            |
+      | dynamic:speed        |
+      | dynamic:location.lat |
+    Then the resulting aggregates should be:
+      | bucket_start         | data_type            | function | value  |
+      | 2024-01-15T10:00:00Z | dynamic:speed        | first    |     60 |
+      | 2024-01-15T10:00:00Z | dynamic:speed        | last     |     70 |
+      | 2024-01-15T10:00:00Z | dynamic:speed        | sum      |    130 |
+      | 2024-01-15T10:00:00Z | dynamic:location.lat | first    |  52.52 |
+      | 2024-01-15T10:00:00Z | dynamic:location.lat | last     |  52.52 |
+      | 2024-01-15T10:00:00Z | dynamic:location.lat | sum      |  52.52 |
+      | 2024-01-15T10:30:00Z | dynamic:location.lat | first    | 52.521 |
+      | 2024-01-15T10:30:00Z | dynamic:location.lat | last     | 52.521 |
+      | 2024-01-15T10:30:00Z | dynamic:location.lat | sum      | 52.521 |
+
+  Scenario: Aggregating a non-numeric data type fails
+    Given vehicle "VIN123456789ABCDEF" has the following telemetry data:
+      | timestamp                      | data_type   | value     |
+      | 2024-01-15T10:00:00.000000000Z | static:make | Ford F150 |
+    When I request the "max" of telemetry data for vehicle "VIN123456789ABCDEF" for the last "1h" (since testing time) in buckets of "1h" with data types:
+      | data_type   |
+      | static:make |
+    Then the request should fail with code "InvalidArgument"
+
+  Scenario: Counting a non-numeric data type
+    Given vehicle "VIN123456789ABCDEF" has the following telemetry data:
+      | timestamp                      | data_type   | value     |
+      | 2024-01-15T10:00:00.000000000Z | static:make | Ford F150 |
+      | 2024-01-15T10:10:00.000000000Z | static:make | Ford F150 |
+    When I request the "count" of telemetry data for vehicle "VIN123456789ABCDEF" for the last "1h" (since testing time) in buckets of "1h" with data types:
+      | data_type   |
+      | static:make |
+    Then the resulting aggregates should be:
+      | bucket_start         | data_type   | function | value |
+      | 2024-01-15T10:00:00Z | static:make | count    |     2 |
@@ -0,0 +1,53 @@
+Feature: Batch Telemetry Data API
+  As a fleet dashboard
+  I want to query the telemetry of many vehicles at once
+  So that I don't need a request per vehicle
+
+  Background:
+    Given the telemetry bigtable is available
+
+  Scenario: Get telemetry data of several vehicles for the last hour
+    Given vehicle "VIN1" has the following telemetry data:
+      | timestamp                      | data_type     | value |
+      | 2024-01-15T09:30:00.000000000Z | dynamic:speed |    10 |
+      | 2024-01-15T10:30:00.000000000Z | dynamic:speed |    11 |
+    And vehicle "VIN10" has the following telemetry data:
+      | timestamp                      | data_type     | value |
+      | 2024-01-15T10:31:00.000000000Z | dynamic:speed |    20 |
+    And vehicle "VIN2" has the following telemetry data:
+      | timestamp                      | data_type     | value |
+      | 2024-01-15T10:32:00.000000000Z | dynamic:speed |    30 |
+      | 2024-01-15T10:33:00.000000000Z | dynamic:speed |    31 |
+    When I request telemetry data for vehicles "VIN1,VIN2,VIN3" for the last "1h" (since testing time) with data types:
+      | data_type     |
+      | dynamic:speed |
+    Then the resulting telemetry of the vehicles should be:
+      | vehicle_id | timestamp                      | data_type     | value |
+      | VIN1       | 2024-01-15T10:30:00.000000000Z | dynamic:speed |    11 |
+      | VIN2       | 2024-01-15T10:32:00.000000000Z | dynamic:speed |    30 |
+      | VIN2       | 2024-01-15T10:33:00.000000000Z | dynamic:speed |    31 |
+
+  Scenario: Get the latest telemetry data of all vehicles with a VIN prefix
+    Given vehicle "VIN1" has the following telemetry data:
+      | timestamp                      | data_type     | value |
+      | 2024-01-15T09:30:00.000000000Z | dynamic:speed |    10 |
+      | 2024-01-15T10:30:00.000000000Z | dynamic:speed |    11 |
+    And vehicle "VIN10" has the following telemetry data:
+      | timestamp                      | data_type     | value |
+      | 2024-01-15T10:31:00.000000000Z | dynamic:speed |    20 |
+    And vehicle "WVW1" has the following telemetry data:
+      | timestamp                      | data_type     | value |
+      | 2024-01-15T10:32:00.000000000Z | dynamic:speed |    30 |
+    When I request the latest telemetry data for vehicles with prefix "VIN1" with data types:
+      | data_type     |
+      | dynamic:speed |
+    Then the resulting telemetry of the vehicles should be:
+      | vehicle_id | timestamp                      | data_type     | value |
+      | VIN1       | 2024-01-15T10:30:00.000000000Z | dynamic:speed |    11 |
+      | VIN10      | 2024-01-15T10:31:00.000000000Z | dynamic:speed |    20 |
+
+  Scenario: Too many vehicles
+    When I request telemetry data for vehicles "VIN1,VIN2,VIN3,VIN4,VIN5,VIN6" for the last "1h" (since testing time) with data types:
+      | data_type     |
+      | dynamic:speed |
+    Then the request should fail with code "InvalidArgument"
@@ -0,0 +1,37 @@
+Feature: Paged Telemetry Data API
+  As a data consuming service
+  I want to query long time ranges in pages
+  So that I don't have to start over when the connection breaks
+
+  Background:
+    Given the telemetry bigtable is available
+
+  Scenario: Get telemetry data page by page with continuation tokens
+    Given vehicle "VIN123456789ABCDEF" has the following telemetry data:
+      | timestamp                      | data_type     | value |
+      | 2024-01-15T10:00:00.000000000Z | dynamic:speed |    10 |
+      | 2024-01-15T10:01:00.000000000Z | dynamic:speed |    11 |
+      | 2024-01-15T10:02:00.000000000Z | dynamic:speed |    12 |
+      | 2024-01-15T10:03:00.000000000Z | dynamic:speed |    13 |
+      | 2024-01-15T10:04:00.000000000Z | dynamic:speed |    14 |
+    When I request telemetry data for vehicle "VIN123456789ABCDEF" from "2024-01-15T09:00:00Z" to "2024-01-15T10:30:00Z" in pages of "2" with data types:
+      | data_type     |
+      | dynamic:speed |
+    Then the resulting telemetry should be:
+      | timestamp                      | data_type     | value |
+      | 2024-01-15T10:00:00.000000000Z | dynamic:speed |    10 |
+      | 2024-01-15T10:01:00.000000000Z | dynamic:speed |    11 |
+      | 2024-01-15T10:02:00.000000000Z | dynamic:speed |    12 |
+      | 2024-01-15T10:03:00.000000000Z | dynamic:speed |    13 |
+      | 2024-01-15T10:04:00.000000000Z | dynamic:speed |    14 |
+    And the telemetry should have been received in 3 pages
+
+  Scenario: Continue with a tampered continuation token
+    Given vehicle "VIN123456789ABCDEF" has the following telemetry data:
+      | timestamp                      | data_type     | value |
+      | 2024-01-15T10:00:00.000000000Z | dynamic:speed |    10 |
+    When I request telemetry data for vehicle "VIN123456789ABCDEF" from "2024-01-15T09:00:00Z" to "2024-01-15T10:30:00Z" in pages of "2" with data types:
+      | data_type     |
+      | dynamic:speed |
+    And I continue the request with the continuation token "eyJrIjoiVklOMTIzNDU2Nzg5QUJDREVGIn0.c2lnbmF0dXJl"
+    Then the request should fail with code "InvalidArgument"
@@ -0,0 +1,62 @@
+Feature: Live Telemetry Subscription
+  As a data consuming service
+  I want to subscribe to the telemetry of a vehicle
+  So that I receive new values as soon as the vehicle sends them
+
+  Background:
+    Given the telemetry bigtable is available
+
+  Scenario: Subscribe to the live telemetry without history
+    Given vehicle "VIN123456789ABCDEF" has the following telemetry data:
+      | timestamp                      | data_type            | value   |
+      | 2024-01-15T10:40:00.000000000Z | dynamic:location.lat | 52.5200 |
+    When I subscribe to the live telemetry for vehicle "VIN123456789ABCDEF" with data types:
+      | data_type            |
+      | dynamic:location.lat |
+    And vehicle "VIN123456789ABCDEF" publishes the following telemetry:
+      | timestamp                      | data_type            | value   |
+      | 2024-01-15T10:47:00.000000000Z | dynamic:location.lat | 52.5210 |
+      | 2024-01-15T10:47:00.000000000Z | dynamic:speed        | 50      |
+    Then the subscription should receive:
+      | timestamp                      | data_type            | value   |
+      | 2024-01-15T10:47:00.000000000Z | dynamic:location.lat | 52.5210 |
+
+  Scenario: Subscribe to the latest telemetry and continue live
+    Given vehicle "VIN123456789ABCDEF" has the following telemetry data:
+      | timestamp                      | data_type   | value     |
+      | 2024-01-15T10:30:00.000000000Z | static:make | Ford F150 |
+      | 2024-01-15T10:35:00.000000000Z | static:make | Ford F250 |
+    When I subscribe to the latest telemetry for vehicle "VIN123456789ABCDEF" with data types:
+      | data_type   |
+      | static:make |
+    And vehicle "VIN123456789ABCDEF" publishes the following telemetry:
+      | timestamp                      | data_type   | value     |
+      | 2024-01-15T10:47:00.000000000Z | static:make | Ford F350 |
+    Then the subscription should receive:
+      | timestamp                      | data_type   | value     |
+      | 2024-01-15T10:35:00.000000000Z | static:make | Ford F250 |
+      | 2024-01-15T10:47:00.000000000Z | static:make | Ford F350 |
+
+  Scenario: Values of the history are not sent again when they arrive live
+    Given vehicle "VIN123456789ABCDEF" has the following telemetry data:
+      | timestamp                      | data_type            | value   |
+      | 2024-01-15T10:00:00.000000000Z | dynamic:location.lat | 52.5200 |
+      | 2024-01-15T10:45:30.000000000Z | dynamic:location.lat | 52.5210 |
+    When I subscribe to telemetry for vehicle "VIN123456789ABCDEF" for the last "1h" (since testing time) with data types:
+      | data_type            |
+      | dynamic:location.lat |
+    And vehicle "VIN123456789ABCDEF" publishes the following telemetry:
+      | timestamp                      | data_type            | value   |
+      | 2024-01-15T10:45:30.000000000Z | dynamic:location.lat | 52.5210 |
+      | 2024-01-15T10:46:30.000000000Z | dynamic:location.lat | 52.5220 |
+    Then the subscription should receive:
+      | timestamp                      | data_type            | value   |
+      | 2024-01-15T10:00:00.000000000Z | dynamic:location.lat | 52.5200 |
+      | 2024-01-15T10:45:30.000000000Z | dynamic:location.lat | 52.5210 |
+      | 2024-01-15T10:46:30.000000000Z | dynamic:location.lat | 52.5220 |
+
+  Scenario: Subscribe with an invalid vehicle id
+    When I subscribe to the live telemetry for vehicle "VIN.*" with data types:
+      | data_type   |
+      | static:make |
+    Then the request should fail with code "InvalidArgument"
@@ -0,0 +1,80 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"data-api/api/gen/telemetry"
+
+	"github.com/cucumber/godog"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const natsURL = "nats://localhost:4222"
+
+func (ts *TestSuite) registerNatsSteps(ctx *godog.ScenarioContext) {
+	ctx.Step(`^vehicle "([^"]*)" publishes the following telemetry:$`, ts.vehiclePublishesTheFollowingTelemetry)
+}
+
+// vehiclePublishesTheFollowingTelemetry publishes the Gherkin table as one telemetry message, like a vehicle does.
+func (ts *TestSuite) vehiclePublishesTheFollowingTelemetry(ctx context.Context, vehicleID string, table *godog.Table) error {
+	msg := &telemetry.TelemetryMessage{
+		MessageId:     fmt.Sprintf("integration-test-%d", time.Now().UnixNano()),
+		SchemaVersion: 1,
+		DeviceId:      vehicleID,
+	}
+	for i := 1; i < len(table.Rows); i++ {
+		row := table.Rows[i]
+		if len(row.Cells) != 3 {
+			return fmt.Errorf("expected 3 columns in the data table (timestamp, data_type, value), but got %d", len(row.Cells))
+		}
+
+		timestamp, err := time.Parse(time.RFC3339Nano, row.Cells[0].Value)
+		if err != nil {
+			return fmt.Errorf("failed to parse timestamp in row %d: '%s': %w", i+1, row.Cells[0].Value, err)
+		}
+
+		// The family of the data type is the data type of the reading.
+		parts := strings.SplitN(row.Cells[1].Value, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid data_type format in row %d: expected 'family:qualifier', got '%s'", i+1, row.Cells[1].Value)
+		}
+		dataType := telemetry.DataType_STATIC
+		if parts[0] == "dynamic" {
+			dataType = telemetry.DataType_DYNAMIC
+		}
+
+		msg.SensorData = append(msg.SensorData, &telemetry.SensorReading{
+			Timestamp: timestamppb.New(timestamp),
+			Value:     row.Cells[2].Value,
+			DataType:  dataType,
+			Sensor:    parts[1],
+		})
+	}
+
+	// The memory source delivers directly, otherwise the message goes through NATS.
+	if ts.LiveSource != nil {
+		ts.LiveSource.Publish(msg)
+		return nil
+	}
+
+	if ts.NatsConn == nil {
+		nc, err := nats.Connect(natsURL)
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS at %s: %w", natsURL, err)
+		}
+		ts.NatsConn = nc
+	}
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := ts.NatsConn.Publish(fmt.Sprintf("telemetry.%s.integration-test", vehicleID), payload); err != nil {
+		return fmt.Errorf("failed to publish telemetry: %w", err)
+	}
+	return ts.NatsConn.Flush()
+}
@@ -2,20 +2,31 @@ package integration
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/bigtable"
 	"github.com/cucumber/godog"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 
 	dataapiv1 "data-api/api/gen/dataapi/v1"
+	"data-api/live"
+	"data-api/server"
+	"data-api/store"
 )
 
+// With "bigtable" the suite runs against the server, the Bigtable emulator and NATS from docker-compose.yml,
+// with "memory" it starts the server in the test with the in-memory store and live source.
+var storeFlag = flag.String("store", "memory", `storage backend to test against: "bigtable" or "memory"`)
+
 // TestSuite holds the shared state between steps for a single scenario.
 type TestSuite struct {
 	// Bigtable Emulator state
@@ -23,13 +34,31 @@ type TestSuite struct {
 	BtClient      *bigtable.Client
 	BtTable       *bigtable.Table
 
+	// The store the steps write the telemetry to
+	Store store.TelemetryStore
+
+	// In-process server for the memory store
+	GrpcServer *grpc.Server
+
+	// Live telemetry: the in-memory source, or the NATS connection the steps publish with
+	LiveSource *live.MemorySource
+	NatsConn   *nats.Conn
+
 	// gRPC Client
 	ApiClient dataapiv1.TelemetryDataAPIClient
 
 	// Test execution state
-	LastResponse []*dataapiv1.TelemetryPoint
-	LastError    error
-	CurrentTime  time.Time
+	LastRequest    *dataapiv1.GetTelemetryDataRequest
+	PageCount      int
+	LastResponse   []*dataapiv1.TelemetryPoint
+	LastAggregates []*dataapiv1.AggregatedPoint
+	LastError      error
+	CurrentTime    time.Time
+
+	// Live subscription state
+	CancelSubscription context.CancelFunc
+	SubscriptionPoints chan *dataapiv1.TelemetryPoint
+	SubscriptionError  chan error
 }
 
 // TestIntegration is the main entry point for running the Godog test suite.
@@ -40,6 +69,7 @@ func TestIntegration(t *testing.T) {
 		ScenarioInitializer: func(ctx *godog.ScenarioContext) {
 			// --- Register steps from all our step files ---
 			ts.registerBigtableSteps(ctx)
+			ts.registerNatsSteps(ctx)
 			ts.registerAPISteps(ctx)
 			ts.registerAssertSteps(ctx)
 
@@ -49,8 +79,15 @@ func TestIntegration(t *testing.T) {
 				ts.CurrentTime = time.Now()
 
 				// --- gRPC Client Setup ---
-				// The server runs in Docker in the background.
+				// The server runs in Docker in the background, unless the memory store is tested.
 				grpcServerAddr := "localhost:8080"
+				if *storeFlag == "memory" {
+					addr, err := ts.startMemoryServer()
+					if err != nil {
+						return ctx, err
+					}
+					grpcServerAddr = addr
+				}
 				conn, err := grpc.NewClient(grpcServerAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
 				if err != nil {
 					return ctx, fmt.Errorf("failed to dial gRPC server at %s: %w", grpcServerAddr, err)
@@ -63,7 +100,21 @@ func TestIntegration(t *testing.T) {
 			})
 
 			ctx.After(func(ctx context.Context, sc *godog.Scenario, err error) (context.Context, error) {
-				// --- gRPC and Bigtable Client Cleanup ---
+				// --- Subscription, NATS, gRPC and Bigtable Client Cleanup ---
+				if ts.CancelSubscription != nil {
+					ts.CancelSubscription()
+					ts.CancelSubscription = nil
+				}
+				ts.SubscriptionPoints = nil
+				ts.SubscriptionError = nil
+				if ts.NatsConn != nil {
+					ts.NatsConn.Close()
+					ts.NatsConn = nil
+				}
+				if ts.GrpcServer != nil {
+					ts.GrpcServer.Stop()
+					ts.GrpcServer = nil
+				}
 				if ts.BtClient != nil {
 					ts.BtClient.Close()
 				}
@@ -91,3 +142,29 @@ func TestIntegration(t *testing.T) {
 		t.Fatal("non-zero status returned, failed to run feature tests")
 	}
 }
+
+// Starts the server with a fresh in-memory store on a free port and returns its address.
+func (ts *TestSuite) startMemoryServer() (string, error) {
+	// The feature files are written for the fixed testing time
+	os.Setenv("TEST_ENV", "true")
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to listen: %w", err)
+	}
+
+	ts.Store = store.NewMemoryStore()
+	ts.LiveSource = live.NewMemorySource()
+	ts.GrpcServer = grpc.NewServer()
+	dataapiv1.RegisterTelemetryDataAPIServer(ts.GrpcServer, server.NewServer(zap.NewNop(), ts.Store, ts.LiveSource, server.Options{
+		MaxLookback:      365 * 24 * time.Hour,
+		HandoverWindow:   5 * time.Minute,
+		LiveBufferSize:   1000,
+		BatchParallelism: 2,
+		MaxBatchVehicles: 5,
+		TokenSecret:      []byte("test-secret"),
+	}))
+	go ts.GrpcServer.Serve(lis)
+
+	return lis.Addr().String(), nil
+}
@@ -424,6 +424,7 @@ add_secret() {
 add_secret "KEYCLOAK_GCP_SERVICE_ACCOUNT" "keycloak-gsa@${GCP_PROJECT_ID}.iam.gserviceaccount.com"
 add_secret "BIGTABLE_CONNECTOR_GCP_SERVICE_ACCOUNT" "bigtable-connector@${GCP_PROJECT_ID}.iam.gserviceaccount.com"
 add_secret "DATA_API_BIGTABLE_CONNECTOR_GCP_SERVICE_ACCOUNT" "data-api-bigtable-connector@${GCP_PROJECT_ID}.iam.gserviceaccount.com"
+add_secret "DATA_API_CONTINUATION_TOKEN_SECRET" "$(openssl rand -hex 32)"
 add_secret "KEYCLOAK_DB_PASSWORD" "${KEYCLOAK_DB_PASSWORD}"
 add_secret "KEYCLOAK_ADMIN_PASSWORD" "$(openssl rand -base64 32)"
 # NATS credentials:
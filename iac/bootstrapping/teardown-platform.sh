@@ -580,6 +580,7 @@ SECRETS_TO_DELETE=(
     "KEYCLOAK_GCP_SERVICE_ACCOUNT"
     "BIGTABLE_CONNECTOR_GCP_SERVICE_ACCOUNT"
     "DATA_API_BIGTABLE_CONNECTOR_GCP_SERVICE_ACCOUNT"
+    "DATA_API_CONTINUATION_TOKEN_SECRET"
     "KEYCLOAK_DB_PASSWORD"
     "KEYCLOAK_ADMIN_PASSWORD"
     "NATS_SERVER_USER"